@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cyberdelia/law/storage"
+)
+
+// setting represents a configuration key, and the environment variable it
+// sets.
+type setting struct {
+	key    string
+	env    string
+	secret bool
+}
+
+// settings lists the keys of the configuration file. Keys of the
+// environment table set the variable of the same name.
+var settings = []setting{
+	{key: "storage", env: "STORAGE_URL"},
+	{key: "database", env: "DATABASE_URL"},
+	{key: "compression", env: "LAW_COMPRESSION"},
+	{key: "concurrency", env: "S3_CONCURRENCY"},
+	{key: "rate_limit", env: "LAW_RATE_LIMIT"},
+	{key: "log.level", env: "LAW_LOG_LEVEL"},
+	{key: "log.format", env: "LAW_LOG_FORMAT"},
+	{key: "metrics.textfile", env: "LAW_METRICS_TEXTFILE"},
+	{key: "daemon.socket", env: "LAW_DAEMON_SOCKET"},
+	{key: "daemon.listen", env: "LAW_DAEMON_LISTEN"},
+	{key: "daemon.token", env: "LAW_DAEMON_TOKEN", secret: true},
+	{key: "backup.schedule", env: "LAW_BACKUP_SCHEDULE"},
+	{key: "backup.cluster", env: "LAW_BACKUP_CLUSTER"},
+	{key: "backup.retain", env: "LAW_BACKUP_RETAIN"},
+	{key: "backup.deltas", env: "LAW_BACKUP_DELTAS"},
+	{key: "hooks.pre_backup", env: "LAW_HOOK_PRE_BACKUP"},
+	{key: "hooks.post_backup", env: "LAW_HOOK_POST_BACKUP"},
+	{key: "hooks.backup_failure", env: "LAW_HOOK_BACKUP_FAILURE"},
+	{key: "hooks.pre_archive", env: "LAW_HOOK_PRE_ARCHIVE"},
+	{key: "hooks.post_archive", env: "LAW_HOOK_POST_ARCHIVE"},
+	{key: "hooks.archive_failure", env: "LAW_HOOK_ARCHIVE_FAILURE"},
+	{key: "hooks.pre_restore", env: "LAW_HOOK_PRE_RESTORE"},
+	{key: "hooks.post_restore", env: "LAW_HOOK_POST_RESTORE"},
+	{key: "hooks.restore_failure", env: "LAW_HOOK_RESTORE_FAILURE"},
+	{key: "notify.webhook_url", env: "LAW_NOTIFY_WEBHOOK_URL"},
+	{key: "notify.webhook_secret", env: "LAW_NOTIFY_WEBHOOK_SECRET", secret: true},
+	{key: "notify.smtp_addr", env: "LAW_NOTIFY_SMTP_ADDR"},
+	{key: "notify.smtp_from", env: "LAW_NOTIFY_SMTP_FROM"},
+	{key: "notify.smtp_to", env: "LAW_NOTIFY_SMTP_TO"},
+	{key: "notify.smtp_username", env: "LAW_NOTIFY_SMTP_USERNAME"},
+	{key: "notify.smtp_password", env: "LAW_NOTIFY_SMTP_PASSWORD", secret: true},
+	{key: "notify.archive_failures", env: "LAW_NOTIFY_ARCHIVE_FAILURES"},
+	{key: "notify.state", env: "LAW_NOTIFY_STATE"},
+	{key: "encryption.sse", env: "S3_SSE"},
+	{key: "encryption.kms_key_id", env: "S3_SSE_KMS_KEY_ID"},
+	{key: "encryption.customer_key", env: "S3_SSE_CUSTOMER_KEY", secret: true},
+}
+
+const environmentTable = "environment."
+
+// config represents the configuration file, and the values given by flags
+// which take precedence over it and the environment.
+type config struct {
+	path   string
+	values map[string]string
+	flags  map[string]string
+}
+
+// loadConfig reads the configuration file at the given path, an empty path
+// being an empty configuration.
+func loadConfig(path string) (*config, error) {
+	c := &config{
+		path:   path,
+		values: make(map[string]string),
+		flags:  make(map[string]string),
+	}
+	if path == "" {
+		return c, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if c.values, err = parseConfig(f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for key := range c.values {
+		if _, ok := lookupSetting(key); !ok {
+			return nil, fmt.Errorf("%s: unknown key %s", path, key)
+		}
+	}
+	return c, nil
+}
+
+func lookupSetting(key string) (setting, bool) {
+	if strings.HasPrefix(key, environmentTable) {
+		env := strings.TrimPrefix(key, environmentTable)
+		return setting{key: key, env: env, secret: secretName(env)}, true
+	}
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// apply sets the environment variables of the configuration which aren't
+// already set, as the environment takes precedence.
+func (c *config) apply() {
+	for key, value := range c.values {
+		s, _ := lookupSetting(key)
+		if _, ok := os.LookupEnv(s.env); !ok {
+			os.Setenv(s.env, value)
+		}
+	}
+}
+
+// get returns the value of the given environment variable, unless a flag
+// gave another one.
+func (c *config) get(env string) string {
+	if v, ok := c.flags[env]; ok {
+		return v
+	}
+	return os.Getenv(env)
+}
+
+// parseConfig parses a TOML configuration, limited to tables and keys of
+// string, integer and boolean values. Keys of tables are prefixed by the
+// name of their table.
+func parseConfig(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	var table string
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.Index(line, "]")
+			if end < 0 || !isComment(line[end+1:]) {
+				return nil, fmt.Errorf("line %d: invalid table", n)
+			}
+			table = strings.TrimSpace(line[1:end])
+			if !isBareKey(table) {
+				return nil, fmt.Errorf("line %d: invalid table name %q", n, table)
+			}
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key := strings.TrimSpace(line[:i])
+		if !isBareKey(key) {
+			return nil, fmt.Errorf("line %d: invalid key %q", n, key)
+		}
+		value, err := parseValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if table != "" {
+			key = table + "." + key
+		}
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %s", n, key)
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+func parseValue(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				if !isComment(s[i+1:]) {
+					return "", fmt.Errorf("unexpected %q after string", s[i+1:])
+				}
+				return strconv.Unquote(s[:i+1])
+			}
+		}
+		return "", fmt.Errorf("unterminated string")
+	case strings.HasPrefix(s, "'"):
+		end := strings.Index(s[1:], "'")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if !isComment(s[end+2:]) {
+			return "", fmt.Errorf("unexpected %q after string", s[end+2:])
+		}
+		return s[1 : end+1], nil
+	}
+	if i := strings.Index(s, "#"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	if s == "true" || s == "false" {
+		return s, nil
+	}
+	n, err := strconv.ParseInt(strings.Replace(s, "_", "", -1), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid value %q", s)
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+func isComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || s[0] == '#'
+}
+
+func isBareKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// secretName reports whether the environment variable likely holds a
+// secret.
+func secretName(env string) bool {
+	for _, s := range []string{"KEY", "SECRET", "TOKEN", "PASSWORD"} {
+		if strings.Contains(env, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// dsnPassword matches the password of a key=value connection string, quoted
+// or not.
+var dsnPassword = regexp.MustCompile(`(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s']\S*)`)
+
+// redact hides secrets of the given value, such as passwords of URLs and of
+// key=value connection strings.
+func redact(s setting, value string) string {
+	if s.secret {
+		return "REDACTED"
+	}
+	if u, err := url.Parse(value); err != nil || u.Scheme == "" {
+		return dsnPassword.ReplaceAllString(value, "${1}REDACTED")
+	}
+	return storage.RedactURL(value)
+}
+
+type configCmd struct {
+	fs *flag.FlagSet
+}
+
+func (cmd *configCmd) Name() string {
+	return "config"
+}
+
+func (cmd *configCmd) DefineFlags(fs *flag.FlagSet) {
+	cmd.fs = fs
+}
+
+func (cmd *configCmd) Run(ctx context.Context) int {
+	if cmd.fs.Arg(0) != "show" {
+		fatal("usage: law config show")
+	}
+	cmd.show(os.Stdout)
+	return exitSuccess
+}
+
+// show prints the effective configuration, with the source of each value,
+// once the configuration file is applied to the environment and flags
+// override both.
+func (cmd *configCmd) show(w io.Writer) {
+	all := append([]setting{}, settings...)
+	var env []string
+	for key := range cfg.values {
+		if strings.HasPrefix(key, environmentTable) {
+			env = append(env, key)
+		}
+	}
+	sort.Strings(env)
+	for _, key := range env {
+		s, _ := lookupSetting(key)
+		all = append(all, s)
+	}
+	if cfg.path != "" {
+		fmt.Fprintf(w, "# %s\n", cfg.path)
+	}
+	var table string
+	for _, s := range all {
+		value, ok := os.LookupEnv(s.env)
+		source := "env"
+		if v, ok := cfg.values[s.key]; ok && v == value {
+			source = "file"
+		}
+		if v, flag := cfg.flags[s.env]; flag {
+			value, ok, source = v, true, "flag"
+		}
+		if !ok {
+			continue
+		}
+		key := s.key
+		if i := strings.Index(key, "."); i >= 0 {
+			if table != key[:i] {
+				table = key[:i]
+				fmt.Fprintf(w, "\n[%s]\n", table)
+			}
+			key = key[i+1:]
+		}
+		fmt.Fprintf(w, "%s = %s # %s\n", key, strconv.Quote(redact(s, value)), source)
+	}
+}
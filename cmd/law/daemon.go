@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cyberdelia/law/daemon"
+	"github.com/cyberdelia/law/storage"
+)
+
+// shutdownTimeout bounds the time spent waiting for requests in flight once
+// the daemon is asked to stop.
+const shutdownTimeout = 30 * time.Second
+
+type daemonCmd struct {
+	listen   *string
+	token    *string
+	schedule *string
+	cluster  *string
+	retain   *int
+	deltas   *int
+	rate     *int
+}
+
+func (cmd *daemonCmd) Name() string {
+	return "daemon"
+}
+
+func (cmd *daemonCmd) DefineFlags(fs *flag.FlagSet) {
+	retain, _ := strconv.Atoi(os.Getenv("LAW_BACKUP_RETAIN"))
+	deltas, _ := strconv.Atoi(os.Getenv("LAW_BACKUP_DELTAS"))
+	rate, _ := strconv.Atoi(os.Getenv("LAW_RATE_LIMIT"))
+	cmd.listen = fs.String("listen", os.Getenv("LAW_DAEMON_LISTEN"), "TCP address serving the backups, status and metrics API")
+	cmd.token = fs.String("token", os.Getenv("LAW_DAEMON_TOKEN"), "Bearer token required by the TCP API, which only listens on loopback without one")
+	cmd.schedule = fs.String("schedule", os.Getenv("LAW_BACKUP_SCHEDULE"), "Cron expression of scheduled backups")
+	cmd.cluster = fs.String("cluster", os.Getenv("LAW_BACKUP_CLUSTER"), "Path of cluster directory of scheduled backups")
+	cmd.retain = fs.Int("retain", retain, "Number of backups kept once a backup completes, all when 0")
+	cmd.deltas = fs.Int("deltas", deltas, "Number of delta backups taken between full backups")
+	cmd.rate = fs.Int("rate-limit", rate, "Rate-limit i/o of scheduled backups")
+}
+
+func (cmd *daemonCmd) Run(ctx context.Context) int {
+	if *socket == "" {
+		fatal("daemon socket required")
+	}
+	var sched *daemon.Schedule
+	if *cmd.schedule != "" {
+		if *cmd.cluster == "" {
+			fatal("cluster directory of scheduled backups required")
+		}
+		var err error
+		if sched, err = daemon.ParseSchedule(*cmd.schedule); err != nil {
+			fatal("invalid schedule", "schedule", *cmd.schedule, "error", usageError{err})
+		}
+	}
+	if *cmd.retain < 0 {
+		fatal("invalid number of backups to retain", "retain", *cmd.retain)
+	}
+	if *cmd.deltas < 0 {
+		fatal("invalid number of delta backups", "deltas", *cmd.deltas)
+	}
+	if *cmd.listen != "" && *cmd.token == "" && !loopback(*cmd.listen) {
+		fatal("token required to listen beyond loopback", "address", *cmd.listen, "error", usageError{errors.New("daemon: missing token")})
+	}
+	o, err := newOperator(*storageURL)
+	if err != nil {
+		fatal("invalid storage", "storage", storage.RedactURL(*storageURL), "error", err)
+	}
+	o.SetDeltaBackups(*cmd.deltas)
+	srv := daemon.NewServer(ctx, o, storage.RedactURL(*storageURL))
+	srv.SetRetention(*cmd.retain)
+	srv.SetCluster(*cmd.cluster)
+	srv.SetToken(*cmd.token)
+	l, err := daemon.Listen(*socket)
+	if err != nil {
+		fatal("unable to listen", "socket", *socket, "error", err)
+	}
+	servers := []*http.Server{{Handler: srv.Handler()}}
+	listeners := []net.Listener{l}
+	if *cmd.listen != "" {
+		l, err := net.Listen("tcp", *cmd.listen)
+		if err != nil {
+			fatal("unable to listen", "address", *cmd.listen, "error", err)
+		}
+		servers = append(servers, &http.Server{Handler: srv.ControlHandler()})
+		listeners = append(listeners, l)
+	}
+	errc := make(chan error, len(servers))
+	for i, s := range servers {
+		go func(s *http.Server, l net.Listener) {
+			errc <- s.Serve(l)
+		}(s, listeners[i])
+	}
+	slog.Info("daemon started", "socket", *socket, "address", *cmd.listen, "storage", storage.RedactURL(*storageURL))
+	if sched != nil {
+		go srv.Schedule(sched, *cmd.cluster, *cmd.rate)
+	}
+
+	select {
+	case err := <-errc:
+		fatal("unable to serve", "error", err)
+	case <-ctx.Done():
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(shutdown); err != nil {
+			slog.Warn("unable to stop serving", "error", err)
+		}
+	}
+	srv.Wait()
+	slog.Info("daemon stopped")
+	return exitSuccess
+}
+
+// loopback reports whether the given TCP address only listens on the
+// loopback interface.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// daemonClient returns a client of the daemon when a socket is configured.
+func daemonClient() *daemon.Client {
+	if *socket == "" {
+		return nil
+	}
+	return daemon.NewClient(*socket)
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestLoopback(t *testing.T) {
+	tests := []struct {
+		addr     string
+		loopback bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"[::1]:8080", true},
+		{"localhost:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"10.0.0.1:8080", false},
+		{"example.com:8080", false},
+		{"8080", false},
+	}
+	for _, tt := range tests {
+		if loopback(tt.addr) != tt.loopback {
+			t.Errorf("loopback of %v don't match, wants %v", tt.addr, tt.loopback)
+		}
+	}
+}
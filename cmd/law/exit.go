@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/cyberdelia/law/daemon"
+	"github.com/cyberdelia/law/storage"
+)
+
+// Exit statuses of commands, letting scripts such as restore_command tell
+// failures apart.
+const (
+	exitSuccess   = 0
+	exitFailure   = 1 // Any other failure.
+	exitUsage     = 2 // Invalid arguments or configuration.
+	exitNotFound  = 3 // The segment, backup or file doesn't exist.
+	exitExist     = 4 // The segment already exists with a different content.
+	exitAuth      = 5 // Credentials are missing, invalid or not allowed.
+	exitTransient = 6 // The storage is unreachable, failing or locked.
+	exitCorrupt   = 7 // The data stored is corrupted.
+)
+
+// usageError is an error caused by invalid arguments or configuration,
+// such as a missing configuration file.
+type usageError struct {
+	error
+}
+
+func (e usageError) Unwrap() error {
+	return e.error
+}
+
+// exitStatus returns the exit status of a command failed with the given
+// error, nil or a usageError if it was given invalid arguments, or 128
+// plus the number of the signal which interrupted it if any, as shells do.
+func exitStatus(err error) int {
+	receivedMu.Lock()
+	defer receivedMu.Unlock()
+	if sig, ok := received.(syscall.Signal); ok {
+		return 128 + int(sig)
+	}
+	var (
+		netErr net.Error
+		usage  usageError
+	)
+	switch {
+	case err == nil, errors.As(err, &usage):
+		return exitUsage
+	case errors.Is(err, storage.ErrNotExist):
+		return exitNotFound
+	case errors.Is(err, storage.ErrExist):
+		return exitExist
+	case errors.Is(err, storage.ErrAuth), errors.Is(err, os.ErrPermission):
+		return exitAuth
+	case errors.Is(err, storage.ErrCorrupt):
+		return exitCorrupt
+	case errors.Is(err, storage.ErrTransient), errors.Is(err, storage.ErrLocked),
+		errors.Is(err, daemon.ErrUnavailable), errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr):
+		return exitTransient
+	default:
+		return exitFailure
+	}
+}
+
+// fatal logs the failure with the given attributes, and exits with the
+// status of the error among them, if any.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	writeMetrics()
+	os.Exit(exitStatus(failure(args)))
+}
+
+// failure returns the error among the given attributes, or nil if there is
+// none.
+func failure(args []interface{}) error {
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/cyberdelia/law/daemon"
+	"github.com/cyberdelia/law/storage"
+)
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{nil, exitUsage},
+		{usageError{&os.PathError{Op: "open", Path: "/etc/law.toml", Err: os.ErrNotExist}}, exitUsage},
+		{errors.New("failure"), exitFailure},
+		{&os.PathError{Op: "open", Path: "000000010000000000000001", Err: os.ErrNotExist}, exitNotFound},
+		{&storage.Error{Kind: storage.ErrExist, Err: errors.New("exists")}, exitExist},
+		{&storage.Error{Kind: storage.ErrAuth, Err: errors.New("no credentials")}, exitAuth},
+		{os.ErrPermission, exitAuth},
+		{&storage.Error{Kind: storage.ErrTransient, Err: errors.New("unreachable")}, exitTransient},
+		{fmt.Errorf("backup: %w", storage.ErrLocked), exitTransient},
+		{fmt.Errorf("%w: refused", daemon.ErrUnavailable), exitTransient},
+		{context.DeadlineExceeded, exitTransient},
+		{&storage.Error{Kind: storage.ErrCorrupt, Err: errors.New("checksum mismatch")}, exitCorrupt},
+	}
+	for _, tt := range tests {
+		if status := exitStatus(tt.err); status != tt.status {
+			t.Errorf("exit status of %v don't match, wants %d got %d", tt.err, tt.status, status)
+		}
+	}
+	err := errors.New("failure")
+	if failure([]interface{}{"segment", "000000010000000000000001", "error", err}) != err {
+		t.Error("failure should be found among attributes")
+	}
+}
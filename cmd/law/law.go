@@ -1,18 +1,28 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 
+	"github.com/cyberdelia/law/daemon"
+	"github.com/cyberdelia/law/metrics"
+	"github.com/cyberdelia/law/notify"
 	"github.com/cyberdelia/law/operator"
+	"github.com/cyberdelia/law/storage"
 )
 
-func init() {
-	log.SetPrefix("law: ")
-}
-
 type walPush struct {
 	segment *string
 }
@@ -25,19 +35,29 @@ func (cmd *walPush) DefineFlags(fs *flag.FlagSet) {
 	cmd.segment = fs.String("segment", "", "Path to a WAL segment to upload")
 }
 
-func (cmd *walPush) Run() {
+func (cmd *walPush) Run(ctx context.Context) int {
 	if *cmd.segment == "" {
-		log.Fatalln("wal segment required")
+		fatal("wal segment required")
 	}
-	log.Printf("uploading wal segment %s", *cmd.segment)
-	o, err := operator.NewOperator(*storage)
+	if c := daemonClient(); c != nil {
+		err := c.Archive(ctx, *cmd.segment)
+		if err == nil {
+			return exitSuccess
+		}
+		if !errors.Is(err, daemon.ErrUnavailable) {
+			fatal("unable to archive wal segment", "segment", filepath.Base(*cmd.segment), "socket", *socket, "error", err)
+		}
+		slog.Warn("daemon unavailable, archiving directly", "socket", *socket, "error", err)
+	}
+	o, err := newOperator(*storageURL)
 	if err != nil {
-		log.Fatal(err)
+		fatal("invalid storage", "storage", storage.RedactURL(*storageURL), "error", err)
 	}
-	if err = o.Archive(*cmd.segment); err != nil {
-		log.Fatal(err)
+	if err = o.Archive(ctx, *cmd.segment); err != nil {
+		fatal("unable to archive wal segment", "segment", filepath.Base(*cmd.segment),
+			"storage", storage.RedactURL(*storageURL), "error", err)
 	}
-	log.Printf("uploaded wal segment %s", *cmd.segment)
+	return exitSuccess
 }
 
 type walFetch struct {
@@ -54,22 +74,32 @@ func (cmd *walFetch) DefineFlags(fs *flag.FlagSet) {
 	cmd.destination = fs.String("destination", "", "Path of WAL segment locally")
 }
 
-func (cmd *walFetch) Run() {
+func (cmd *walFetch) Run(ctx context.Context) int {
 	if *cmd.segment == "" {
-		log.Fatalln("wal segment required")
+		fatal("wal segment required")
 	}
 	if *cmd.destination == "" {
-		log.Fatalln("wal destination required")
+		fatal("wal destination required")
 	}
-	log.Printf("downloading wal segment %s", *cmd.segment)
-	o, err := operator.NewOperator(*storage)
+	if c := daemonClient(); c != nil {
+		err := c.Unarchive(ctx, *cmd.segment, *cmd.destination)
+		if err == nil {
+			return exitSuccess
+		}
+		if !errors.Is(err, daemon.ErrUnavailable) {
+			fatal("unable to restore wal segment", "segment", *cmd.segment, "socket", *socket, "error", err)
+		}
+		slog.Warn("daemon unavailable, restoring directly", "socket", *socket, "error", err)
+	}
+	o, err := newOperator(*storageURL)
 	if err != nil {
-		log.Fatal(err)
+		fatal("invalid storage", "storage", storage.RedactURL(*storageURL), "error", err)
 	}
-	if err = o.Unarchive(*cmd.segment, *cmd.destination); err != nil {
-		log.Fatal(err)
+	if err = o.Unarchive(ctx, *cmd.segment, *cmd.destination); err != nil {
+		fatal("unable to restore wal segment", "segment", *cmd.segment,
+			"storage", storage.RedactURL(*storageURL), "error", err)
 	}
-	log.Printf("downloaded wal segment %s", *cmd.segment)
+	return exitSuccess
 }
 
 type backupPush struct {
@@ -82,28 +112,34 @@ func (cmd *backupPush) Name() string {
 }
 
 func (cmd *backupPush) DefineFlags(fs *flag.FlagSet) {
+	rate, _ := strconv.Atoi(os.Getenv("LAW_RATE_LIMIT"))
 	cmd.cluster = fs.String("cluster", "", "Path of cluster directory")
-	cmd.rate = fs.Int("rate-limit", 0, "Rate-limit i/o")
+	cmd.rate = fs.Int("rate-limit", rate, "Rate-limit i/o")
 }
 
-func (cmd *backupPush) Run() {
+func (cmd *backupPush) Run(ctx context.Context) int {
 	if *cmd.cluster == "" {
-		log.Fatalln("cluster directory required")
+		fatal("cluster directory required")
 	}
-	log.Printf("backuping %s", *cmd.cluster)
-	o, err := operator.NewOperator(*storage)
+	o, err := newOperator(*storageURL)
 	if err != nil {
-		log.Fatal(err)
+		fatal("invalid storage", "storage", storage.RedactURL(*storageURL), "error", err)
 	}
-	if err = o.Backup(*cmd.cluster, *cmd.rate); err != nil {
-		log.Fatal(err)
+	if err = o.Backup(ctx, *cmd.cluster, *cmd.rate); err != nil {
+		fatal("unable to backup cluster", "cluster", *cmd.cluster, "storage", storage.RedactURL(*storageURL), "error", err)
 	}
-	log.Printf("backuped %s", *cmd.cluster)
+	return exitSuccess
 }
 
 type backupFetch struct {
-	cluster *string
-	name    *string
+	cluster        *string
+	name           *string
+	targetTime     *string
+	targetLSN      *string
+	targetXID      *string
+	targetTimeline *string
+	standby        *bool
+	recover        *bool
 }
 
 func (cmd *backupFetch) Name() string {
@@ -113,57 +149,364 @@ func (cmd *backupFetch) Name() string {
 func (cmd *backupFetch) DefineFlags(fs *flag.FlagSet) {
 	cmd.cluster = fs.String("cluster", "", "Path of cluster directory")
 	cmd.name = fs.String("name", "", "Name of backup")
+	cmd.targetTime = fs.String("target-time", "", "Recover up to the given timestamp")
+	cmd.targetLSN = fs.String("target-lsn", "", "Recover up to the given WAL location")
+	cmd.targetXID = fs.String("target-xid", "", "Recover up to the given transaction ID")
+	cmd.targetTimeline = fs.String("target-timeline", "", "Recover into the given timeline")
+	cmd.standby = fs.Bool("standby", false, "Start as a standby server")
+	cmd.recover = fs.Bool("recover", false, "Configure recovery fetching WAL from storage, implied by a recovery target or -standby")
 }
 
-func (cmd *backupFetch) Run() {
+func (cmd *backupFetch) Run(ctx context.Context) int {
 	if *cmd.cluster == "" {
-		log.Fatalln("law: cluster directory required")
+		fatal("cluster directory required")
 	}
 	if *cmd.name == "" {
-		log.Fatalln("law: name of backup required")
+		fatal("name of backup required")
+	}
+	o, err := newOperator(*storageURL)
+	if err != nil {
+		fatal("invalid storage", "storage", storage.RedactURL(*storageURL), "error", err)
+	}
+	var recovery *operator.Recovery
+	if *cmd.recover || *cmd.standby || *cmd.targetTime != "" || *cmd.targetLSN != "" || *cmd.targetXID != "" || *cmd.targetTimeline != "" {
+		recovery = &operator.Recovery{
+			TargetTime:     *cmd.targetTime,
+			TargetLSN:      *cmd.targetLSN,
+			TargetXID:      *cmd.targetXID,
+			TargetTimeline: *cmd.targetTimeline,
+			Standby:        *cmd.standby,
+		}
+		if *configPath != "" {
+			if recovery.Config, err = filepath.Abs(*configPath); err != nil {
+				fatal("invalid configuration", "error", usageError{err})
+			}
+		} else if storage.RedactURL(*storageURL) != *storageURL {
+			slog.Warn("restore_command reads the storage holding credentials from STORAGE_URL of the server without a configuration file")
+		}
+	}
+	if err = o.Restore(ctx, *cmd.cluster, *cmd.name, recovery); err != nil {
+		fatal("unable to restore backup", "backup", *cmd.name, "cluster", *cmd.cluster,
+			"storage", storage.RedactURL(*storageURL), "error", err)
+	}
+	return exitSuccess
+}
+
+type walVerify struct {
+	segmentSize *int64
+	json        *bool
+}
+
+func (cmd *walVerify) Name() string {
+	return "wal-verify"
+}
+
+func (cmd *walVerify) DefineFlags(fs *flag.FlagSet) {
+	cmd.segmentSize = fs.Int64("segment-size", 0, "Size of WAL segments in bytes, detected when not set")
+	cmd.json = fs.Bool("json", false, "Output report as JSON")
+}
+
+func (cmd *walVerify) Run(ctx context.Context) int {
+	o, err := newOperator(*storageURL)
+	if err != nil {
+		fatal("invalid storage", "storage", storage.RedactURL(*storageURL), "error", err)
+	}
+	size := *cmd.segmentSize
+	if dsn := os.Getenv("DATABASE_URL"); size == 0 && dsn != "" {
+		if size, err = segmentSize(ctx, dsn); err != nil {
+			fatal("unable to detect segment size", "error", err)
+		}
+	}
+	report, err := o.Verify(ctx, size)
+	if err != nil {
+		fatal("unable to verify wal", "storage", storage.RedactURL(*storageURL), "error", err)
+	}
+	if *cmd.json {
+		if err = json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			fatal("unable to write report", "error", err)
+		}
+	} else {
+		fmt.Printf("timeline %d, newest segment %s\n", report.Timeline, report.Newest)
+		for _, b := range report.Backups {
+			fmt.Printf("%s: %d missing segments since %s\n", b.Name, len(b.Missing), b.Start)
+			for _, name := range b.Missing {
+				fmt.Printf("  %s\n", name)
+			}
+		}
+	}
+	if !report.Complete() {
+		return exitFailure
+	}
+	return exitSuccess
+}
+
+// segmentSize returns the size of WAL segments of the given database,
+// closing its connection once read.
+func segmentSize(ctx context.Context, dsn string) (int64, error) {
+	db, err := operator.NewDatabase(dsn)
+	if err != nil {
+		return 0, err
+	}
+	return db.SegmentSize(ctx)
+}
+
+type copyBackups struct {
+	from    *string
+	to      *string
+	backups *string
+	json    *bool
+}
+
+func (cmd *copyBackups) Name() string {
+	return "copy"
+}
+
+func (cmd *copyBackups) DefineFlags(fs *flag.FlagSet) {
+	cmd.from = fs.String("from", "", "Storage Source Name to copy from, defaults to -storage")
+	cmd.to = fs.String("to", "", "Storage Source Name to copy to, archives are copied as is without re-encoding their compression")
+	cmd.backups = fs.String("backups", "", "Comma separated names of backups to copy, all when not set")
+	cmd.json = fs.Bool("json", false, "Output report as JSON")
+}
+
+func (cmd *copyBackups) Run(ctx context.Context) int {
+	from := *cmd.from
+	if from == "" {
+		from = *storageURL
+	}
+	if from == "" {
+		fatal("source storage required")
+	}
+	if *cmd.to == "" {
+		fatal("destination storage required")
+	}
+	var backups []string
+	if *cmd.backups != "" {
+		backups = strings.Split(*cmd.backups, ",")
 	}
-	log.Printf("restoring backup %s to %s", *cmd.name, *cmd.cluster)
-	o, err := operator.NewOperator(*storage)
+	o, err := newOperator(from)
 	if err != nil {
-		log.Fatal(err)
+		fatal("invalid storage", "storage", storage.RedactURL(from), "error", err)
 	}
-	if err = o.Restore(*cmd.cluster, *cmd.name); err != nil {
-		log.Fatal(err)
+	report, err := o.Copy(ctx, *cmd.to, backups)
+	if report != nil {
+		if *cmd.json {
+			if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+				fatal("unable to write report", "error", err)
+			}
+		} else {
+			slog.Info("copied storage", "copied", report.Copied, "skipped", report.Skipped,
+				"backups", len(report.Backups), "segments", report.Segments)
+		}
+	}
+	if err != nil {
+		fatal("unable to copy storage",
+			"storage", storage.RedactURL(from), "destination", storage.RedactURL(*cmd.to), "error", err)
 	}
-	log.Printf("restored backup %s to %s", *cmd.name, *cmd.cluster)
+	return exitSuccess
+}
+
+type migrateLayout struct {
+	rewrite *bool
+	remove  *bool
+}
+
+func (cmd *migrateLayout) Name() string {
+	return "migrate-layout"
+}
+
+func (cmd *migrateLayout) DefineFlags(fs *flag.FlagSet) {
+	cmd.rewrite = fs.Bool("rewrite", false, "Copy archives of prior layouts into the current layout")
+	cmd.remove = fs.Bool("delete", false, "Delete archives of prior layouts once rewritten")
+}
+
+func (cmd *migrateLayout) Run(ctx context.Context) int {
+	if *cmd.remove && !*cmd.rewrite {
+		fatal("-delete requires -rewrite")
+	}
+	o, err := newOperator(*storageURL)
+	if err != nil {
+		fatal("invalid storage", "storage", storage.RedactURL(*storageURL), "error", err)
+	}
+	report, err := o.MigrateLayout(ctx, *cmd.rewrite, *cmd.remove)
+	if report != nil {
+		slog.Info("migrated layout", "versions", report.Versions, "rewritten", report.Rewritten)
+	}
+	if err != nil {
+		fatal("unable to migrate layout", "storage", storage.RedactURL(*storageURL), "error", err)
+	}
+	return exitSuccess
 }
 
 var (
 	cpuprofile = flag.String("cpuprofile", "", "CPU profile filepath")
 	memprofile = flag.String("memprofile", "", "Memory profile filepath")
-	storage    = flag.String("storage", os.Getenv("STORAGE_URL"), "Storage Source Name")
+	storageURL = flag.String("storage", os.Getenv("STORAGE_URL"), "Storage Source Name")
+	socket     = flag.String("socket", os.Getenv("LAW_DAEMON_SOCKET"), "Path of the Unix socket of the daemon")
+	configPath = flag.String("config", os.Getenv("LAW_CONFIG"), "Path to the configuration file")
+	logLevel   = flag.String("log-level", os.Getenv("LAW_LOG_LEVEL"), "Minimum level of logs: debug, info, warn or error")
+	logFormat  = flag.String("log-format", os.Getenv("LAW_LOG_FORMAT"), "Format of logs: text or json")
+	textfile   = flag.String("metrics-textfile", os.Getenv("LAW_METRICS_TEXTFILE"), "Path of a textfile collector file to write metrics to")
+
+	cfg *config
 )
 
+// envFlags maps flags to the environment variable they take precedence
+// over, and the value of which they are given once resolved.
+var envFlags = map[string]string{
+	"storage":          "STORAGE_URL",
+	"socket":           "LAW_DAEMON_SOCKET",
+	"log-level":        "LAW_LOG_LEVEL",
+	"log-format":       "LAW_LOG_FORMAT",
+	"metrics-textfile": "LAW_METRICS_TEXTFILE",
+}
+
+// withoutStorage lists the commands which don't use the -storage flag.
+var withoutStorage = map[string]bool{
+	"copy":   true,
+	"config": true,
+}
+
 func main() {
+	os.Exit(run())
+}
+
+// run runs the command given, returning its exit status once the profiles
+// and metrics are written.
+func run() int {
 	log.SetFlags(0)
 	flag.Parse()
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
-			log.Fatal(err)
+			fatal("unable to create cpu profile", "error", err)
 		}
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
 
-	if *storage == "" {
-		log.Fatalln("storage source name required")
+	// Flags take precedence over the environment, which takes precedence
+	// over the configuration file.
+	var err error
+	if cfg, err = loadConfig(*configPath); err != nil {
+		fatal("invalid configuration", "error", usageError{err})
+	}
+	cfg.apply()
+	flag.Visit(func(f *flag.Flag) {
+		if env, ok := envFlags[f.Name]; ok {
+			cfg.flags[env] = f.Value.String()
+		}
+	})
+	*storageURL = cfg.get("STORAGE_URL")
+	*socket = cfg.get("LAW_DAEMON_SOCKET")
+	*logLevel = cfg.get("LAW_LOG_LEVEL")
+	*logFormat = cfg.get("LAW_LOG_FORMAT")
+	*textfile = cfg.get("LAW_METRICS_TEXTFILE")
+	logger, err := newLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fatal("invalid logging configuration", "error", usageError{err})
+	}
+	slog.SetDefault(logger)
+	if c := os.Getenv("LAW_COMPRESSION"); c != "" && c != "lzo" {
+		fatal("unsupported compression", "compression", c)
 	}
 
-	Parse(new(walPush), new(walFetch), new(backupPush), new(backupFetch))
+	if *storageURL == "" && !withoutStorage[flag.Arg(0)] {
+		fatal("storage source name required")
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	status := Parse(ctx, new(walPush), new(walFetch), new(backupPush), new(backupFetch), new(walVerify), new(copyBackups), new(migrateLayout), new(daemonCmd), new(lockCmd), new(configCmd))
+	writeMetrics()
 
 	if *memprofile != "" {
 		f, err := os.Create(*memprofile)
 		if err != nil {
-			log.Fatal(err)
+			fatal("unable to create memory profile", "error", err)
 		}
 		pprof.WriteHeapProfile(f)
 		f.Close()
 	}
+	return status
+}
+
+// newOperator creates an operator of the given storage, running the hooks
+// configured in the environment.
+func newOperator(uri string) (*operator.Operator, error) {
+	o, err := operator.NewOperator(uri)
+	if err != nil {
+		return nil, err
+	}
+	o.SetHooks(operator.Hooks{
+		PreBackup:      os.Getenv("LAW_HOOK_PRE_BACKUP"),
+		PostBackup:     os.Getenv("LAW_HOOK_POST_BACKUP"),
+		BackupFailure:  os.Getenv("LAW_HOOK_BACKUP_FAILURE"),
+		PreArchive:     os.Getenv("LAW_HOOK_PRE_ARCHIVE"),
+		PostArchive:    os.Getenv("LAW_HOOK_POST_ARCHIVE"),
+		ArchiveFailure: os.Getenv("LAW_HOOK_ARCHIVE_FAILURE"),
+		PreRestore:     os.Getenv("LAW_HOOK_PRE_RESTORE"),
+		PostRestore:    os.Getenv("LAW_HOOK_POST_RESTORE"),
+		RestoreFailure: os.Getenv("LAW_HOOK_RESTORE_FAILURE"),
+	})
+	if n := newNotifier(); n != nil {
+		o.SetNotifier(n)
+		threshold := 3
+		if v := os.Getenv("LAW_NOTIFY_ARCHIVE_FAILURES"); v != "" {
+			if threshold, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("invalid LAW_NOTIFY_ARCHIVE_FAILURES: %v", err)
+			}
+		}
+		o.SetArchiveStreak(notify.NewStreak(streakPath(uri)), threshold)
+	}
+	return o, nil
+}
+
+// newNotifier returns the notifiers configured by the environment, or nil
+// if there are none.
+func newNotifier() notify.Notifier {
+	var m notify.Multi
+	if u := os.Getenv("LAW_NOTIFY_WEBHOOK_URL"); u != "" {
+		m = append(m, notify.NewWebhook(u, os.Getenv("LAW_NOTIFY_WEBHOOK_SECRET")))
+	}
+	if addr := os.Getenv("LAW_NOTIFY_SMTP_ADDR"); addr != "" {
+		var to []string
+		for _, t := range strings.Split(os.Getenv("LAW_NOTIFY_SMTP_TO"), ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				to = append(to, t)
+			}
+		}
+		m = append(m, notify.NewSMTP(addr, os.Getenv("LAW_NOTIFY_SMTP_FROM"), to,
+			os.Getenv("LAW_NOTIFY_SMTP_USERNAME"), os.Getenv("LAW_NOTIFY_SMTP_PASSWORD")))
+	}
+	switch len(m) {
+	case 0:
+		return nil
+	case 1:
+		return m[0]
+	}
+	return m
+}
+
+// streakPath returns the file counting consecutive archive failures, shared
+// by the successive runs of wal-push for the given storage.
+func streakPath(uri string) string {
+	if p := os.Getenv("LAW_NOTIFY_STATE"); p != "" {
+		return p
+	}
+	h := fnv.New32a()
+	io.WriteString(h, uri)
+	return filepath.Join(os.TempDir(), fmt.Sprintf("law-archive-failures-%08x", h.Sum32()))
+}
+
+// writeMetrics writes the metrics of the command to the textfile collector
+// file, when configured.
+func writeMetrics() {
+	path := *textfile
+	if path == "" {
+		return
+	}
+	if err := metrics.Default.WriteTextfile(path); err != nil {
+		slog.Warn("unable to write metrics", "path", path, "error", err)
+	}
 }
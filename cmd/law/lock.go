@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/cyberdelia/law/storage"
+)
+
+type lockCmd struct {
+	fs    *flag.FlagSet
+	json  *bool
+	force *bool
+}
+
+func (cmd *lockCmd) Name() string {
+	return "lock"
+}
+
+func (cmd *lockCmd) DefineFlags(fs *flag.FlagSet) {
+	cmd.fs = fs
+	cmd.json = fs.Bool("json", false, "Output lock as JSON")
+	cmd.force = fs.Bool("force", false, "Break the lock even if it hasn't expired")
+}
+
+func (cmd *lockCmd) Run(ctx context.Context) int {
+	action := cmd.fs.Arg(0)
+	if action != "status" && action != "break" {
+		fatal("usage: law lock status|break")
+	}
+	o, err := newOperator(*storageURL)
+	if err != nil {
+		fatal("invalid storage", "storage", storage.RedactURL(*storageURL), "error", err)
+	}
+	if action == "break" {
+		l, err := o.LockStatus(ctx)
+		if err != nil {
+			fatal("unable to read lock", "storage", storage.RedactURL(*storageURL), "error", err)
+		}
+		if l == nil {
+			slog.Info("storage not locked")
+			return exitSuccess
+		}
+		printLock(os.Stdout, l, time.Now())
+		if _, err := o.BreakLock(ctx, *cmd.force); errors.Is(err, storage.ErrLocked) {
+			fatal("lock not expired, break it with -force once its owner is known to be gone", "storage", storage.RedactURL(*storageURL), "error", err)
+		} else if err != nil {
+			fatal("unable to break lock", "storage", storage.RedactURL(*storageURL), "error", err)
+		}
+		return exitSuccess
+	}
+	l, err := o.LockStatus(ctx)
+	if err != nil {
+		fatal("unable to read lock", "storage", storage.RedactURL(*storageURL), "error", err)
+	}
+	if *cmd.json {
+		if err := json.NewEncoder(os.Stdout).Encode(l); err != nil {
+			fatal("unable to write lock", "error", err)
+		}
+		return exitSuccess
+	}
+	printLock(os.Stdout, l, time.Now())
+	return exitSuccess
+}
+
+// printLock prints the given lock, or that the storage isn't locked.
+func printLock(w io.Writer, l *storage.Lock, now time.Time) {
+	if l == nil {
+		fmt.Fprintln(w, "not locked")
+		return
+	}
+	state := "held"
+	if l.Expired(now) {
+		state = "expired"
+	}
+	fmt.Fprintf(w, "%s by %s for %s\n", state, l.Owner, l.Operation)
+	fmt.Fprintf(w, "host %s, pid %d\n", l.Hostname, l.PID)
+	fmt.Fprintf(w, "acquired %s, heartbeat %s, expires %s\n",
+		l.Acquired.Format(time.RFC3339), l.Heartbeat.Format(time.RFC3339), l.Expires.Format(time.RFC3339))
+}
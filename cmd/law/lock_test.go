@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cyberdelia/law/storage"
+)
+
+func TestPrintLock(t *testing.T) {
+	acquired := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := &storage.Lock{
+		Owner:     "541ad63a28248d17",
+		Hostname:  "db1",
+		PID:       42,
+		Operation: "backup",
+		Acquired:  acquired,
+		Heartbeat: acquired.Add(time.Minute),
+		Expires:   acquired.Add(6 * time.Minute),
+	}
+	var tests = []struct {
+		lock     *storage.Lock
+		now      time.Time
+		expected string
+	}{
+		{nil, acquired, "not locked\n"},
+		{l, acquired.Add(2 * time.Minute), "held by 541ad63a28248d17 for backup\nhost db1, pid 42\n" +
+			"acquired 2017-06-01T12:00:00Z, heartbeat 2017-06-01T12:01:00Z, expires 2017-06-01T12:06:00Z\n"},
+		{l, acquired.Add(time.Hour), "expired by 541ad63a28248d17 for backup\nhost db1, pid 42\n" +
+			"acquired 2017-06-01T12:00:00Z, heartbeat 2017-06-01T12:01:00Z, expires 2017-06-01T12:06:00Z\n"},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		printLock(&b, tt.lock, tt.now)
+		if b.String() != tt.expected {
+			t.Errorf("output don't match, wants %q got %q", tt.expected, b.String())
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// newLogger returns a logger writing records of the given level and above,
+// as text or JSON. Text records have no time, as PostgreSQL records it when
+// capturing the output of commands.
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if level != "" {
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %s", level)
+		}
+	}
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{
+			Level: l,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		})), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: l})), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %s", format)
+	}
+}
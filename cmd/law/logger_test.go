@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var b bytes.Buffer
+	l, err := newLogger(&b, "warn", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Info("ignored")
+	l.Warn("archived wal segment", "segment", "000000010000000000000001")
+	expected := "level=WARN msg=\"archived wal segment\" segment=000000010000000000000001\n"
+	if b.String() != expected {
+		t.Errorf("output don't match, wants %q got %q", expected, b.String())
+	}
+
+	b.Reset()
+	if l, err = newLogger(&b, "", "json"); err != nil {
+		t.Fatal(err)
+	}
+	l.Debug("ignored")
+	l.Info("archived wal segment", "bytes", 3)
+	var record map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["level"] != "INFO" || record["bytes"] != 3.0 || record["time"] == nil {
+		t.Errorf("record don't match, got %v", record)
+	}
+}
+
+func TestNewInvalidLogger(t *testing.T) {
+	for _, test := range [][2]string{{"verbose", "text"}, {"info", "xml"}} {
+		if _, err := newLogger(&bytes.Buffer{}, test[0], test[1]); err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("expected error for %v, got %v", test, err)
+		}
+	}
+}
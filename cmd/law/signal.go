@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	receivedMu sync.Mutex
+	received   os.Signal
+)
+
+// signalContext returns a context cancelled on SIGINT or SIGTERM, letting
+// commands clean up in-flight work. A second signal terminates the process
+// immediately.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-c:
+			receivedMu.Lock()
+			received = sig
+			receivedMu.Unlock()
+			signal.Stop(c)
+			slog.Warn("received signal, shutting down", "signal", sig.String())
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(c)
+		cancel()
+	}
+}
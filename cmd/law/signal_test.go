@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignalContext(t *testing.T) {
+	ctx, cancel := signalContext()
+	defer cancel()
+	if status := exitStatus(errors.New("failure")); status != 1 {
+		t.Errorf("exit status don't match, wants 1 got %d", status)
+	}
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Skip(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not cancelled by signal")
+	}
+	defer func() {
+		receivedMu.Lock()
+		received = nil
+		receivedMu.Unlock()
+	}()
+	if status := exitStatus(errors.New("failure")); status != 143 {
+		t.Errorf("exit status don't match, wants 143 got %d", status)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -9,7 +10,7 @@ import (
 type subCommand interface {
 	Name() string
 	DefineFlags(*flag.FlagSet)
-	Run()
+	Run(context.Context) int
 }
 
 type subCommandParser struct {
@@ -17,8 +18,9 @@ type subCommandParser struct {
 	fs  *flag.FlagSet
 }
 
-// Parse parses all given subCommands.
-func Parse(commands ...subCommand) {
+// Parse parses all given subCommands, and runs the one given with the
+// context, returning its exit status.
+func Parse(ctx context.Context, commands ...subCommand) int {
 	scp := make(map[string]*subCommandParser, len(commands))
 	for _, cmd := range commands {
 		name := cmd.Name()
@@ -40,16 +42,15 @@ func Parse(commands ...subCommand) {
 
 	if flag.NArg() < 1 {
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
 	cmdname := flag.Arg(0)
 	if sc, ok := scp[cmdname]; ok {
 		sc.fs.Parse(flag.Args()[1:])
-		sc.cmd.Run()
-	} else {
-		fmt.Fprintf(os.Stderr, "error: %s is not a valid command", cmdname)
-		flag.Usage()
-		os.Exit(1)
+		return sc.cmd.Run(ctx)
 	}
+	fmt.Fprintf(os.Stderr, "error: %s is not a valid command", cmdname)
+	flag.Usage()
+	return exitUsage
 }
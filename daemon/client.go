@@ -0,0 +1,168 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ErrUnavailable is returned when the daemon can't be reached.
+var ErrUnavailable = errors.New("daemon: unavailable")
+
+// Client requests operations from a daemon listening on a Unix socket.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient creates a client of the daemon listening on the given socket.
+func NewClient(socket string) *Client {
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Archive archives the given wal segment, relative paths being resolved
+// from the working directory of the client.
+func (c *Client) Archive(ctx context.Context, segment string) error {
+	path, err := filepath.Abs(segment)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, "/wal-push", &walPushRequest{Segment: path}, nil)
+}
+
+// Unarchive restores the given wal segment to the destination, relative
+// paths being resolved from the working directory of the client.
+func (c *Client) Unarchive(ctx context.Context, name, dest string) error {
+	path, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, "/wal-fetch", &walFetchRequest{Segment: name, Destination: path}, nil)
+}
+
+// Backup starts a backup of the given cluster.
+func (c *Client) Backup(ctx context.Context, cluster string, rate int) (*BackupStatus, error) {
+	status := new(BackupStatus)
+	err := c.do(ctx, http.MethodPost, "/backups", &backupRequest{Cluster: cluster, RateLimit: rate}, status)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Backups returns the names of the stored backups.
+func (c *Client) Backups(ctx context.Context) ([]string, error) {
+	var resp backupsResponse
+	if err := c.do(ctx, http.MethodGet, "/backups", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Backups, nil
+}
+
+// Status returns the state of the daemon.
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	status := new(Status)
+	if err := c.do(ctx, http.MethodGet, "/status", nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://law"+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			e.Error = resp.Status
+		}
+		return &responseError{StatusCode: resp.StatusCode, Message: e.Error, Kind: e.Kind}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// responseError represents an operation failed by the daemon.
+type responseError struct {
+	StatusCode int
+	Message    string
+	Kind       string
+}
+
+func (e *responseError) Error() string {
+	return "daemon: " + e.Message
+}
+
+// Is reports whether the failure of the daemon is of the kind of the
+// target, such as storage.ErrNotExist.
+func (e *responseError) Is(target error) bool {
+	for _, k := range errorKinds {
+		if k.err == target && k.name == e.Kind {
+			return true
+		}
+	}
+	return target == os.ErrNotExist && e.StatusCode == http.StatusNotFound
+}
+
+// Listen listens on the given Unix socket, only accessible to the user.
+// A socket left by a daemon which didn't shut down cleanly is replaced.
+func Listen(socket string) (net.Listener, error) {
+	l, err := net.Listen("unix", socket)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("daemon: %s already in use", socket)
+		}
+		if err := os.Remove(socket); err != nil {
+			return nil, err
+		}
+		l, err = net.Listen("unix", socket)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,300 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cyberdelia/law/operator"
+	"github.com/cyberdelia/law/storage"
+)
+
+type fakeOperator struct {
+	mu       sync.Mutex
+	archived []string
+	backup   chan error
+	cluster  string
+	locked   bool
+	retained int
+	runs     []*operator.Run
+}
+
+func (o *fakeOperator) Archive(ctx context.Context, name string) error {
+	if filepath.Base(name) == "000000010000000000000003" {
+		return &storage.Error{Kind: storage.ErrExist, Err: errors.New("already archived")}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.archived = append(o.archived, name)
+	return nil
+}
+
+func (o *fakeOperator) Unarchive(ctx context.Context, name, dest string) error {
+	if name != "000000010000000000000001" {
+		return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return ioutil.WriteFile(dest, []byte("law"), 0600)
+}
+
+func (o *fakeOperator) Backup(ctx context.Context, cluster string, rate int) error {
+	o.mu.Lock()
+	o.cluster = cluster
+	locked := o.locked
+	o.mu.Unlock()
+	if locked {
+		return storage.ErrLocked
+	}
+	select {
+	case err := <-o.backup:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (o *fakeOperator) Backups(ctx context.Context) ([]string, error) {
+	return []string{"base_000000010000000000000002_00000028"}, nil
+}
+
+func (o *fakeOperator) Retain(ctx context.Context, keep int) (*operator.RetentionReport, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.retained = keep
+	return &operator.RetentionReport{Deleted: []string{"base_000000010000000000000001_00000028"}}, nil
+}
+
+func (o *fakeOperator) RecordRun(ctx context.Context, run *operator.Run) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.runs = append(o.runs, run)
+	return nil
+}
+
+func (o *fakeOperator) Runs(ctx context.Context, n int) ([]*operator.Run, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.runs) > n {
+		return o.runs[len(o.runs)-n:], nil
+	}
+	return o.runs, nil
+}
+
+func serve(t *testing.T, o Operator, retain int) (*Client, *Server, func()) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "law.sock")
+	l, err := Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := NewServer(ctx, o, "file:///tmp/law")
+	srv.SetRetention(retain)
+	hs := &http.Server{Handler: srv.Handler()}
+	go hs.Serve(l)
+	return NewClient(socket), srv, func() {
+		cancel()
+		hs.Close()
+		srv.Wait()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestWal(t *testing.T) {
+	o := new(fakeOperator)
+	c, srv, stop := serve(t, o, 0)
+	defer stop()
+	ctx := context.Background()
+
+	if err := c.Archive(ctx, "000000010000000000000001"); err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	expected := filepath.Join(wd, "000000010000000000000001")
+	if len(o.archived) != 1 || o.archived[0] != expected {
+		t.Errorf("archived segments don't match, wants %v got %v", expected, o.archived)
+	}
+
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "RECOVERYXLOG")
+	if err := c.Unarchive(ctx, "000000010000000000000001", dest); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(dest); err != nil || string(b) != "law" {
+		t.Errorf("restored segment don't match, got %q %v", b, err)
+	}
+	if err := c.Unarchive(ctx, "000000010000000000000002", dest); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing segment should not exist, got %v", err)
+	}
+
+	status, err := c.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Archived != 1 || status.Restored != 1 || status.Failed != 0 ||
+		status.LastArchived != "000000010000000000000001" || status.Storage != "file:///tmp/law" {
+		t.Errorf("status don't match, got %+v", status)
+	}
+	if s := srv.Status(); s.Archived != status.Archived {
+		t.Errorf("archived don't match, wants %v got %v", s.Archived, status.Archived)
+	}
+	if err := c.Archive(ctx, "000000010000000000000003"); !errors.Is(err, storage.ErrExist) || errors.Is(err, storage.ErrNotExist) {
+		t.Errorf("conflicting segment should fail with ErrExist, got %v", err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	o := &fakeOperator{backup: make(chan error)}
+	c, srv, stop := serve(t, o, 2)
+	defer stop()
+	ctx := context.Background()
+
+	backups, err := c.Backups(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || backups[0] != "base_000000010000000000000002_00000028" {
+		t.Errorf("backups don't match, got %v", backups)
+	}
+
+	b, err := c.Backup(ctx, "/var/lib/postgres", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Running || b.Cluster != "/var/lib/postgres" {
+		t.Errorf("backup status don't match, got %+v", b)
+	}
+	if _, err := c.Backup(ctx, "/var/lib/postgres", 0); err == nil {
+		t.Error("backup should be running")
+	}
+	o.backup <- errors.New("failed")
+
+	var status *Status
+	for i := 0; i < 100; i++ {
+		if status, err = c.Status(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if !status.Backup.Running {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Backup.Running || status.Backup.Finished == nil || status.Backup.Error != "failed" {
+		t.Errorf("backup status don't match, got %+v", status.Backup)
+	}
+	srv.Wait()
+	if o.retained != 0 {
+		t.Errorf("failed backup should not apply retention, got %v", o.retained)
+	}
+
+	if _, err := c.Backup(ctx, "/var/lib/postgres", 0); err != nil {
+		t.Fatal(err)
+	}
+	o.backup <- nil
+	srv.Wait()
+	if o.retained != 2 {
+		t.Errorf("backup should apply retention, got %v", o.retained)
+	}
+	if len(o.runs) != 2 || o.runs[0].Error != "failed" || o.runs[1].Error != "" ||
+		o.runs[1].Retention == nil || o.runs[1].Scheduled != nil {
+		t.Errorf("runs don't match, got %+v", o.runs)
+	}
+
+	o.mu.Lock()
+	o.locked = true
+	o.mu.Unlock()
+	if _, err := c.Backup(ctx, "/var/lib/postgres", 0); err != nil {
+		t.Fatal(err)
+	}
+	srv.Wait()
+	if status := srv.Status(); !strings.Contains(status.LastRun.Error, "locked") {
+		t.Errorf("backup of a locked storage should fail, got %+v", status.LastRun)
+	}
+}
+
+func TestControl(t *testing.T) {
+	o := &fakeOperator{backup: make(chan error, 1)}
+	o.backup <- nil
+	srv := NewServer(context.Background(), o, "mem://law")
+	srv.SetCluster("/var/lib/postgres")
+	srv.SetToken("secret")
+	ts := httptest.NewServer(srv.ControlHandler())
+	defer ts.Close()
+
+	tests := []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer law", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/backups", strings.NewReader(`{"cluster":"/tmp"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.token != "" {
+			req.Header.Set("Authorization", tt.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("status with %q don't match, wants %v got %v", tt.token, tt.status, resp.StatusCode)
+		}
+	}
+	srv.Wait()
+	if o.cluster != "/var/lib/postgres" {
+		t.Errorf("backed up cluster don't match, wants %v got %v", "/var/lib/postgres", o.cluster)
+	}
+}
+
+func TestFirstBackup(t *testing.T) {
+	sched, err := ParseSchedule("@daily")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := new(fakeOperator)
+	srv := NewServer(context.Background(), o, "mem://law")
+	now := time.Now()
+	if next := srv.firstBackup(sched); !next.After(now) {
+		t.Errorf("first backup should be scheduled, got %v", next)
+	}
+	o.runs = append(o.runs, &operator.Run{Started: now.AddDate(0, 0, -2)})
+	if next := srv.firstBackup(sched); next.After(time.Now()) {
+		t.Errorf("missed backup should be taken at once, got %v", next)
+	}
+	srv.skip("/var/lib/postgres", now, ErrBackupRunning)
+	if len(o.runs) != 2 || o.runs[1].Scheduled == nil || !strings.HasPrefix(o.runs[1].Error, "skipped") {
+		t.Errorf("skipped run don't match, got %+v", o.runs[1])
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewClient(filepath.Join(dir, "law.sock"))
+	if err := c.Archive(context.Background(), "000000010000000000000001"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("daemon should be unavailable, got %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	from := time.Date(2017, 6, 1, 12, 30, 15, 0, time.UTC) // Thursday
+	var tests = []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2017, 6, 1, 12, 31, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2017, 6, 1, 13, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2017, 6, 2, 0, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2017, 6, 2, 2, 30, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2017, 6, 1, 12, 40, 0, 0, time.UTC)},
+		{"0 3 * * 1-5", time.Date(2017, 6, 2, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * 7", time.Date(2017, 6, 4, 3, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2017, 6, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2017, 6, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		if next := s.Next(from); !next.Equal(tt.next) {
+			t.Errorf("%s: next don't match, wants %v got %v", tt.expr, tt.next, next)
+		}
+	}
+}
+
+func TestInvalidSchedule(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := ParseSchedule(expr); err == nil {
+			t.Errorf("%q should be invalid", expr)
+		}
+	}
+}
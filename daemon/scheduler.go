@@ -0,0 +1,98 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/cyberdelia/law/operator"
+)
+
+// wakeInterval bounds the time the scheduler sleeps, so the wall clock is
+// checked again after the host is suspended.
+const wakeInterval = time.Minute
+
+// Schedule takes backups of the given cluster on the schedule until the
+// context of the server is cancelled. A scheduled backup missed while the
+// daemon wasn't running, as found from the last recorded run, is taken at
+// once. A scheduled backup overlapping a running one is skipped, and
+// recorded as such. Delta backups are taken as set on the operator.
+func (s *Server) Schedule(sched *Schedule, cluster string, rate int) {
+	next := s.firstBackup(sched)
+	for !next.IsZero() {
+		s.mu.Lock()
+		s.status.NextBackup = &next
+		s.mu.Unlock()
+		s.log.Info("scheduled backup", "cluster", cluster, "at", next)
+		if !s.sleep(next) {
+			return
+		}
+		scheduled := next
+		if _, err := s.startBackup(cluster, rate, &scheduled); err != nil {
+			s.skip(cluster, scheduled, err)
+		}
+		next = sched.Next(time.Now())
+	}
+	s.log.Warn("schedule never matches", "cluster", cluster)
+}
+
+// firstBackup returns the time of the first scheduled backup.
+func (s *Server) firstBackup(sched *Schedule) time.Time {
+	now := time.Now()
+	runs, err := s.o.Runs(s.ctx, 1)
+	if err != nil {
+		s.log.Warn("unable to read last backup run", "error", err)
+	}
+	if len(runs) == 1 {
+		last := runs[0].Started
+		if runs[0].Scheduled != nil {
+			last = *runs[0].Scheduled
+		}
+		if due := sched.Next(last); !due.IsZero() && due.Before(now) {
+			s.log.Warn("missed scheduled backup", "scheduled", due, "last", last)
+			return now
+		}
+	}
+	return sched.Next(now)
+}
+
+// sleep waits until the given time, reporting false if the context of the
+// server is cancelled first.
+func (s *Server) sleep(until time.Time) bool {
+	for {
+		d := time.Until(until)
+		if d <= 0 {
+			return true
+		}
+		if d > wakeInterval {
+			d = wakeInterval
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-s.ctx.Done():
+			t.Stop()
+			return false
+		case <-t.C:
+		}
+	}
+}
+
+// skip records a scheduled backup which didn't start.
+func (s *Server) skip(cluster string, scheduled time.Time, cause error) {
+	s.log.Warn("skipped scheduled backup", "cluster", cluster, "scheduled", scheduled, "error", cause)
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	run := &operator.Run{
+		Cluster:   cluster,
+		Hostname:  hostname,
+		Scheduled: &scheduled,
+		Started:   now,
+		Finished:  now,
+		Error:     "skipped: " + cause.Error(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), recordTimeout)
+	defer cancel()
+	if err := s.o.RecordRun(ctx, run); err != nil {
+		s.log.Warn("unable to record backup run", "cluster", cluster, "error", err)
+	}
+}
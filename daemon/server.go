@@ -0,0 +1,456 @@
+// Package daemon implements a long-running process serving the operations
+// of law over HTTP, keeping storage connections open between requests.
+package daemon
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cyberdelia/law/metrics"
+	"github.com/cyberdelia/law/operator"
+	"github.com/cyberdelia/law/storage"
+)
+
+// Operator represents the operations served by the daemon.
+type Operator interface {
+	Archive(ctx context.Context, name string) error
+	Unarchive(ctx context.Context, name, dest string) error
+	Backup(ctx context.Context, cluster string, rate int) error
+	Backups(ctx context.Context) ([]string, error)
+	Retain(ctx context.Context, keep int) (*operator.RetentionReport, error)
+	RecordRun(ctx context.Context, run *operator.Run) error
+	Runs(ctx context.Context, n int) ([]*operator.Run, error)
+}
+
+// Status represents the state of the daemon.
+type Status struct {
+	Storage      string        `json:"storage"`
+	Started      time.Time     `json:"started"`
+	Archived     int64         `json:"archived"`
+	Restored     int64         `json:"restored"`
+	Failed       int64         `json:"failed"`
+	LastArchived string        `json:"last_archived,omitempty"`
+	Backup       *BackupStatus `json:"backup,omitempty"`
+	NextBackup   *time.Time    `json:"next_backup,omitempty"`
+	LastRun      *operator.Run `json:"last_run,omitempty"`
+}
+
+// BackupStatus represents the running or last backup.
+type BackupStatus struct {
+	Cluster  string     `json:"cluster"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Running  bool       `json:"running"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// recordTimeout bounds the time spent recording the outcome of a backup,
+// regardless of the daemon stopping.
+const recordTimeout = 30 * time.Second
+
+// ErrBackupRunning is returned when a backup is requested while another
+// one is running.
+var ErrBackupRunning = errors.New("daemon: backup already running")
+
+// Server serves the operations of an operator.
+type Server struct {
+	ctx     context.Context
+	o       Operator
+	log     *slog.Logger
+	wg      sync.WaitGroup
+	retain  int
+	cluster string
+	token   string
+
+	mu     sync.Mutex
+	status Status
+}
+
+// NewServer creates a server of the given operator, storing to the given
+// storage. Backups run until they complete or the context is cancelled.
+func NewServer(ctx context.Context, o Operator, storage string) *Server {
+	return &Server{
+		ctx: ctx,
+		o:   o,
+		log: slog.Default(),
+		status: Status{
+			Storage: storage,
+			Started: time.Now(),
+		},
+	}
+}
+
+// SetLogger sets the logger of the server.
+func (s *Server) SetLogger(l *slog.Logger) {
+	s.log = l
+}
+
+// SetRetention sets the number of backups kept once a backup completes,
+// all being kept when 0.
+func (s *Server) SetRetention(keep int) {
+	s.retain = keep
+}
+
+// SetCluster sets the cluster directory of requested backups. Backups
+// requested over the control API always back it up, while requests on the
+// Unix socket may name another one.
+func (s *Server) SetCluster(cluster string) {
+	s.cluster = cluster
+}
+
+// SetToken sets the token of requests to the control API, given as a
+// bearer token in their Authorization header. Requests aren't
+// authenticated when it is empty.
+func (s *Server) SetToken(token string) {
+	s.token = token
+}
+
+// Wait waits for the running backup to complete.
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+// Handler returns the HTTP handler of the whole API, including requests
+// reading and writing local files, only meant to be served on a Unix
+// socket.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wal-push", s.walPush)
+	mux.HandleFunc("/wal-fetch", s.walFetch)
+	s.control(mux, true)
+	return mux
+}
+
+// ControlHandler returns the HTTP handler of the API triggering and
+// listing backups, reporting the status and metrics, authenticating
+// requests with the token if set.
+func (s *Server) ControlHandler() http.Handler {
+	mux := http.NewServeMux()
+	s.control(mux, false)
+	return s.authenticate(mux)
+}
+
+// control registers the control API, backups of any cluster can only be
+// requested locally.
+func (s *Server) control(mux *http.ServeMux, local bool) {
+	mux.HandleFunc("/backups", func(w http.ResponseWriter, r *http.Request) {
+		s.backups(w, r, local)
+	})
+	mux.HandleFunc("/runs", s.runs)
+	mux.HandleFunc("/status", s.statusHandler)
+	mux.Handle("/metrics", metrics.Default)
+}
+
+func (s *Server) authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type walPushRequest struct {
+	Segment string `json:"segment"`
+}
+
+type walFetchRequest struct {
+	Segment     string `json:"segment"`
+	Destination string `json:"destination"`
+}
+
+type backupRequest struct {
+	Cluster   string `json:"cluster"`
+	RateLimit int    `json:"rate_limit"`
+}
+
+type backupsResponse struct {
+	Backups []string `json:"backups"`
+}
+
+type runsResponse struct {
+	Runs []*operator.Run `json:"runs"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Kind  string `json:"kind,omitempty"`
+}
+
+// errorKinds lists the errors classifying failures, reported to clients
+// by name.
+var errorKinds = []struct {
+	name string
+	err  error
+}{
+	{"not_found", storage.ErrNotExist},
+	{"exists", storage.ErrExist},
+	{"auth", storage.ErrAuth},
+	{"transient", storage.ErrTransient},
+	{"corrupt", storage.ErrCorrupt},
+	{"locked", storage.ErrLocked},
+}
+
+// errorKind returns the name of the kind of the error, if known.
+func errorKind(err error) string {
+	for _, k := range errorKinds {
+		if errors.Is(err, k.err) {
+			return k.name
+		}
+	}
+	return ""
+}
+
+func (s *Server) walPush(w http.ResponseWriter, r *http.Request) {
+	var req walPushRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if !filepath.IsAbs(req.Segment) {
+		writeError(w, http.StatusBadRequest, errors.New("absolute path of wal segment required"))
+		return
+	}
+	err := s.o.Archive(r.Context(), req.Segment)
+	s.mu.Lock()
+	if err == nil {
+		s.status.Archived++
+		s.status.LastArchived = filepath.Base(req.Segment)
+	} else {
+		s.status.Failed++
+	}
+	s.mu.Unlock()
+	if err != nil {
+		s.log.Error("unable to archive wal segment", "segment", filepath.Base(req.Segment), "error", err)
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) walFetch(w http.ResponseWriter, r *http.Request) {
+	var req walFetchRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.Segment == "" || !filepath.IsAbs(req.Destination) {
+		writeError(w, http.StatusBadRequest, errors.New("wal segment and absolute destination required"))
+		return
+	}
+	err := s.o.Unarchive(r.Context(), req.Segment, req.Destination)
+	s.mu.Lock()
+	if err == nil {
+		s.status.Restored++
+	} else if !errors.Is(err, storage.ErrNotExist) {
+		s.status.Failed++
+	}
+	s.mu.Unlock()
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotExist) {
+			s.log.Error("unable to restore wal segment", "segment", req.Segment, "error", err)
+		}
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) backups(w http.ResponseWriter, r *http.Request, local bool) {
+	switch r.Method {
+	case http.MethodGet:
+		names, err := s.o.Backups(r.Context())
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		if names == nil {
+			names = []string{}
+		}
+		writeJSON(w, http.StatusOK, &backupsResponse{Backups: names})
+	case http.MethodPost:
+		var req backupRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		cluster := s.cluster
+		if local && req.Cluster != "" {
+			cluster = req.Cluster
+		}
+		if cluster == "" {
+			writeError(w, http.StatusBadRequest, errors.New("cluster directory required"))
+			return
+		}
+		status, err := s.startBackup(cluster, req.RateLimit, nil)
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, status)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// startBackup starts a backup of the given cluster in the background,
+// unless one is already running.
+func (s *Server) startBackup(cluster string, rate int, scheduled *time.Time) (*BackupStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status.Backup != nil && s.status.Backup.Running {
+		return nil, ErrBackupRunning
+	}
+	s.status.Backup = &BackupStatus{
+		Cluster: cluster,
+		Started: time.Now(),
+		Running: true,
+	}
+	status := *s.status.Backup
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		run := s.backup(cluster, rate, scheduled)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.status.Backup.Running = false
+		s.status.Backup.Finished = &run.Finished
+		s.status.Backup.Error = run.Error
+		s.status.LastRun = run
+	}()
+	return &status, nil
+}
+
+// backup backs up the given cluster, applies the retention once it
+// completes, and records the outcome.
+func (s *Server) backup(cluster string, rate int, scheduled *time.Time) *operator.Run {
+	hostname, _ := os.Hostname()
+	run := &operator.Run{
+		Cluster:   cluster,
+		Hostname:  hostname,
+		Scheduled: scheduled,
+		Started:   time.Now(),
+	}
+	err := s.backupAndRetain(run, rate)
+	run.Finished = time.Now()
+	if err != nil {
+		run.Error = err.Error()
+		s.log.Error("unable to backup cluster", "cluster", cluster, "error", err)
+	}
+	// The outcome is recorded even once the daemon is stopping.
+	ctx, cancel := context.WithTimeout(context.Background(), recordTimeout)
+	defer cancel()
+	if err := s.o.RecordRun(ctx, run); err != nil {
+		s.log.Warn("unable to record backup run", "cluster", cluster, "error", err)
+	}
+	return run
+}
+
+func (s *Server) backupAndRetain(run *operator.Run, rate int) error {
+	if err := s.o.Backup(s.ctx, run.Cluster, rate); err != nil {
+		return err
+	}
+	if s.retain > 0 {
+		report, err := s.o.Retain(s.ctx, s.retain)
+		run.Retention = report
+		if err != nil {
+			return fmt.Errorf("retention: %w", err)
+		}
+	}
+	return nil
+}
+
+// Status returns the state of the daemon.
+func (s *Server) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	if status.Backup != nil {
+		b := *status.Backup
+		status.Backup = &b
+	}
+	return status
+}
+
+func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	status := s.Status()
+	writeJSON(w, http.StatusOK, &status)
+}
+
+func (s *Server) runs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	n := 20
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid number of runs"))
+			return
+		}
+	}
+	runs, err := s.o.Runs(r.Context(), n)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	if runs == nil {
+		runs = []*operator.Run{}
+	}
+	writeJSON(w, http.StatusOK, &runsResponse{Runs: runs})
+}
+
+// decode decodes the JSON body of a POST request, writing the error
+// response when it fails.
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrExist):
+		return http.StatusConflict
+	case errors.Is(err, context.Canceled), errors.Is(err, storage.ErrTransient), errors.Is(err, storage.ErrLocked):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, &errorResponse{Error: err.Error(), Kind: errorKind(err)})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
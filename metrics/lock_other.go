@@ -0,0 +1,8 @@
+//go:build !unix
+
+package metrics
+
+// lockFile doesn't lock on systems without flock.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,305 @@
+// Package metrics implements counters, gauges and histograms exposed in the
+// Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of histograms of durations, in
+// seconds.
+var DefaultBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+// Default is the registry of the metrics of law.
+var Default = NewRegistry()
+
+// Retries counts the requests retried after a failure, by operation, such
+// as the requests to S3 or the posts of webhooks.
+var Retries = NewCounter("law_retries_total",
+	"Requests retried after a failure.", "operation")
+
+// Registry holds metrics, written in their order of registration.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	family() family
+}
+
+// family represents the samples of a metric.
+type family struct {
+	name    string
+	help    string
+	typ     string
+	samples []sample
+}
+
+type sample struct {
+	series string
+	value  float64
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return new(Registry)
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) families() []family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	families := make([]family, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		families = append(families, m.family())
+	}
+	return families
+}
+
+// WriteTo writes the metrics of the registry in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	return writeFamilies(w, r.families())
+}
+
+// ServeHTTP writes the metrics of the registry in the Prometheus text
+// format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+func writeFamilies(w io.Writer, families []family) (int64, error) {
+	var b strings.Builder
+	for _, f := range families {
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range f.samples {
+			fmt.Fprintf(&b, "%s %s\n", s.series, formatValue(s.value))
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// vec holds the values of a metric by label values.
+type vec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	keys   []string
+	values map[string][]string
+}
+
+func newVec(name, help string, labels []string) vec {
+	return vec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string][]string),
+	}
+}
+
+// key returns the key of the given label values, remembering them.
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	if _, ok := v.values[key]; !ok {
+		v.keys = append(v.keys, key)
+		v.values[key] = append([]string(nil), values...)
+	}
+	return key
+}
+
+// series returns the name of the series with the given label values, and
+// extra labels.
+func (v *vec) series(name, key string, extra ...string) string {
+	values := v.values[key]
+	var pairs []string
+	for i, l := range v.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", l, strconv.Quote(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extra[i], strconv.Quote(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter represents a value which only increases.
+type Counter struct {
+	vec
+	counts map[string]float64
+}
+
+// NewCounter registers a counter with the given labels.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		vec:    newVec(name, help, labels),
+		counts: make(map[string]float64),
+	}
+	r.register(c)
+	return c
+}
+
+// Add adds the given value to the counter with the given label values.
+func (c *Counter) Add(v float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[c.key(values)] += v
+}
+
+// Inc increments the counter with the given label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Value returns the value of the counter with the given label values.
+func (c *Counter) Value(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[c.key(values)]
+}
+
+func (c *Counter) family() family {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := family{name: c.name, help: c.help, typ: "counter"}
+	for _, key := range c.keys {
+		f.samples = append(f.samples, sample{c.series(c.name, key), c.counts[key]})
+	}
+	return f
+}
+
+// Gauge represents a value which can be set.
+type Gauge struct {
+	vec
+	gauges map[string]float64
+}
+
+// NewGauge registers a gauge with the given labels.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		vec:    newVec(name, help, labels),
+		gauges: make(map[string]float64),
+	}
+	r.register(g)
+	return g
+}
+
+// Set sets the gauge with the given label values.
+func (g *Gauge) Set(v float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.gauges[g.key(values)] = v
+}
+
+func (g *Gauge) family() family {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f := family{name: g.name, help: g.help, typ: "gauge"}
+	for _, key := range g.keys {
+		f.samples = append(f.samples, sample{g.series(g.name, key), g.gauges[key]})
+	}
+	return f
+}
+
+// Histogram represents the distribution of observed values in buckets.
+type Histogram struct {
+	vec
+	buckets []float64
+	counts  map[string][]uint64
+	sums    map[string]float64
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds
+// and labels.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{
+		vec:     newVec(name, help, labels),
+		buckets: buckets,
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe adds the given value to the histogram with the given label
+// values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := h.key(values)
+	counts, ok := h.counts[key]
+	if !ok {
+		counts = make([]uint64, len(h.buckets)+1)
+		h.counts[key] = counts
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			counts[i]++
+		}
+	}
+	counts[len(h.buckets)]++
+	h.sums[key] += v
+}
+
+func (h *Histogram) family() family {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f := family{name: h.name, help: h.help, typ: "histogram"}
+	for _, key := range h.keys {
+		counts := h.counts[key]
+		for i, upper := range h.buckets {
+			f.samples = append(f.samples, sample{h.series(h.name+"_bucket", key, "le", formatValue(upper)), float64(counts[i])})
+		}
+		f.samples = append(f.samples,
+			sample{h.series(h.name+"_bucket", key, "le", "+Inf"), float64(counts[len(h.buckets)])},
+			sample{h.series(h.name+"_sum", key), h.sums[key]},
+			sample{h.series(h.name+"_count", key), float64(counts[len(h.buckets)])},
+		)
+	}
+	return f
+}
+
+// NewCounter registers a counter in the default registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// NewGauge registers a gauge in the default registry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// NewHistogram registers a histogram in the default registry.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
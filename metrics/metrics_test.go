@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestRegistry() (*Registry, *Counter, *Gauge, *Histogram) {
+	r := NewRegistry()
+	c := r.NewCounter("law_operations_total", "Operations by result.", "operation", "result")
+	g := r.NewGauge("law_last_success_timestamp_seconds", "Time of the last success.", "operation")
+	h := r.NewHistogram("law_operation_duration_seconds", "Duration of operations.", []float64{1, 0.1}, "operation")
+	return r, c, g, h
+}
+
+func TestWriteTo(t *testing.T) {
+	r, c, g, h := newTestRegistry()
+	c.Inc("archive", "success")
+	c.Add(2, "archive", "failure")
+	g.Set(1500000000, "archive")
+	h.Observe(0.05, "archive")
+	h.Observe(0.5, "archive")
+	var b bytes.Buffer
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP law_operations_total Operations by result.
+# TYPE law_operations_total counter
+law_operations_total{operation="archive",result="success"} 1
+law_operations_total{operation="archive",result="failure"} 2
+# HELP law_last_success_timestamp_seconds Time of the last success.
+# TYPE law_last_success_timestamp_seconds gauge
+law_last_success_timestamp_seconds{operation="archive"} 1.5e+09
+# HELP law_operation_duration_seconds Duration of operations.
+# TYPE law_operation_duration_seconds histogram
+law_operation_duration_seconds_bucket{operation="archive",le="0.1"} 1
+law_operation_duration_seconds_bucket{operation="archive",le="1"} 2
+law_operation_duration_seconds_bucket{operation="archive",le="+Inf"} 2
+law_operation_duration_seconds_sum{operation="archive"} 0.55
+law_operation_duration_seconds_count{operation="archive"} 2
+`
+	if b.String() != expected {
+		t.Errorf("output don't match, wants\n%s\ngot\n%s", expected, b.String())
+	}
+}
+
+func TestWriteTextfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "law.prom")
+
+	r, c, g, h := newTestRegistry()
+	c.Inc("backup", "success")
+	c.Inc("archive", "success")
+	g.Set(1, "archive")
+	h.Observe(0.5, "archive")
+	if err := r.WriteTextfile(path); err != nil {
+		t.Fatal(err)
+	}
+	// A later run only archives.
+	r, c, g, h = newTestRegistry()
+	c.Inc("archive", "success")
+	g.Set(2, "archive")
+	h.Observe(2, "archive")
+	if err := r.WriteTextfile(path); err != nil {
+		t.Fatal(err)
+	}
+	families, err := readTextfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, f := range families {
+		for _, s := range f.samples {
+			values[s.series] = s.value
+		}
+	}
+	for series, expected := range map[string]float64{
+		`law_operations_total{operation="archive",result="success"}`:        2,
+		`law_operations_total{operation="backup",result="success"}`:         1,
+		`law_last_success_timestamp_seconds{operation="archive"}`:           2,
+		`law_operation_duration_seconds_bucket{operation="archive",le="1"}`: 1,
+		`law_operation_duration_seconds_count{operation="archive"}`:         2,
+		`law_operation_duration_seconds_sum{operation="archive"}`:           2.5,
+	} {
+		if values[series] != expected {
+			t.Errorf("%s don't match, wants %v got %v", series, expected, values[series])
+		}
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, ".law.prom.*"))
+	if len(matches) != 0 {
+		t.Errorf("temporary files should be removed, got %v", matches)
+	}
+}
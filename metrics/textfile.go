@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// WriteTextfile writes the metrics of the registry to the given file, read
+// by the textfile collector of the node exporter. Counters and histograms
+// are added to the ones of the existing file, so they accumulate across
+// runs of law, while gauges replace them. The file is replaced atomically,
+// under a lock held by processes updating it.
+func (r *Registry) WriteTextfile(path string) error {
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	previous, err := readTextfile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := writeFamilies(f, merge(r.families(), previous)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// readTextfile reads the metric families of a file written by WriteTextfile.
+func readTextfile(path string) ([]family, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var families []family
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			fields := strings.SplitN(strings.TrimPrefix(line, "# HELP "), " ", 2)
+			f := family{name: fields[0]}
+			if len(fields) == 2 {
+				f.help = fields[1]
+			}
+			families = append(families, f)
+		case strings.HasPrefix(line, "# TYPE ") && len(families) > 0:
+			fields := strings.Fields(strings.TrimPrefix(line, "# TYPE "))
+			if len(fields) == 2 {
+				families[len(families)-1].typ = fields[1]
+			}
+		case line == "" || strings.HasPrefix(line, "#") || len(families) == 0:
+		default:
+			i := strings.LastIndex(line, " ")
+			if i < 0 {
+				continue
+			}
+			value, err := strconv.ParseFloat(line[i+1:], 64)
+			if err != nil {
+				continue
+			}
+			f := &families[len(families)-1]
+			f.samples = append(f.samples, sample{line[:i], value})
+		}
+	}
+	return families, scanner.Err()
+}
+
+// merge adds the samples of previous counters and histograms to the
+// current ones, and keeps previous samples which weren't updated.
+func merge(current, previous []family) []family {
+	prev := make(map[string]family, len(previous))
+	for _, f := range previous {
+		prev[f.name] = f
+	}
+	merged := make([]family, 0, len(current)+len(previous))
+	for _, f := range current {
+		p, ok := prev[f.name]
+		delete(prev, f.name)
+		if ok && p.typ == f.typ {
+			index := make(map[string]int, len(f.samples))
+			for i, s := range f.samples {
+				index[s.series] = i
+			}
+			for _, s := range p.samples {
+				i, ok := index[s.series]
+				switch {
+				case !ok:
+					f.samples = append(f.samples, s)
+				case f.typ != "gauge":
+					f.samples[i].value += s.value
+				}
+			}
+		}
+		merged = append(merged, f)
+	}
+	for _, f := range previous {
+		if _, ok := prev[f.name]; ok {
+			merged = append(merged, f)
+		}
+	}
+	return merged
+}
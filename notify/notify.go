@@ -0,0 +1,137 @@
+// Package notify sends notifications of the outcome of operations, to HTTP
+// webhooks or by email.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of events.
+const (
+	BackupSucceeded  = "backup_succeeded"
+	BackupFailed     = "backup_failed"
+	ArchiveFailing   = "archive_failing"
+	RetentionApplied = "retention_applied"
+	RetentionFailed  = "retention_failed"
+)
+
+// Event represents the outcome of an operation, sent as a JSON payload.
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Storage  string    `json:"storage"`
+	Cluster  string    `json:"cluster,omitempty"`
+	Backup   string    `json:"backup,omitempty"`
+	Segment  string    `json:"segment,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Duration float64   `json:"duration,omitempty"`
+	Failures int       `json:"failures,omitempty"`
+	Kept     []string  `json:"kept,omitempty"`
+	Deleted  []string  `json:"deleted,omitempty"`
+	Segments int       `json:"segments,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Summary returns a one line description of the event.
+func (e *Event) Summary() string {
+	switch e.Type {
+	case BackupSucceeded:
+		return fmt.Sprintf("backup %s completed on %s", e.Backup, e.Hostname)
+	case BackupFailed:
+		return fmt.Sprintf("backup of %s failed on %s: %s", e.Cluster, e.Hostname, e.Error)
+	case ArchiveFailing:
+		return fmt.Sprintf("archiving failed %d times in a row on %s: %s", e.Failures, e.Hostname, e.Error)
+	case RetentionApplied:
+		return fmt.Sprintf("retention deleted %d backups and %d wal segments on %s", len(e.Deleted), e.Segments, e.Hostname)
+	case RetentionFailed:
+		return fmt.Sprintf("retention failed on %s: %s", e.Hostname, e.Error)
+	}
+	return fmt.Sprintf("%s on %s", e.Type, e.Hostname)
+}
+
+// Notifier represents a destination of notifications.
+type Notifier interface {
+	Notify(ctx context.Context, e *Event) error
+}
+
+// Multi sends notifications to every notifier.
+type Multi []Notifier
+
+// Notify sends the event to every notifier, returning their errors.
+func (m Multi) Notify(ctx context.Context, e *Event) error {
+	var errs []error
+	for _, n := range m {
+		if err := n.Notify(ctx, e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Streak counts consecutive failures, in a file shared by processes when
+// given a path, such as successive runs of an archive command.
+type Streak struct {
+	mu   sync.Mutex
+	path string
+	n    int
+}
+
+// NewStreak creates a streak stored in the given file, or in memory when
+// the path is empty.
+func NewStreak(path string) *Streak {
+	return &Streak{path: path}
+}
+
+// Fail records a failure, returning the number of consecutive failures.
+func (s *Streak) Fail() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" {
+		s.n++
+		return s.n, nil
+	}
+	n, err := s.read()
+	if err != nil {
+		return 0, err
+	}
+	n++
+	return n, ioutil.WriteFile(s.path, []byte(strconv.Itoa(n)+"\n"), 0600)
+}
+
+// Reset records a success, ending the streak.
+func (s *Streak) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n = 0
+	if s.path == "" {
+		return nil
+	}
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *Streak) read() (int, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("notify: invalid streak in %s: %v", s.path, err)
+	}
+	return n, nil
+}
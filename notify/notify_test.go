@@ -0,0 +1,221 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cyberdelia/law/metrics"
+)
+
+func TestWebhook(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts int
+		received []*Event
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if sig := r.Header.Get("X-Law-Signature"); sig != Sign("secret", body) {
+			t.Errorf("signature doesn't match, wants %v got %v", Sign("secret", body), sig)
+		}
+		if event := r.Header.Get("X-Law-Event"); event != BackupFailed {
+			t.Errorf("event doesn't match, wants %v got %v", BackupFailed, event)
+		}
+		e := new(Event)
+		if err := json.Unmarshal(body, e); err != nil {
+			t.Error(err)
+		}
+		received = append(received, e)
+	}))
+	defer ts.Close()
+
+	w := NewWebhook(ts.URL, "secret")
+	w.Backoff = time.Millisecond
+	e := &Event{Type: BackupFailed, Hostname: "db1", Cluster: "/var/lib/postgresql", Error: "boom"}
+	if err := w.Notify(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("attempts don't match, wants %v got %v", 2, attempts)
+	}
+	if len(received) != 1 || received[0].Error != "boom" || received[0].Cluster != e.Cluster {
+		t.Errorf("events don't match, wants %v got %v", e, received)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		status   int
+		attempts int
+	}{
+		{http.StatusInternalServerError, 3},
+		{http.StatusTooManyRequests, 3},
+		{http.StatusBadRequest, 1},
+	}
+	for _, tt := range tests {
+		attempts := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.WriteHeader(tt.status)
+		}))
+		w := NewWebhook(ts.URL, "")
+		w.Retries = 2
+		w.Backoff = time.Millisecond
+		retries := metrics.Retries.Value("webhook")
+		err := w.Notify(context.Background(), &Event{Type: RetentionApplied})
+		ts.Close()
+		if err == nil {
+			t.Errorf("status %d should fail", tt.status)
+		}
+		if attempts != tt.attempts {
+			t.Errorf("attempts don't match for %d, wants %v got %v", tt.status, tt.attempts, attempts)
+		}
+		if n := metrics.Retries.Value("webhook") - retries; n != float64(tt.attempts-1) {
+			t.Errorf("retries don't match for %d, wants %v got %v", tt.status, tt.attempts-1, n)
+		}
+	}
+}
+
+// serveSMTP accepts a single SMTP session on a local listener, sending the
+// recipients and the message received.
+func serveSMTP(t *testing.T) (string, <-chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var rcpt []string
+		var data []string
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "MAIL FROM:"):
+				reply("250 OK")
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				rcpt = append(rcpt, strings.TrimSpace(line[len("RCPT TO:"):]))
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data = append(data, strings.TrimRight(line, "\r\n"))
+				}
+				reply("250 OK")
+			case cmd == "QUIT":
+				reply("221 bye")
+				received <- append(rcpt, strings.Join(data, "\n"))
+				return
+			default:
+				reply("502 unknown command")
+			}
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+func TestSMTP(t *testing.T) {
+	addr, received := serveSMTP(t)
+	s := NewSMTP(addr, "law@example.com", []string{"ops@example.com", "dba@example.com"}, "", "")
+	e := &Event{
+		Type:     ArchiveFailing,
+		Time:     time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Hostname: "db1",
+		Segment:  "000000010000000000000001",
+		Failures: 3,
+		Error:    "timeout",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Notify(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+	got := <-received
+	rcpt, msg := got[:len(got)-1], got[len(got)-1]
+	if strings.Join(rcpt, ",") != "<ops@example.com>,<dba@example.com>" {
+		t.Errorf("recipients don't match, got %v", rcpt)
+	}
+	for _, expected := range []string{
+		"Subject: [law] archiving failed 3 times in a row on db1: timeout",
+		"X-Law-Event: archive_failing",
+		`"segment": "000000010000000000000001"`,
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("message doesn't contain %q, got %q", expected, msg)
+		}
+	}
+}
+
+func TestStreak(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "streak")
+	// Successive processes share the streak through its file.
+	for _, expected := range []int{1, 2, 3} {
+		n, err := NewStreak(path).Fail()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != expected {
+			t.Errorf("failures don't match, wants %v got %v", expected, n)
+		}
+	}
+	for _, s := range []*Streak{NewStreak(path), NewStreak("")} {
+		s.Fail()
+		if err := s.Reset(); err != nil {
+			t.Fatal(err)
+		}
+		n, err := s.Fail()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("failures after reset don't match, wants %v got %v", 1, n)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTP sends notifications by email, upgrading the connection with
+// STARTTLS when the server supports it.
+type SMTP struct {
+	Addr string
+	From string
+	To   []string
+	Auth smtp.Auth
+}
+
+// NewSMTP creates a notifier sending emails through the server at the
+// given address, authenticating with PLAIN when a username is given.
+func NewSMTP(addr, from string, to []string, username, password string) *SMTP {
+	s := &SMTP{Addr: addr, From: from, To: to}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		s.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s
+}
+
+// Notify sends the event as an email, with its summary as subject and its
+// JSON payload as body.
+func (s *SMTP) Notify(ctx context.Context, e *Event) error {
+	msg, err := s.message(e)
+	if err != nil {
+		return err
+	}
+	if err := s.send(ctx, msg); err != nil {
+		return fmt.Errorf("smtp: %v", err)
+	}
+	return nil
+}
+
+func (s *SMTP) message(e *Event) ([]byte, error) {
+	payload, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&b, "Subject: [law] %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(e.Summary()))
+	fmt.Fprintf(&b, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&b, "X-Law-Event: %s\r\n\r\n", e.Type)
+	fmt.Fprintf(&b, "%s\r\n\r\n", e.Summary())
+	b.Write(bytes.ReplaceAll(payload, []byte("\n"), []byte("\r\n")))
+	b.WriteString("\r\n")
+	return b.Bytes(), nil
+}
+
+func (s *SMTP) send(ctx context.Context, msg []byte) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Auth != nil {
+		if err := c.Auth(s.Auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.From); err != nil {
+		return err
+	}
+	for _, to := range s.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
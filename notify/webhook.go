@@ -0,0 +1,96 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cyberdelia/law/metrics"
+)
+
+// Webhook posts notifications to an HTTP endpoint. Payloads are signed
+// with the secret, if any, in the X-Law-Signature header as the hex encoded
+// HMAC-SHA256 of the body prefixed by "sha256=".
+type Webhook struct {
+	URL     string
+	Secret  string
+	Retries int
+	Backoff time.Duration
+	Client  *http.Client
+}
+
+// NewWebhook creates a webhook posting to the given URL, retrying failed
+// requests 3 times with an exponential backoff.
+func NewWebhook(url, secret string) *Webhook {
+	return &Webhook{
+		URL:     url,
+		Secret:  secret,
+		Retries: 3,
+		Backoff: time.Second,
+		Client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Notify posts the event, retrying on network errors and server errors.
+func (w *Webhook) Notify(ctx context.Context, e *Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(ctx, e.Type, body)
+		if err == nil || !retry || attempt >= w.Retries {
+			return err
+		}
+		t := time.NewTimer(w.Backoff << uint(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		metrics.Retries.Inc("webhook")
+	}
+}
+
+// post posts the payload, reporting whether a failed request should be
+// retried.
+func (w *Webhook) post(ctx context.Context, event string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "law")
+	req.Header.Set("X-Law-Event", event)
+	if w.Secret != "" {
+		req.Header.Set("X-Law-Signature", Sign(w.Secret, body))
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, fmt.Errorf("webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("webhook: unexpected status %s", resp.Status)
+	}
+	return false, nil
+}
+
+// Sign returns the signature of a payload with the given secret, as sent
+// in the X-Law-Signature header.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -6,7 +6,9 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
 const (
@@ -33,12 +35,37 @@ type Tape []*File
 
 // Partition creates multiple tapes for the given directory.
 func Partition(cluster string) (tapes []Tape, err error) {
-	var size int64
-	var tape Tape
 	files, err := walk(cluster)
 	if err != nil {
 		return nil, err
 	}
+	return partition(files)
+}
+
+// PartitionDelta creates multiple tapes for the files of the given
+// directory modified since the given time, along with its directories,
+// links and control file, returning the names of all its files as well so
+// files deleted since can be removed once restored.
+func PartitionDelta(cluster string, since time.Time) (tapes []Tape, names []string, err error) {
+	files, err := walk(cluster)
+	if err != nil {
+		return nil, nil, err
+	}
+	var changed []*File
+	for _, file := range files {
+		names = append(names, filepath.ToSlash(file.Rel))
+		if !file.FileInfo.Mode().IsRegular() || !file.FileInfo.ModTime().Before(since) ||
+			file.Rel == filepath.Join("global", "pg_control") {
+			changed = append(changed, file)
+		}
+	}
+	tapes, err = partition(changed)
+	return tapes, names, err
+}
+
+func partition(files []*File) (tapes []Tape, err error) {
+	var size int64
+	var tape Tape
 	for _, file := range files {
 		if file.FileInfo.Size() > MaxPartitionSize {
 			// File is bigger than the max size of partition
@@ -99,6 +126,7 @@ func (t Tape) Copy(w io.WriteCloser) error {
 }
 
 func walk(cluster string) (files []*File, err error) {
+	var control *File
 	err = filepath.Walk(cluster, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			// An error occured, stop processing
@@ -112,11 +140,18 @@ func walk(cluster string) (files []*File, err error) {
 		if err != nil {
 			return err
 		}
-		files = append(files, &File{
+		file := &File{
 			Path:     path,
 			Rel:      rel,
 			FileInfo: info,
-		})
+		}
+		if rel == filepath.Join("global", "pg_control") {
+			// pg_control must be archived last, so that a backup taken from
+			// a standby server is recovered up to its minimum recovery point.
+			control = file
+			return nil
+		}
+		files = append(files, file)
 		if keepEmpty(path) && info.IsDir() {
 			// We don't want to archive WAL files, nor temporary files, nor log
 			// files but we want to keep the directory that contains them.
@@ -124,9 +159,38 @@ func walk(cluster string) (files []*File, err error) {
 		}
 		return nil
 	})
+	if control != nil {
+		files = append(files, control)
+	}
 	return files, err
 }
 
+// writeFiles writes a tar archive of the given files content.
+func writeFiles(w io.WriteCloser, files map[string]string) error {
+	archive := tar.NewWriter(w)
+	defer archive.Close()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		header := &tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(files[name])),
+			ModTime: time.Now(),
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(archive, files[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Unite untar a partition for the given directory.
 func Unite(cluster string, partition io.ReadCloser) error {
 	archive := tar.NewReader(partition)
@@ -156,6 +220,29 @@ func Unite(cluster string, partition io.ReadCloser) error {
 	return nil
 }
 
+// removeDeleted removes the files of the given directory missing from the
+// given names, as deleted since the full backup a delta backup restored on
+// top of it is based on.
+func removeDeleted(cluster string, names []string) error {
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+	files, err := walk(cluster)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if keep[filepath.ToSlash(file.Rel)] {
+			continue
+		}
+		if err := os.RemoveAll(file.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func createFile(name string, mode os.FileMode) (*os.File, error) {
 	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
 		return nil, err
@@ -171,6 +258,7 @@ func ignoreFile(filename string) bool {
 	files := []string{
 		"postmaster.pid", "postmaster.opts", "postgresql.conf", "pg_hba.conf",
 		"recovery.conf", "recovery.done", "pg_ident.conf", "promote",
+		"recovery.signal", "standby.signal",
 	}
 	for _, file := range files {
 		if file == filename {
@@ -1,7 +1,12 @@
 package operator
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestFileString(t *testing.T) {
@@ -13,3 +18,74 @@ func TestFileString(t *testing.T) {
 		t.Fatalf("string don't match, wants %s got %s", "/tmp/file/path", path)
 	}
 }
+
+func TestWalkControlLast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"global/pg_control", "global/pg_filenode.map", "PG_VERSION", "postmaster.pid"} {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := walk(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Rel)
+	}
+	want := []string{".", "PG_VERSION", "global", "global/pg_filenode.map", "global/pg_control"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("files don't match, wants %v got %v", want, names)
+	}
+}
+
+func TestPartitionDelta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	since := time.Now().Add(-time.Hour)
+	for _, name := range []string{"global/pg_control", "PG_VERSION", "base/1", "base/2"} {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if name != "base/2" {
+			old := since.Add(-time.Hour)
+			if err := os.Chtimes(filename, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	tapes, names, err := PartitionDelta(dir, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changed []string
+	for _, tape := range tapes {
+		for _, file := range tape {
+			changed = append(changed, file.Rel)
+		}
+	}
+	want := []string{".", "base", "base/2", "global", "global/pg_control"}
+	if !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed files don't match, wants %v got %v", want, changed)
+	}
+	want = []string{".", "PG_VERSION", "base", "base/1", "base/2", "global", "global/pg_control"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("names don't match, wants %v got %v", want, names)
+	}
+}
@@ -0,0 +1,137 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cyberdelia/law/operator/xlog"
+	"github.com/cyberdelia/law/storage"
+)
+
+// CopyReport represents the backups and the number of WAL segments
+// considered, and the number of files copied to the destination or skipped
+// as already present.
+type CopyReport struct {
+	Backups  []string `json:"backups"`
+	Copied   int      `json:"copied"`
+	Segments int      `json:"segments"`
+	Skipped  int      `json:"skipped"`
+}
+
+// Copy copies the given backups, along with the full backups the delta
+// backups among them are based on, or all backups when none are given, to
+// the destination storage along with the WAL segments required to restore
+// them up to the newest archived segment, while holding the lock of the
+// source storage so retention doesn't delete them meanwhile. Files already
+// copied are skipped, so an interrupted copy can be resumed.
+func (o *Operator) Copy(ctx context.Context, dst string, backups []string) (report *CopyReport, err error) {
+	defer func(start time.Time) { observe("copy", start, err) }(time.Now())
+	err = o.withLock(ctx, "copy", func(ctx context.Context) error {
+		report, err = o.copy(ctx, dst, backups)
+		return err
+	})
+	return report, err
+}
+
+func (o *Operator) copy(ctx context.Context, dst string, backups []string) (report *CopyReport, err error) {
+	d, err := storage.NewStorage(dst)
+	if err != nil {
+		return nil, err
+	}
+	d.SetLogger(o.logger)
+	all, err := o.s.Backups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(backups) == 0 {
+		backups = all
+	}
+	size, err := o.segmentSize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range backups {
+		if !contains(all, name) {
+			return nil, fmt.Errorf("unknown backup: %s", name)
+		}
+	}
+	// Delta backups are copied along the full backups they are based on.
+	if backups, err = o.withBases(ctx, backups); err != nil {
+		return nil, err
+	}
+	// WAL segments preceding the oldest backup are only kept when copying
+	// everything.
+	var oldest *xlog.Segment
+	for _, name := range backups {
+		start, err := parseBackupName(name, size)
+		if err != nil {
+			return nil, err
+		}
+		if oldest == nil || start.Number < oldest.Number {
+			oldest = &start
+		}
+	}
+	if len(backups) == len(all) {
+		oldest = nil
+	}
+	report = &CopyReport{
+		Backups: backups,
+	}
+	segments, err := o.s.Segments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range segments {
+		if oldest != nil && !requiredSegment(name, *oldest, size) {
+			continue
+		}
+		copied, err := o.s.CopySegment(ctx, d, name)
+		if err != nil {
+			return report, err
+		}
+		if copied {
+			report.Copied++
+		} else {
+			report.Skipped++
+		}
+		report.Segments++
+		o.log.Debug("copied wal segment", "segment", name, "skipped", !copied, "destination", storage.RedactURL(dst))
+	}
+	// Backups are copied once their WAL is, as the WAL is required to
+	// restore them.
+	for _, name := range backups {
+		copied, skipped, err := o.s.CopyBackup(ctx, d, name)
+		report.Copied += copied
+		report.Skipped += skipped
+		if err != nil {
+			return report, err
+		}
+		o.log.Info("copied backup", "backup", name, "copied", copied, "skipped", skipped, "destination", storage.RedactURL(dst))
+	}
+	return report, nil
+}
+
+// requiredSegment reports whether the archived file is required to restore
+// backups starting at the given segment, whatever their timeline. Timeline
+// history files, and files which aren't named after a segment, are always
+// required.
+func requiredSegment(name string, oldest xlog.Segment, size int64) bool {
+	if len(name) < 24 {
+		return true
+	}
+	s, err := xlog.ParseSegment(name[:24], size)
+	if err != nil {
+		return true
+	}
+	return s.Number >= oldest.Number
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package operator
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cyberdelia/law/operator/xlog"
+	"github.com/cyberdelia/law/storage"
+)
+
+func TestCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	o, err := NewOperator("file://" + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"000000010000000000000001",
+		"000000010000000000000002",
+		"000000010000000000000003",
+		"000000010000000000000003.00000028.backup",
+		"00000002.history",
+		"000000020000000000000004",
+	} {
+		segment := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(segment, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.Archive(context.Background(), segment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"000000010000000000000001", "000000010000000000000003"} {
+		w, err := o.s.Backup(context.Background(), name, "00000028", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+	}
+
+	dst := "file://" + filepath.Join(dir, "copy")
+	report, err := o.Copy(context.Background(), dst, []string{"base_000000010000000000000003_00000028"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 5 || report.Skipped != 0 {
+		t.Errorf("counts don't match, wants 5 copied got %d, %d skipped", report.Copied, report.Skipped)
+	}
+	s, err := storage.NewStorage(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := s.Segments(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"000000010000000000000003",
+		"000000010000000000000003.00000028.backup",
+		"00000002.history",
+		"000000020000000000000004",
+	}
+	if !reflect.DeepEqual(segments, want) {
+		t.Errorf("segments don't match, wants %v got %v", want, segments)
+	}
+
+	report, err = o.Copy(context.Background(), dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 3 || report.Skipped != 5 {
+		t.Errorf("counts don't match, wants 3 copied got %d, %d skipped", report.Copied, report.Skipped)
+	}
+	backups, err := s.Backups(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Errorf("expected two backups, got %v", backups)
+	}
+
+	if _, err := o.Copy(context.Background(), dst, []string{"base_000000010000000000000009_00000028"}); err == nil {
+		t.Fatal("expected unknown backup")
+	}
+}
+
+func TestRequiredSegment(t *testing.T) {
+	oldest := xlog.Segment{Timeline: 2, Number: 0x100}
+	tests := []struct {
+		name     string
+		size     int64
+		required bool
+	}{
+		{"000000020000000100000000", xlog.DefaultSegmentSize, true},
+		{"0000000200000000000000FF", xlog.DefaultSegmentSize, false},
+		{"000000010000000100000001", xlog.DefaultSegmentSize, true},
+		{"0000000300000000000000FF.partial", xlog.DefaultSegmentSize, false},
+		{"0000000200000000000000FF.00000028.backup", xlog.DefaultSegmentSize, false},
+		{"00000002.history", xlog.DefaultSegmentSize, true},
+		{"00000002000000000000000Z", xlog.DefaultSegmentSize, true},
+		{"000000020000000000000100", 1024 * 1024, true},
+		{"0000000200000000000000FF", 1024 * 1024, false},
+		{"000000020000000000000003", 1024 * 1024 * 1024, false},
+	}
+	for _, tt := range tests {
+		if required := requiredSegment(tt.name, oldest, tt.size); required != tt.required {
+			t.Errorf("required %v don't match, wants %v got %v", tt.name, tt.required, required)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package operator
+
+import (
+	"context"
+	"time"
+)
+
+// deltaMargin is subtracted from the start of the full backup a delta
+// backup is based on, so files modified as it started are stored again
+// despite the resolution of modification times.
+const deltaMargin = time.Minute
+
+// baseBackup represents the full backup a delta backup is based on.
+type baseBackup struct {
+	*Metadata
+	name string
+}
+
+// deltaOf reports whether a delta backup starting with the given backup,
+// on the given host, can be based on the full backup. Modification times
+// only tell which files changed on the host which took the full backup,
+// and for the same cluster.
+func (b *baseBackup) deltaOf(start *Backup, hostname string) bool {
+	if b.StartTime.IsZero() || b.Hostname == "" || b.Hostname != hostname {
+		return false
+	}
+	if b.SystemIdentifier != 0 && start.SystemIdentifier != 0 && b.SystemIdentifier != start.SystemIdentifier {
+		return false
+	}
+	return start.backupName() != b.name
+}
+
+// deltaBase returns the newest full backup the next backup is a delta
+// backup of, or nil if a full backup must be taken, as no delta backups
+// are set or the newest full backup already has as many delta backups.
+func (o *Operator) deltaBase(ctx context.Context) (*baseBackup, error) {
+	if o.deltas < 1 {
+		return nil, nil
+	}
+	backups, err := o.s.Backups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	size, err := o.segmentSize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := sortBackups(backups, size); err != nil {
+		return nil, err
+	}
+	deltas := 0
+	for i := len(backups) - 1; i >= 0; i-- {
+		m, err := o.readMetadata(ctx, backups[i])
+		if err != nil || m == nil {
+			return nil, err
+		}
+		if m.Base == "" {
+			if deltas >= o.deltas {
+				return nil, nil
+			}
+			return &baseBackup{Metadata: m, name: backups[i]}, nil
+		}
+		deltas++
+	}
+	return nil, nil
+}
+
+// withBases returns the given backups along with the full backups the
+// delta backups among them are based on.
+func (o *Operator) withBases(ctx context.Context, backups []string) ([]string, error) {
+	names := append([]string(nil), backups...)
+	for _, name := range backups {
+		m, err := o.readMetadata(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if m == nil || m.Base == "" || contains(names, m.Base) {
+			continue
+		}
+		names = append(names, m.Base)
+	}
+	return names, nil
+}
@@ -0,0 +1,129 @@
+package operator
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// uploadBackup stores a backup of the given files and metadata, as if
+// taken starting at the given segment.
+func uploadBackup(t *testing.T, o *Operator, name string, files map[string]string, m *Metadata) {
+	ctx := context.Background()
+	backup := &Backup{Name: name, Offset: "00000028"}
+	_, _, err := o.upload(ctx, backup, 0, 0, func(w io.WriteCloser) error {
+		return writeFiles(w, files)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.writeMetadata(ctx, backup, backup, m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreDelta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	o, err := NewOperator("file://" + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadBackup(t, o, "000000010000000000000002", map[string]string{
+		"PG_VERSION": "12\n",
+		"base/1":     "full",
+		"base/2":     "deleted",
+	}, &Metadata{})
+	uploadBackup(t, o, "000000010000000000000004", map[string]string{
+		"base/1": "delta",
+	}, &Metadata{
+		Base:  "base_000000010000000000000002_00000028",
+		Files: []string{".", "PG_VERSION", "base", "base/1"},
+	})
+	cluster := filepath.Join(dir, "cluster")
+	if err := o.Restore(context.Background(), cluster, "base_000000010000000000000004_00000028", nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"PG_VERSION": "12\n", "base/1": "delta"} {
+		content, err := ioutil.ReadFile(filepath.Join(cluster, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Errorf("content of %s don't match, wants %q got %q", name, expected, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cluster, "base", "2")); !os.IsNotExist(err) {
+		t.Errorf("file deleted since the full backup should be removed, got %v", err)
+	}
+}
+
+func TestDeltaBase(t *testing.T) {
+	o, err := NewOperator("mem://delta-base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	hostname, _ := os.Hostname()
+	started := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	uploadBackup(t, o, "000000010000000000000002", nil, &Metadata{StartTime: started, Hostname: hostname})
+	if base, err := o.deltaBase(ctx); err != nil || base != nil {
+		t.Errorf("full backup should be taken without delta backups set, got %+v %v", base, err)
+	}
+	o.SetDeltaBackups(1)
+	base, err := o.deltaBase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base == nil || base.name != "base_000000010000000000000002_00000028" {
+		t.Fatalf("base don't match, got %+v", base)
+	}
+	var tests = []struct {
+		start    *Backup
+		hostname string
+		expected bool
+	}{
+		{&Backup{Name: "000000010000000000000004", Offset: "00000028"}, hostname, true},
+		{&Backup{Name: "000000010000000000000004", Offset: "00000028"}, "other", false},
+		{&Backup{Name: "000000010000000000000002", Offset: "00000028"}, hostname, false},
+	}
+	for _, tt := range tests {
+		if delta := base.deltaOf(tt.start, tt.hostname); delta != tt.expected {
+			t.Errorf("delta of %s on %s don't match, wants %v got %v", tt.start.Name, tt.hostname, tt.expected, delta)
+		}
+	}
+	uploadBackup(t, o, "000000010000000000000004", nil, &Metadata{Base: base.name})
+	if base, err := o.deltaBase(ctx); err != nil || base != nil {
+		t.Errorf("full backup should be taken once delta backups are taken, got %+v %v", base, err)
+	}
+}
+
+func TestRetainDeltas(t *testing.T) {
+	o, err := NewOperator("mem://retain-deltas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	uploadBackup(t, o, "000000010000000000000002", nil, &Metadata{})
+	uploadBackup(t, o, "000000010000000000000004", nil, &Metadata{})
+	uploadBackup(t, o, "000000010000000000000006", nil, &Metadata{Base: "base_000000010000000000000004_00000028"})
+	report, err := o.Retain(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &RetentionReport{
+		Kept:    []string{"base_000000010000000000000004_00000028", "base_000000010000000000000006_00000028"},
+		Deleted: []string{"base_000000010000000000000002_00000028"},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("report don't match, wants %+v got %+v", expected, report)
+	}
+}
@@ -0,0 +1,32 @@
+package operator
+
+import (
+	"errors"
+
+	"github.com/cyberdelia/law/storage"
+	"github.com/cyberdelia/lzo"
+)
+
+// ErrLiveCluster is returned when restoring a backup to the data directory
+// of a running cluster.
+var ErrLiveCluster = errors.New("attempt to overwrite a live data directory")
+
+// corrupted classifies failures to decompress a stored file as
+// storage.ErrCorrupt.
+func corrupted(err error) error {
+	if errors.Is(err, lzo.ErrHeader) || errors.Is(err, lzo.ErrCorrupt) {
+		return &storage.Error{Kind: storage.ErrCorrupt, Err: err}
+	}
+	return err
+}
+
+// destinationError is a failure to write a restored file, which doesn't
+// wrap the underlying error such that a missing destination directory
+// isn't mistaken for a missing file of the storage.
+type destinationError struct {
+	err error
+}
+
+func (e *destinationError) Error() string {
+	return "unable to write destination: " + e.err.Error()
+}
@@ -0,0 +1,151 @@
+package operator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cyberdelia/law/storage"
+	"github.com/cyberdelia/lzo"
+)
+
+func TestArchiveConflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	o, err := NewOperator("file://" + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment := filepath.Join(dir, "000000010000000000000001")
+	if err := ioutil.WriteFile(segment, []byte("law"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		// Archiving is retried once the segment was archived.
+		if err := o.Archive(context.Background(), segment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(segment, []byte("wal"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Archive(context.Background(), segment); !errors.Is(err, storage.ErrExist) {
+		t.Errorf("archiving a different segment should fail with ErrExist, got %v", err)
+	}
+	dest := filepath.Join(dir, "restored")
+	if err := o.Unarchive(context.Background(), "000000010000000000000001", dest); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(dest); string(b) != "law" {
+		t.Errorf("archived segment should be kept, got %q", b)
+	}
+}
+
+func TestArchiveTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	o, err := NewOperator("file://" + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("law"), 1024)
+	segment := filepath.Join(dir, "000000010000000000000001")
+	if err := ioutil.WriteFile(segment, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Archive(context.Background(), segment); err != nil {
+		t.Fatal(err)
+	}
+	// A segment left truncated by a previous attempt is overwritten.
+	archived := filepath.Join(dir, "storage", "wal_"+storage.CurrentVersion, "000000010000000000000001.lzo")
+	if err := os.Truncate(archived, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Archive(context.Background(), segment); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "restored")
+	if err := o.Unarchive(context.Background(), "000000010000000000000001", dest); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(dest); !bytes.Equal(b, content) {
+		t.Errorf("archived segment should be overwritten, got %d bytes", len(b))
+	}
+	// A failed upload is discarded.
+	unreadable := filepath.Join(dir, "000000010000000000000002")
+	if err := os.Mkdir(unreadable, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Archive(context.Background(), unreadable); err == nil {
+		t.Fatal("expected error archiving an unreadable segment")
+	}
+	segments, err := o.s.Segments(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Errorf("failed upload should be discarded, got %v", segments)
+	}
+}
+
+func TestUnarchiveMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	o, err := NewOperator("file://" + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment := filepath.Join(dir, "000000010000000000000001")
+	if err := ioutil.WriteFile(segment, []byte("law"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Archive(context.Background(), segment); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "restored")
+	if err := o.Unarchive(context.Background(), "000000010000000000000002", dest); !errors.Is(err, storage.ErrNotExist) {
+		t.Errorf("missing segment should fail with ErrNotExist, got %v", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("missing segment should not be restored, got %v", err)
+	}
+	// A missing destination directory isn't a missing segment.
+	dest = filepath.Join(dir, "missing", "restored")
+	if err := o.Unarchive(context.Background(), "000000010000000000000001", dest); err == nil || errors.Is(err, storage.ErrNotExist) {
+		t.Errorf("missing destination should not fail with ErrNotExist, got %v", err)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{context.Canceled, "canceled"},
+		{fmt.Errorf("open: %w", os.ErrNotExist), "not_found"},
+		{&storage.Error{Kind: storage.ErrExist, Err: errors.New("exists")}, "conflict"},
+		{&storage.Error{Kind: storage.ErrAuth, Err: errors.New("denied")}, "permission"},
+		{corrupted(lzo.ErrCorrupt), "corrupt"},
+		{&storage.Error{Kind: storage.ErrTransient, Err: errors.New("unreachable")}, "network"},
+		{ErrLiveCluster, "other"},
+	}
+	for _, tt := range tests {
+		if class := errorClass(tt.err); class != tt.class {
+			t.Errorf("class of %v don't match, wants %v got %v", tt.err, tt.class, class)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/cyberdelia/law/storage"
+)
+
+// hookTimeout bounds the time spent running post and failure hooks, which
+// run even once the operation is cancelled.
+const hookTimeout = 5 * time.Minute
+
+// Hooks represents shell commands run around operations, with environment
+// variables describing the operation. Pre hooks abort the operation when
+// they fail. Post hooks run once the operation completes or fails, after
+// their pre hook succeeded, and failure hooks only once it fails.
+type Hooks struct {
+	PreBackup      string
+	PostBackup     string
+	BackupFailure  string
+	PreArchive     string
+	PostArchive    string
+	ArchiveFailure string
+	PreRestore     string
+	PostRestore    string
+	RestoreFailure string
+}
+
+// SetHooks sets the hooks run around operations.
+func (o *Operator) SetHooks(h Hooks) {
+	o.hooks = h
+}
+
+// runHook runs the given hook command, if any, with the environment of the
+// operation.
+func (o *Operator) runHook(ctx context.Context, name, command string, env []string) error {
+	if command == "" {
+		return nil
+	}
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), "LAW_HOOK="+name, "LAW_STORAGE="+storage.RedactURL(o.ssn))
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook: %w", name, err)
+	}
+	o.log.Debug("ran hook", "hook", name, "duration", time.Since(start))
+	return nil
+}
+
+// afterHooks runs the post hook, unless empty as its pre hook failed, and
+// the failure hook of an operation once it completes or fails.
+func (o *Operator) afterHooks(ctx context.Context, operation, post, failure string, env []string, begin time.Time, err error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), hookTimeout)
+	defer cancel()
+	result := "success"
+	if err != nil {
+		result = "failure"
+		env = append(env, "LAW_ERROR="+err.Error())
+	}
+	env = append(env,
+		"LAW_RESULT="+result,
+		"LAW_DURATION="+strconv.FormatFloat(time.Since(begin).Seconds(), 'f', 3, 64),
+	)
+	if herr := o.runHook(ctx, "post_"+operation, post, env); herr != nil {
+		o.log.Warn("hook failed", "hook", "post_"+operation, "error", herr)
+	}
+	if err == nil {
+		return
+	}
+	if herr := o.runHook(ctx, operation+"_failure", failure, env); herr != nil {
+		o.log.Warn("hook failed", "hook", operation+"_failure", "error", herr)
+	}
+}
+
+// sizeEnv returns the environment describing the bytes of an operation,
+// before and after compression.
+func sizeEnv(uncompressed, compressed int64) []string {
+	return []string{
+		"LAW_SIZE=" + strconv.FormatInt(uncompressed, 10),
+		"LAW_COMPRESSED_SIZE=" + strconv.FormatInt(compressed, 10),
+	}
+}
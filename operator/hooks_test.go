@@ -0,0 +1,90 @@
+package operator
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArchiveHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	o, err := NewOperator("file://" + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "hooks")
+	record := `echo "$LAW_HOOK $LAW_SEGMENT $LAW_SIZE $LAW_RESULT $LAW_ERROR" >> ` + out
+	o.SetHooks(Hooks{
+		PreArchive:     record,
+		PostArchive:    record,
+		ArchiveFailure: record,
+	})
+	segment := filepath.Join(dir, "000000010000000000000001")
+	if err := ioutil.WriteFile(segment, []byte("law"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Archive(context.Background(), segment); err != nil {
+		t.Fatal(err)
+	}
+	o.SetHooks(Hooks{
+		PreArchive:     "exit 3",
+		PostArchive:    record,
+		ArchiveFailure: record,
+	})
+	err = o.Archive(context.Background(), filepath.Join(dir, "000000010000000000000002"))
+	if err == nil || !strings.Contains(err.Error(), "pre_archive hook") {
+		t.Errorf("failing pre hook should abort, got %v", err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "pre_archive 000000010000000000000001   \n" +
+		"post_archive 000000010000000000000001 3 success \n" +
+		"archive_failure 000000010000000000000002  failure pre_archive hook: exit status 3\n"
+	if string(b) != expected {
+		t.Errorf("hooks don't match, wants %q got %q", expected, b)
+	}
+}
+
+func TestRestoreHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	o, err := NewOperator("file://" + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup := &Backup{Name: "000000010000000000000002", Offset: "00000028"}
+	_, _, err = o.upload(context.Background(), backup, 0, 0, func(w io.WriteCloser) error {
+		return writeFiles(w, map[string]string{"PG_VERSION": "12\n"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "hooks")
+	o.SetHooks(Hooks{
+		PostRestore: `echo "$LAW_OPERATION $LAW_BACKUP $LAW_SIZE $LAW_RESULT" > ` + out,
+	})
+	cluster := filepath.Join(dir, "cluster")
+	if err := o.Restore(context.Background(), cluster, "base_000000010000000000000002_00000028", nil); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "restore base_000000010000000000000002_00000028 2048 success\n"; string(b) != expected {
+		t.Errorf("hooks don't match, wants %q got %q", expected, b)
+	}
+}
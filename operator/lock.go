@@ -0,0 +1,91 @@
+package operator
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cyberdelia/law/storage"
+)
+
+var (
+	// lockTTL is the duration of the lease of a storage, refreshed by the
+	// heartbeat of its owner.
+	lockTTL = 5 * time.Minute
+	// heartbeatInterval is the interval between refreshes of a lease.
+	heartbeatInterval = time.Minute
+)
+
+// withLock runs fn while holding the lock of the storage for the given
+// operation. The context of fn is cancelled once the lock is lost, such as
+// when it is broken or couldn't be refreshed before expiring.
+func (o *Operator) withLock(ctx context.Context, operation string, fn func(context.Context) error) error {
+	l, err := o.s.AcquireLock(ctx, operation, lockTTL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		o.heartbeat(ctx, l, done, cancel)
+	}()
+	err = fn(ctx)
+	close(done)
+	<-stopped
+	if cause := context.Cause(ctx); errors.Is(cause, storage.ErrLockLost) {
+		err = cause
+	}
+	// The lock is released even once the operation is cancelled.
+	release, cancelRelease := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancelRelease()
+	if rerr := o.s.ReleaseLock(release, l); rerr != nil {
+		o.log.Warn("unable to release lock", "operation", operation, "error", rerr)
+	}
+	return err
+}
+
+// heartbeat refreshes the given lock until done is closed, cancelling the
+// operation once the lock is lost.
+func (o *Operator) heartbeat(ctx context.Context, l *storage.Lock, done <-chan struct{}, cancel context.CancelCauseFunc) {
+	t := time.NewTicker(heartbeatInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		err := o.s.RefreshLock(ctx, l, lockTTL)
+		if err == nil {
+			continue
+		}
+		lost := errors.Is(err, storage.ErrLockLost) || errors.Is(err, storage.ErrLocked)
+		if !lost && time.Now().Before(l.Expires) {
+			o.log.Warn("unable to refresh lock", "operation", l.Operation, "expires", l.Expires, "error", err)
+			continue
+		}
+		if !errors.Is(err, storage.ErrLockLost) {
+			err = storage.ErrLockLost
+		}
+		o.log.Error("lost lock", "operation", l.Operation)
+		cancel(err)
+		return
+	}
+}
+
+// LockStatus returns the lock of the storage, or nil if it has none.
+func (o *Operator) LockStatus(ctx context.Context) (*storage.Lock, error) {
+	return o.s.LockStatus(ctx)
+}
+
+// BreakLock deletes the lock of the storage once expired, or regardless of
+// its owner when forced, such as left by a process which was killed,
+// returning the lock broken.
+func (o *Operator) BreakLock(ctx context.Context, force bool) (*storage.Lock, error) {
+	return o.s.BreakLock(ctx, force)
+}
@@ -0,0 +1,64 @@
+package operator
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cyberdelia/law/storage"
+)
+
+func TestWithLock(t *testing.T) {
+	defer func(ttl, interval time.Duration) {
+		lockTTL, heartbeatInterval = ttl, interval
+	}(lockTTL, heartbeatInterval)
+	lockTTL, heartbeatInterval = time.Second, 10*time.Millisecond
+
+	o, err := NewOperator("mem://with-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = o.withLock(ctx, "backup", func(ctx context.Context) error {
+		l, err := o.LockStatus(ctx)
+		if err != nil {
+			return err
+		}
+		if l == nil || l.Operation != "backup" {
+			t.Errorf("lock don't match, got %+v", l)
+		}
+		if _, err := o.Retain(ctx, 1); !errors.Is(err, storage.ErrLocked) {
+			t.Errorf("retention should be locked out, got %v", err)
+		}
+		if _, err := o.Copy(ctx, "mem://with-lock-copy", nil); !errors.Is(err, storage.ErrLocked) {
+			t.Errorf("copy should be locked out, got %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		refreshed, err := o.LockStatus(ctx)
+		if err != nil {
+			return err
+		}
+		if !refreshed.Heartbeat.After(l.Heartbeat) || !refreshed.Expires.After(l.Expires) {
+			t.Errorf("lock should be refreshed, got %+v", refreshed)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := o.LockStatus(ctx); err != nil || l != nil {
+		t.Errorf("lock should be released, got %+v %v", l, err)
+	}
+
+	err = o.withLock(ctx, "backup", func(ctx context.Context) error {
+		if _, err := o.BreakLock(ctx, true); err != nil {
+			return err
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, storage.ErrLockLost) {
+		t.Errorf("broken lock should be lost, got %v", err)
+	}
+}
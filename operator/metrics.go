@@ -0,0 +1,70 @@
+package operator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/cyberdelia/law/metrics"
+	"github.com/cyberdelia/law/storage"
+)
+
+var (
+	operationDuration = metrics.NewHistogram("law_operation_duration_seconds",
+		"Duration of operations, in seconds.", metrics.DefaultBuckets, "operation")
+	operations = metrics.NewCounter("law_operations_total",
+		"Operations by result.", "operation", "result")
+	operationFailures = metrics.NewCounter("law_operation_failures_total",
+		"Failed operations by class of error.", "operation", "class")
+	lastSuccess = metrics.NewGauge("law_last_success_timestamp_seconds",
+		"Time of the last successful operation, in seconds since epoch.", "operation")
+	uncompressedBytes = metrics.NewCounter("law_uncompressed_bytes_total",
+		"Bytes archived or restored, before compression.", "operation")
+	compressedBytes = metrics.NewCounter("law_compressed_bytes_total",
+		"Bytes uploaded or downloaded, after compression.", "operation")
+)
+
+// observe records the duration and the outcome of an operation started at
+// the given time.
+func observe(operation string, start time.Time, err error) {
+	operationDuration.Observe(time.Since(start).Seconds(), operation)
+	if err != nil {
+		operations.Inc(operation, "failure")
+		operationFailures.Inc(operation, errorClass(err))
+		return
+	}
+	operations.Inc(operation, "success")
+	lastSuccess.Set(float64(time.Now().Unix()), operation)
+}
+
+// transferred records the bytes of an operation, before and after
+// compression.
+func transferred(operation string, uncompressed, compressed int64) {
+	uncompressedBytes.Add(float64(uncompressed), operation)
+	compressedBytes.Add(float64(compressed), operation)
+}
+
+// errorClass returns the class of an error, as reported by metrics.
+func errorClass(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, os.ErrNotExist):
+		return "not_found"
+	case errors.Is(err, storage.ErrExist):
+		return "conflict"
+	case errors.Is(err, os.ErrPermission), errors.Is(err, storage.ErrAuth):
+		return "permission"
+	case errors.Is(err, storage.ErrCorrupt):
+		return "corrupt"
+	case errors.Is(err, storage.ErrTransient), errors.As(err, &netErr):
+		return "network"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,105 @@
+package operator
+
+import (
+	"context"
+	"os"
+	"path"
+	"time"
+
+	"github.com/cyberdelia/law/notify"
+	"github.com/cyberdelia/law/storage"
+)
+
+// notifyTimeout bounds the time spent sending a notification, which is
+// sent even once the operation is cancelled.
+const notifyTimeout = time.Minute
+
+// SetNotifier sets the notifier told of the outcome of backups, retention
+// runs and streaks of archive failures.
+func (o *Operator) SetNotifier(n notify.Notifier) {
+	o.notifier = n
+}
+
+// SetArchiveStreak sets the streak counting consecutive archive failures,
+// notifying every given number of failures.
+func (o *Operator) SetArchiveStreak(s *notify.Streak, threshold int) {
+	o.streak = s
+	o.threshold = threshold
+}
+
+// notify sends the event, if a notifier is set. Failing to notify doesn't
+// fail the operation.
+func (o *Operator) notify(ctx context.Context, e *notify.Event) {
+	if o.notifier == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notifyTimeout)
+	defer cancel()
+	e.Time = time.Now().UTC()
+	e.Hostname, _ = os.Hostname()
+	e.Storage = storage.RedactURL(o.ssn)
+	if err := o.notifier.Notify(ctx, e); err != nil {
+		o.log.Warn("unable to notify", "event", e.Type, "error", err)
+	}
+}
+
+// notifyBackup sends the outcome of a backup.
+func (o *Operator) notifyBackup(ctx context.Context, cluster string, r *backupResult, begin time.Time, err error) {
+	e := &notify.Event{
+		Type:     notify.BackupSucceeded,
+		Cluster:  cluster,
+		Size:     r.size,
+		Duration: time.Since(begin).Seconds(),
+	}
+	if r.start != nil {
+		e.Backup = r.start.backupName()
+	}
+	if err != nil {
+		e.Type = notify.BackupFailed
+		e.Error = err.Error()
+	}
+	o.notify(ctx, e)
+}
+
+// notifyRetention sends the outcome of a retention run.
+func (o *Operator) notifyRetention(ctx context.Context, report *RetentionReport, err error) {
+	e := &notify.Event{Type: notify.RetentionApplied}
+	if report != nil {
+		e.Kept = report.Kept
+		e.Deleted = report.Deleted
+		e.Segments = report.Segments
+	}
+	if err != nil {
+		e.Type = notify.RetentionFailed
+		e.Error = err.Error()
+	}
+	o.notify(ctx, e)
+}
+
+// archived records the outcome of archiving a wal segment in the streak of
+// failures, notifying every threshold consecutive failures.
+func (o *Operator) archived(ctx context.Context, name string, err error) {
+	if o.notifier == nil || o.streak == nil {
+		return
+	}
+	if err == nil {
+		if serr := o.streak.Reset(); serr != nil {
+			o.log.Warn("unable to reset archive failures", "error", serr)
+		}
+		return
+	}
+	n, serr := o.streak.Fail()
+	if serr != nil {
+		o.log.Warn("unable to count archive failures", "error", serr)
+		return
+	}
+	if o.threshold < 1 || n%o.threshold != 0 {
+		return
+	}
+	o.notify(ctx, &notify.Event{
+		Type:     notify.ArchiveFailing,
+		Segment:  path.Base(name),
+		Failures: n,
+		Error:    err.Error(),
+	})
+}
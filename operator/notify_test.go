@@ -0,0 +1,84 @@
+package operator
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cyberdelia/law/notify"
+)
+
+type notifier []*notify.Event
+
+func (n *notifier) Notify(ctx context.Context, e *notify.Event) error {
+	*n = append(*n, e)
+	return nil
+}
+
+func TestArchiveNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	o, err := NewOperator("file://" + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n notifier
+	o.SetNotifier(&n)
+	o.SetArchiveStreak(notify.NewStreak(""), 2)
+	missing := filepath.Join(dir, "000000010000000000000001")
+	for i := 0; i < 5; i++ {
+		if i == 3 {
+			// A success ends the streak.
+			segment := filepath.Join(dir, "000000010000000000000002")
+			if err := ioutil.WriteFile(segment, []byte("law"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := o.Archive(context.Background(), segment); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := o.Archive(context.Background(), missing); err == nil {
+			t.Fatal("archiving a missing segment should fail")
+		}
+	}
+	if len(n) != 2 {
+		t.Fatalf("notifications don't match, wants %v got %v", 2, len(n))
+	}
+	for i, expected := range []int{2, 2} {
+		e := n[i]
+		if e.Type != notify.ArchiveFailing || e.Segment != "000000010000000000000001" || e.Failures != expected {
+			t.Errorf("notification doesn't match, got %+v", e)
+		}
+	}
+}
+
+func TestRetainNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	o, err := NewOperator("file://" + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n notifier
+	o.SetNotifier(&n)
+	if _, err := o.Retain(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Retain(context.Background(), 0); err == nil {
+		t.Fatal("keeping no backup should fail")
+	}
+	if len(n) != 2 || n[0].Type != notify.RetentionApplied || n[1].Type != notify.RetentionFailed {
+		t.Fatalf("notifications don't match, got %+v", n)
+	}
+	if n[0].Hostname == "" || n[0].Storage == "" || n[0].Time.IsZero() {
+		t.Errorf("notification should describe its origin, got %+v", n[0])
+	}
+}
@@ -1,132 +1,647 @@
 package operator
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path"
+	"time"
 
+	"github.com/cyberdelia/law/notify"
 	"github.com/cyberdelia/law/storage"
 	"github.com/cyberdelia/pipeline"
 )
 
 // Operator contains all operations.
 type Operator struct {
-	s *storage.Storage
+	s      *storage.Storage
+	ssn    string
+	logger *slog.Logger
+	log    *slog.Logger
+	hooks  Hooks
+
+	notifier  notify.Notifier
+	streak    *notify.Streak
+	threshold int
+
+	deltas int
 }
 
-// NewOperator creates a new operator.
+// NewOperator creates a new operator, logging to the default logger.
 func NewOperator(ssn string) (*Operator, error) {
 	s, err := storage.NewStorage(ssn)
 	if err != nil {
 		return nil, err
 	}
-	return &Operator{
-		s: s,
-	}, nil
+	o := &Operator{
+		s:   s,
+		ssn: ssn,
+	}
+	o.SetLogger(slog.Default())
+	return o, nil
 }
 
-// Unarchive restore the given wal segment to the destination.
-func (o *Operator) Unarchive(name string, dest string) error {
-	file, err := os.Create(dest)
-	if err != nil {
-		return err
-	}
-	r, err := o.s.Unarchive(name)
+// SetDeltaBackups sets the number of delta backups taken after each full
+// backup before the next one, a delta backup storing the files of the
+// cluster modified since the full backup it is based on.
+func (o *Operator) SetDeltaBackups(n int) {
+	o.deltas = n
+}
+
+// SetLogger sets the logger of the operator and its storage.
+func (o *Operator) SetLogger(l *slog.Logger) {
+	o.logger = l
+	o.log = l.With("storage", storage.RedactURL(o.ssn))
+	o.s.SetLogger(l)
+}
+
+// Unarchive restore the given wal segment to the destination. Failing to
+// write the destination is never mistaken for a missing segment, and the
+// destination is removed unless the segment is fully restored.
+func (o *Operator) Unarchive(ctx context.Context, name string, dest string) (err error) {
+	defer func(start time.Time) { observe("unarchive", start, err) }(time.Now())
+	start := time.Now()
+	r, err := o.s.Unarchive(ctx, name)
 	if err != nil {
 		return err
 	}
 	defer r.Close()
-	pipe, err := pipeline.PipeRead(r, lzoReadPipeline)
+	cr := &countingReader{ReadCloser: r}
+	pipe, err := pipeline.PipeRead(cr, lzoReadPipeline)
 	if err != nil {
 		return err
 	}
 	defer pipe.Close()
-	if _, err = io.Copy(file, pipe); err != nil {
+	file, err := os.Create(dest)
+	if err != nil {
+		return &destinationError{err}
+	}
+	n, err := io.Copy(file, pipe)
+	if cerr := file.Close(); err == nil && cerr != nil {
+		err = &destinationError{cerr}
+	}
+	if err != nil {
+		os.Remove(dest)
 		return err
 	}
+	transferred("unarchive", n, cr.n)
+	o.log.Info("restored wal segment", "segment", name, "bytes", n, "duration", time.Since(start))
 	return nil
 }
 
-// Archive archives the given wal segment.
-func (o *Operator) Archive(name string) error {
+// Archive archives the given wal segment, running the archive hooks around
+// it and notifying of repeated failures.
+func (o *Operator) Archive(ctx context.Context, name string) (err error) {
+	defer func(start time.Time) { observe("archive", start, err) }(time.Now())
+	defer func() { o.archived(ctx, name, err) }()
+	begin := time.Now()
+	env := []string{"LAW_OPERATION=archive", "LAW_SEGMENT=" + path.Base(name), "LAW_SEGMENT_PATH=" + name}
+	var post string
+	defer func() { o.afterHooks(ctx, "archive", post, o.hooks.ArchiveFailure, env, begin, err) }()
+	if err := o.runHook(ctx, "pre_archive", o.hooks.PreArchive, env); err != nil {
+		return err
+	}
+	post = o.hooks.PostArchive
+	n, compressed, err := o.archive(ctx, name)
+	env = append(env, sizeEnv(n, compressed)...)
+	return err
+}
+
+// archive archives the given wal segment, returning its size before and
+// after compression.
+func (o *Operator) archive(ctx context.Context, name string) (int64, int64, error) {
 	file, err := os.Open(name)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
-	w, err := o.s.Archive(path.Base(name))
+	defer file.Close()
+	if archived, err := o.isArchived(ctx, file); err != nil || archived {
+		return 0, 0, err
+	}
+	start := time.Now()
+	w, err := o.s.Archive(ctx, path.Base(name))
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
-	defer w.Close()
-	pipe, err := pipeline.PipeWrite(w, lzoWritePipeline)
+	cw := &countingWriter{WriteCloser: w}
+	pipe, err := pipeline.PipeWrite(cw, lzoWritePipeline)
 	if err != nil {
-		return err
+		w.Abort()
+		return 0, 0, err
 	}
-	defer pipe.Close()
-	if _, err = io.Copy(pipe, file); err != nil {
+	n, err := io.Copy(pipe, file)
+	if err != nil {
+		pipe.Close()
+		w.Abort()
+		return n, cw.n, err
+	}
+	if err := pipe.Close(); err != nil {
+		w.Abort()
+		return n, cw.n, err
+	}
+	if err := w.Close(); err != nil {
+		return n, cw.n, err
+	}
+	transferred("archive", n, cw.n)
+	o.log.Info("archived wal segment", "segment", path.Base(name), "bytes", n, "duration", time.Since(start))
+	return n, cw.n, nil
+}
+
+// isArchived reports whether the given wal segment was already archived
+// with the same content, such as when archiving is retried after a crash,
+// rewinding the file. The archived segment is compared to the segment once
+// compressed, its content is only read when its size allows it to be the
+// same or a truncated segment. A segment archived with a different content
+// fails with storage.ErrExist, as it is never overwritten, while a
+// truncated or unreadable one is overwritten.
+func (o *Operator) isArchived(ctx context.Context, file *os.File) (bool, error) {
+	name := path.Base(file.Name())
+	size, err := o.s.ArchiveSize(ctx, name)
+	if errors.Is(err, storage.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	n, compressed, err := compressedDigest(file, size)
+	if err != nil {
+		return false, err
+	}
+	if err := rewind(file); err != nil {
+		return false, err
+	}
+	if n >= size {
+		r, err := o.s.Unarchive(ctx, name)
+		if err != nil {
+			return false, err
+		}
+		archived, err := digest(r)
+		r.Close()
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(archived, compressed) {
+			if n == size {
+				o.log.Info("wal segment already archived", "segment", name)
+				return true, nil
+			}
+			o.log.Warn("overwriting truncated wal segment", "segment", name, "bytes", size)
+			return false, nil
+		}
+	}
+	return o.sameArchived(ctx, file, name)
+}
+
+// sameArchived compares the content of the archived wal segment, possibly
+// compressed differently, to the given one.
+func (o *Operator) sameArchived(ctx context.Context, file *os.File, name string) (bool, error) {
+	r, err := o.s.Unarchive(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	archived, err := func() ([]byte, error) {
+		pipe, err := pipeline.PipeRead(r, lzoReadPipeline)
+		if err != nil {
+			return nil, err
+		}
+		defer pipe.Close()
+		return digest(pipe)
+	}()
+	if errors.Is(err, storage.ErrCorrupt) || errors.Is(err, io.ErrUnexpectedEOF) {
+		o.log.Warn("overwriting unreadable wal segment", "segment", name, "error", err)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	local, err := digest(file)
+	if err != nil {
+		return false, err
+	}
+	if err := rewind(file); err != nil {
+		return false, err
+	}
+	if !bytes.Equal(archived, local) {
+		return false, &storage.Error{Kind: storage.ErrExist, Err: fmt.Errorf("wal segment %s already archived with a different content", name)}
+	}
+	o.log.Info("wal segment already archived", "segment", name)
+	return true, nil
+}
+
+func digest(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// compressedDigest compresses the given reader as archived, returning the
+// compressed size and the digest of its first n bytes.
+func compressedDigest(r io.Reader, n int64) (int64, []byte, error) {
+	h := sha256.New()
+	cw := &countingWriter{WriteCloser: nopWriteCloser{&prefixWriter{w: h, n: n}}}
+	z, err := lzoWritePipeline(cw)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := io.Copy(z, r); err != nil {
+		z.Close()
+		return 0, nil, err
+	}
+	if err := z.Close(); err != nil {
+		return 0, nil, err
+	}
+	return cw.n, h.Sum(nil), nil
+}
+
+// prefixWriter only writes the first n bytes written to it.
+type prefixWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	if w.n > 0 {
+		b := p
+		if int64(len(b)) > w.n {
+			b = b[:w.n]
+		}
+		w.n -= int64(len(b))
+		if _, err := w.w.Write(b); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func rewind(file *os.File) error {
+	_, err := file.Seek(0, io.SeekStart)
+	return err
+}
+
+// stopTimeout bounds the time spent stopping a backup once it has failed
+// or been cancelled.
+const stopTimeout = 30 * time.Second
+
+// Backup backups the given cluster directory, while holding the lock of
+// the storage and running the backup hooks around it, then notifying of
+// its outcome. A delta backup is taken instead of a full one when the
+// number of delta backups set allows it. The backup is stopped on the database when it fails or the
+// context is cancelled, and the partition being uploaded is discarded.
+func (o *Operator) Backup(ctx context.Context, cluster string, rate int) (err error) {
+	defer func(start time.Time) { observe("backup", start, err) }(time.Now())
+	begin := time.Now()
+	env := []string{"LAW_OPERATION=backup", "LAW_CLUSTER=" + cluster}
+	var post string
+	var r backupResult
+	defer func() { o.notifyBackup(ctx, cluster, &r, begin, err) }()
+	defer func() { o.afterHooks(ctx, "backup", post, o.hooks.BackupFailure, env, begin, err) }()
+	return o.withLock(ctx, "backup", func(ctx context.Context) error {
+		if err := o.runHook(ctx, "pre_backup", o.hooks.PreBackup, env); err != nil {
+			return err
+		}
+		post = o.hooks.PostBackup
+		err := o.backup(ctx, cluster, rate, &r)
+		env = append(env, r.env()...)
 		return err
+	})
+}
+
+// backupResult represents the progress of a backup.
+type backupResult struct {
+	start, stop      *Backup
+	size, compressed int64
+}
+
+func (r *backupResult) env() []string {
+	var env []string
+	if r.start != nil {
+		env = append(env, "LAW_BACKUP="+r.start.backupName(), "LAW_START_SEGMENT="+r.start.Name)
 	}
-	return nil
+	if r.stop != nil {
+		env = append(env, "LAW_STOP_SEGMENT="+r.stop.Name)
+	}
+	return append(env, sizeEnv(r.size, r.compressed)...)
 }
 
-// Backup backups the given cluster directory.
-func (o *Operator) Backup(cluster string, rate int) error {
+func (o *Operator) backup(ctx context.Context, cluster string, rate int, r *backupResult) error {
+	if err := o.s.InitLayout(ctx); err != nil {
+		return err
+	}
 	db, err := NewDatabase(os.Getenv("DATABASE_URL"))
 	if err != nil {
 		return err
 	}
-	backup, err := db.StartBackup()
+	base, err := o.deltaBase(ctx)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	begin := time.Now()
+	start, err := db.StartBackup(ctx)
 	if err != nil {
 		return err
 	}
-	defer db.StopBackup()
-	partitions, err := Partition(cluster)
+	r.start = start
+	log := o.log.With("backup", start.backupName())
+	m := &Metadata{StartTime: begin, Hostname: hostname}
+	var partitions []Tape
+	if base != nil && base.deltaOf(start, hostname) {
+		m.Base = base.name
+		log.Info("started delta backup", "standby", start.Standby, "base", base.name)
+		partitions, m.Files, err = PartitionDelta(cluster, base.StartTime.Add(-deltaMargin))
+	} else {
+		log.Info("started backup", "standby", start.Standby)
+		partitions, err = Partition(cluster)
+	}
 	if err != nil {
+		abortBackup(log, db, err)
 		return err
 	}
 	for n, part := range partitions {
-		w, err := o.s.Backup(backup.Name, backup.Offset, n)
+		size, compressed, err := o.upload(ctx, start, n, rate, part.Copy)
+		r.size += size
+		r.compressed += compressed
 		if err != nil {
+			abortBackup(log, db, err)
 			return err
 		}
-		pipe, err := pipeline.PipeWrite(w, rateLimitWritePipeline(rate), lzoWritePipeline)
-		if err != nil {
-			return err
+	}
+	stop, err := db.StopBackup(ctx)
+	if err != nil {
+		return err
+	}
+	r.stop = stop
+	if stop.Label != "" {
+		files := map[string]string{"backup_label": stop.Label}
+		if stop.TablespaceMap != "" {
+			files["tablespace_map"] = stop.TablespaceMap
 		}
-		if err := part.Copy(pipe); err != nil {
-			return err
+		if m.Base != "" {
+			for name := range files {
+				m.Files = append(m.Files, name)
+			}
 		}
-		if err := pipe.Close(); err != nil {
+		size, compressed, err := o.upload(ctx, start, len(partitions), rate, func(w io.WriteCloser) error {
+			return writeFiles(w, files)
+		})
+		r.size += size
+		r.compressed += compressed
+		if err != nil {
 			return err
 		}
 	}
+	if err := o.writeMetadata(ctx, start, stop, m); err != nil {
+		return err
+	}
+	log.Info("completed backup", "partitions", len(partitions), "duration", time.Since(begin))
 	return nil
 }
 
-// Restore a named backup to the given cluster directory.
-func (o *Operator) Restore(cluster, name string) error {
-	if _, err := os.Stat(path.Join(cluster, "postmaster.pid")); err == nil {
-		return errors.New("attempt to overwrite a live data directory")
+// abortBackup stops a backup which won't complete, regardless of the
+// cancellation of the backup itself.
+func abortBackup(log *slog.Logger, db Database, cause error) {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	if _, err := db.StopBackup(ctx); err != nil {
+		log.Warn("unable to stop failed backup", "error", err)
+	}
+	log.Warn("stopped failed backup", "error", cause)
+}
+
+// backupName returns the name of the backup in the storage.
+func (b *Backup) backupName() string {
+	return fmt.Sprintf("base_%s_%s", b.Name, b.Offset)
+}
+
+// upload writes the partition n of the given backup, returning the bytes
+// stored before and after compression.
+func (o *Operator) upload(ctx context.Context, backup *Backup, n, rate int, copy func(io.WriteCloser) error) (int64, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	start := time.Now()
+	w, err := o.s.Backup(ctx, backup.Name, backup.Offset, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	cw := &countingWriter{WriteCloser: w}
+	pipe, err := pipeline.PipeWrite(cw, rateLimitWritePipeline(rate), lzoWritePipeline)
+	if err != nil {
+		w.Abort()
+		return 0, 0, err
+	}
+	c := &countingWriter{WriteCloser: pipe}
+	if err := copy(c); err != nil {
+		w.Abort()
+		return 0, 0, err
+	}
+	if err := pipe.Close(); err != nil {
+		w.Abort()
+		return 0, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, 0, err
 	}
-	rs, err := o.s.Restore(name)
+	transferred("backup", c.n, cw.n)
+	o.log.Info("uploaded backup partition", "backup", backup.backupName(), "partition", n,
+		"bytes", c.n, "duration", time.Since(start))
+	return c.n, cw.n, nil
+}
+
+type countingWriter struct {
+	io.WriteCloser
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// Metadata represents the metadata stored along a backup.
+type Metadata struct {
+	Start            string    `json:"start"`
+	Stop             string    `json:"stop"`
+	Standby          bool      `json:"standby"`
+	MinRecoveryPoint string    `json:"min_recovery_point,omitempty"`
+	SegmentSize      int64     `json:"segment_size,omitempty"`
+	SystemIdentifier uint64    `json:"system_identifier,omitempty"`
+	StartTime        time.Time `json:"start_time"`
+	Hostname         string    `json:"hostname,omitempty"`
+
+	// Base is the full backup a delta backup is based on, and Files the
+	// names of all files of the cluster when it was taken.
+	Base  string   `json:"base,omitempty"`
+	Files []string `json:"files,omitempty"`
+}
+
+// writeMetadata writes the given metadata of a backup, completed by its
+// start and stop.
+func (o *Operator) writeMetadata(ctx context.Context, start, stop *Backup, m *Metadata) error {
+	w, err := o.s.BackupMetadata(ctx, start.Name, start.Offset)
 	if err != nil {
 		return err
 	}
-	if err = os.MkdirAll(path.Dir(cluster), 0700); err != nil {
+	m.Start = start.Name
+	m.Stop = stop.Name
+	m.Standby = start.Standby
+	m.MinRecoveryPoint = stop.MinRecoveryPoint
+	m.SegmentSize = start.SegmentSize
+	m.SystemIdentifier = start.SystemIdentifier
+	if err = json.NewEncoder(w).Encode(m); err != nil {
+		w.Abort()
 		return err
 	}
-	for _, r := range rs {
-		pipe, err := pipeline.PipeRead(r, lzoReadPipeline)
+	return w.Close()
+}
+
+// readMetadata returns the metadata of the given backup, or nil if it has
+// none.
+func (o *Operator) readMetadata(ctx context.Context, name string) (*Metadata, error) {
+	r, err := o.s.RestoreMetadata(ctx, name)
+	if err != nil || r == nil {
+		return nil, err
+	}
+	defer r.Close()
+	m := new(Metadata)
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Backups returns the names of the stored backups.
+func (o *Operator) Backups(ctx context.Context) ([]string, error) {
+	return o.s.Backups(ctx)
+}
+
+// MigrateLayout indexes or rewrites archives of prior storage layouts,
+// while holding the lock of the storage.
+func (o *Operator) MigrateLayout(ctx context.Context, rewrite, remove bool) (report *storage.MigrationReport, err error) {
+	err = o.withLock(ctx, "migrate-layout", func(ctx context.Context) error {
+		report, err = o.s.MigrateLayout(ctx, rewrite, remove)
+		return err
+	})
+	return report, err
+}
+
+// Restore a named backup to the given cluster directory, and configure
+// its recovery if given, running the restore hooks around it. Restoring
+// stops between partitions once the context is cancelled.
+func (o *Operator) Restore(ctx context.Context, cluster, name string, recovery *Recovery) (err error) {
+	defer func(start time.Time) { observe("restore", start, err) }(time.Now())
+	begin := time.Now()
+	env := []string{"LAW_OPERATION=restore", "LAW_BACKUP=" + name, "LAW_CLUSTER=" + cluster}
+	var post string
+	defer func() { o.afterHooks(ctx, "restore", post, o.hooks.RestoreFailure, env, begin, err) }()
+	if err := o.runHook(ctx, "pre_restore", o.hooks.PreRestore, env); err != nil {
+		return err
+	}
+	post = o.hooks.PostRestore
+	size, compressed, err := o.restore(ctx, cluster, name, recovery)
+	env = append(env, sizeEnv(size, compressed)...)
+	return err
+}
+
+// restore restores the given backup, returning its size before and after
+// compression. A delta backup is restored on top of the full backup it is
+// based on, removing the files deleted since.
+func (o *Operator) restore(ctx context.Context, cluster, name string, recovery *Recovery) (size, compressed int64, err error) {
+	if recovery != nil {
+		if err := recovery.validate(); err != nil {
+			return size, compressed, err
+		}
+	}
+	m, err := o.readMetadata(ctx, name)
+	if err != nil {
+		return size, compressed, err
+	}
+	if recovery != nil {
+		if err := recovery.consistent(m); err != nil {
+			return size, compressed, err
+		}
+	}
+	if _, err := os.Stat(path.Join(cluster, "postmaster.pid")); err == nil {
+		return 0, 0, ErrLiveCluster
+	}
+	if err = os.MkdirAll(path.Dir(cluster), 0700); err != nil {
+		return size, compressed, err
+	}
+	if m != nil && m.Base != "" {
+		size, compressed, err = o.restorePartitions(ctx, cluster, m.Base)
 		if err != nil {
-			return err
+			return size, compressed, fmt.Errorf("full backup %s: %w", m.Base, err)
 		}
-		if err = Unite(cluster, pipe); err != nil {
-			return err
+	}
+	n, c, err := o.restorePartitions(ctx, cluster, name)
+	size += n
+	compressed += c
+	if err != nil {
+		return size, compressed, err
+	}
+	if m != nil && m.Base != "" {
+		if err := removeDeleted(cluster, m.Files); err != nil {
+			return size, compressed, err
+		}
+	}
+	if recovery != nil {
+		return size, compressed, recovery.Write(cluster, restoreCommand(o.ssn, recovery.Config))
+	}
+	return size, compressed, nil
+}
+
+// restorePartitions restores the partitions of the given backup, returning
+// their size before and after compression.
+func (o *Operator) restorePartitions(ctx context.Context, cluster, name string) (size, compressed int64, err error) {
+	rs, err := o.s.Restore(ctx, name)
+	if err != nil {
+		return size, compressed, err
+	}
+	begin := time.Now()
+	log := o.log.With("backup", name)
+	for n, r := range rs {
+		if err := ctx.Err(); err != nil {
+			return size, compressed, err
+		}
+		start := time.Now()
+		cr := &countingReader{ReadCloser: r}
+		pipe, err := pipeline.PipeRead(cr, lzoReadPipeline)
+		if err != nil {
+			return size, compressed, err
+		}
+		c := &countingReader{ReadCloser: pipe}
+		if err = Unite(cluster, c); err != nil {
+			return size, compressed, err
 		}
 		if err = pipe.Close(); err != nil {
-			return err
+			return size, compressed, err
 		}
+		transferred("restore", c.n, cr.n)
+		size += c.n
+		compressed += cr.n
+		log.Info("restored backup partition", "partition", n, "bytes", c.n, "duration", time.Since(start))
 	}
-	return nil
+	log.Info("restored backup", "partitions", len(rs), "duration", time.Since(begin))
+	return size, compressed, nil
 }
@@ -1,9 +1,90 @@
 package operator
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestNewOperator(t *testing.T) {
 	if _, err := NewOperator("file:///tmp"); err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestRestoreCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	o, err := NewOperator("file://" + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup := &Backup{Name: "000000010000000000000002", Offset: "00000028"}
+	_, _, err = o.upload(context.Background(), backup, 0, 0, func(w io.WriteCloser) error {
+		return writeFiles(w, map[string]string{"PG_VERSION": "12\n"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cluster := filepath.Join(dir, "cluster")
+	if err := o.Restore(ctx, cluster, "base_000000010000000000000002_00000028", nil); err != context.Canceled {
+		t.Fatalf("restore should be cancelled, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cluster, "PG_VERSION")); !os.IsNotExist(err) {
+		t.Errorf("cancelled restore should not write files, got %v", err)
+	}
+	_, _, err = o.upload(ctx, backup, 1, 0, func(w io.WriteCloser) error {
+		return writeFiles(w, nil)
+	})
+	if err != context.Canceled {
+		t.Errorf("upload should be cancelled, got %v", err)
+	}
+}
+
+func TestArchiveLogging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	uri := "file://" + filepath.Join(dir, "storage")
+	o, err := NewOperator(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	o.SetLogger(slog.New(slog.NewJSONHandler(&b, nil)))
+	segment := filepath.Join(dir, "000000010000000000000001")
+	if err := ioutil.WriteFile(segment, []byte("law"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Archive(context.Background(), segment); err != nil {
+		t.Fatal(err)
+	}
+	var record struct {
+		Level    string `json:"level"`
+		Msg      string `json:"msg"`
+		Storage  string `json:"storage"`
+		Segment  string `json:"segment"`
+		Bytes    int64  `json:"bytes"`
+		Duration *int64 `json:"duration"`
+	}
+	if err := json.Unmarshal(b.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Level != "INFO" || record.Msg != "archived wal segment" || record.Storage != uri ||
+		record.Segment != "000000010000000000000001" || record.Bytes != 3 || record.Duration == nil {
+		t.Errorf("record don't match, got %+v", record)
+	}
+}
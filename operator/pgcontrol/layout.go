@@ -0,0 +1,170 @@
+package pgcontrol
+
+// kind represents the C type of a field, as laid out on 64-bit platforms.
+type kind int
+
+const (
+	uint32Kind kind = iota
+	uint64Kind
+	boolKind
+	nonceKind
+	structKind
+)
+
+type field struct {
+	name   string
+	kind   kind
+	fields []field
+}
+
+// layout represents the offsets of the fields of ControlFileData.
+type layout struct {
+	offsets map[string]int
+	size    int
+}
+
+// layouts contains the layout of each supported pg_control_version.
+var layouts = map[uint32]*layout{
+	960:  newLayout(controlFields(960)),
+	1002: newLayout(controlFields(1002)),
+	1100: newLayout(controlFields(1100)),
+	1201: newLayout(controlFields(1201)),
+	1300: newLayout(controlFields(1300)),
+	1700: newLayout(controlFields(1700)),
+	1800: newLayout(controlFields(1800)),
+}
+
+// checkpointFields returns the fields of CheckPoint.
+func checkpointFields(version uint32) []field {
+	fields := []field{
+		{"redo", uint64Kind, nil},
+		{"ThisTimeLineID", uint32Kind, nil},
+		{"PrevTimeLineID", uint32Kind, nil},
+		{"fullPageWrites", boolKind, nil},
+	}
+	if version >= 1700 {
+		fields = append(fields, field{"wal_level", uint32Kind, nil})
+	}
+	if version >= 1201 {
+		fields = append(fields, field{"nextXid", uint64Kind, nil})
+	} else {
+		fields = append(fields, field{"nextXidEpoch", uint32Kind, nil}, field{"nextXid", uint32Kind, nil})
+	}
+	return append(fields,
+		field{"nextOid", uint32Kind, nil},
+		field{"nextMulti", uint32Kind, nil},
+		field{"nextMultiOffset", uint32Kind, nil},
+		field{"oldestXid", uint32Kind, nil},
+		field{"oldestXidDB", uint32Kind, nil},
+		field{"oldestMulti", uint32Kind, nil},
+		field{"oldestMultiDB", uint32Kind, nil},
+		field{"time", uint64Kind, nil},
+		field{"oldestCommitTsXid", uint32Kind, nil},
+		field{"newestCommitTsXid", uint32Kind, nil},
+		field{"oldestActiveXid", uint32Kind, nil},
+	)
+}
+
+// controlFields returns the fields of ControlFileData.
+func controlFields(version uint32) []field {
+	fields := []field{
+		{"system_identifier", uint64Kind, nil},
+		{"pg_control_version", uint32Kind, nil},
+		{"catalog_version_no", uint32Kind, nil},
+		{"state", uint32Kind, nil},
+		{"time", uint64Kind, nil},
+		{"checkPoint", uint64Kind, nil},
+	}
+	if version < 1100 {
+		fields = append(fields, field{"prevCheckPoint", uint64Kind, nil})
+	}
+	fields = append(fields,
+		field{"checkPointCopy", structKind, checkpointFields(version)},
+		field{"unloggedLSN", uint64Kind, nil},
+		field{"minRecoveryPoint", uint64Kind, nil},
+		field{"minRecoveryPointTLI", uint32Kind, nil},
+		field{"backupStartPoint", uint64Kind, nil},
+		field{"backupEndPoint", uint64Kind, nil},
+		field{"backupEndRequired", boolKind, nil},
+		field{"wal_level", uint32Kind, nil},
+		field{"wal_log_hints", boolKind, nil},
+		field{"MaxConnections", uint32Kind, nil},
+		field{"max_worker_processes", uint32Kind, nil},
+	)
+	if version >= 1201 {
+		fields = append(fields, field{"max_wal_senders", uint32Kind, nil})
+	}
+	fields = append(fields,
+		field{"max_prepared_xacts", uint32Kind, nil},
+		field{"max_locks_per_xact", uint32Kind, nil},
+		field{"track_commit_timestamp", boolKind, nil},
+		field{"maxAlign", uint32Kind, nil},
+		field{"floatFormat", uint64Kind, nil},
+		field{"blcksz", uint32Kind, nil},
+		field{"relseg_size", uint32Kind, nil},
+		field{"xlog_blcksz", uint32Kind, nil},
+		field{"xlog_seg_size", uint32Kind, nil},
+		field{"nameDataLen", uint32Kind, nil},
+		field{"indexMaxKeys", uint32Kind, nil},
+		field{"toast_max_chunk_size", uint32Kind, nil},
+		field{"loblksize", uint32Kind, nil},
+	)
+	if version < 1002 {
+		fields = append(fields, field{"enableIntTimes", boolKind, nil})
+	}
+	if version < 1300 {
+		fields = append(fields, field{"float4ByVal", boolKind, nil})
+	}
+	fields = append(fields,
+		field{"float8ByVal", boolKind, nil},
+		field{"data_checksum_version", uint32Kind, nil},
+	)
+	if version >= 1800 {
+		fields = append(fields, field{"default_char_signedness", boolKind, nil})
+	}
+	if version >= 1002 {
+		fields = append(fields, field{"mock_authentication_nonce", nonceKind, nil})
+	}
+	return append(fields, field{"crc", uint32Kind, nil})
+}
+
+// newLayout computes the offset of each field following the C alignment
+// rules, where fields are aligned on their size and structs on their
+// largest member.
+func newLayout(fields []field) *layout {
+	l := &layout{
+		offsets: make(map[string]int),
+	}
+	l.size = align(l.add("", fields, 0), 8)
+	return l
+}
+
+func (l *layout) add(prefix string, fields []field, offset int) int {
+	for _, f := range fields {
+		var size, alignment int
+		switch f.kind {
+		case uint32Kind:
+			size, alignment = 4, 4
+		case uint64Kind:
+			size, alignment = 8, 8
+		case boolKind:
+			size, alignment = 1, 1
+		case nonceKind:
+			size, alignment = 32, 1
+		case structKind:
+			// Structs of pg_control all contain 64-bit members.
+			offset = align(offset, 8)
+			l.offsets[prefix+f.name] = offset
+			offset = align(l.add(prefix+f.name+".", f.fields, offset), 8)
+			continue
+		}
+		offset = align(offset, alignment)
+		l.offsets[prefix+f.name] = offset
+		offset += size
+	}
+	return offset
+}
+
+func align(offset, alignment int) int {
+	return (offset + alignment - 1) / alignment * alignment
+}
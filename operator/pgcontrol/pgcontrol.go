@@ -0,0 +1,123 @@
+// Package pgcontrol reads PostgreSQL pg_control files.
+package pgcontrol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"time"
+)
+
+// State represents the state of a database cluster.
+type State uint32
+
+// States of a database cluster.
+const (
+	Startup State = iota
+	Shutdowned
+	ShutdownedInRecovery
+	Shutdowning
+	InCrashRecovery
+	InArchiveRecovery
+	InProduction
+)
+
+var states = []string{
+	"starting up", "shut down", "shut down in recovery", "shutting down",
+	"in crash recovery", "in archive recovery", "in production",
+}
+
+func (s State) String() string {
+	if int(s) < len(states) {
+		return states[s]
+	}
+	return "unrecognized status code"
+}
+
+// ControlFile represents the content of a pg_control file.
+type ControlFile struct {
+	SystemIdentifier    uint64
+	Version             uint32
+	CatalogVersion      uint32
+	State               State
+	Time                time.Time
+	Checkpoint          uint64
+	Redo                uint64
+	Timeline            uint32
+	PrevTimeline        uint32
+	MinRecoveryPoint    uint64
+	MinRecoveryTimeline uint32
+	BlockSize           uint32
+	WALBlockSize        uint32
+	WALSegmentSize      uint32
+	DataChecksumVersion uint32
+}
+
+// ErrChecksum is returned when the checksum of a pg_control file doesn't
+// match its content.
+var ErrChecksum = errors.New("pgcontrol: incorrect checksum")
+
+// Read reads the pg_control file of the given cluster directory.
+func Read(cluster string) (*ControlFile, error) {
+	b, err := ioutil.ReadFile(filepath.Join(cluster, "global", "pg_control"))
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// Parse parses the content of a pg_control file, written by a supported
+// PostgreSQL version.
+func Parse(b []byte) (*ControlFile, error) {
+	if len(b) < 12 {
+		return nil, errors.New("pgcontrol: file too short")
+	}
+	var order binary.ByteOrder
+	var l *layout
+	for _, o := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if l = layouts[o.Uint32(b[8:])]; l != nil {
+			order = o
+			break
+		}
+	}
+	if l == nil {
+		return nil, fmt.Errorf("pgcontrol: unsupported version %d", binary.LittleEndian.Uint32(b[8:]))
+	}
+	if len(b) < l.size {
+		return nil, errors.New("pgcontrol: file too short")
+	}
+	crc := crc32.Checksum(b[:l.offsets["crc"]], crc32.MakeTable(crc32.Castagnoli))
+	if crc != order.Uint32(b[l.offsets["crc"]:]) {
+		return nil, ErrChecksum
+	}
+	u32 := func(name string) uint32 {
+		return order.Uint32(b[l.offsets[name]:])
+	}
+	u64 := func(name string) uint64 {
+		return order.Uint64(b[l.offsets[name]:])
+	}
+	if math.Float64frombits(u64("floatFormat")) != 1234567.0 {
+		return nil, errors.New("pgcontrol: incompatible floating point format")
+	}
+	return &ControlFile{
+		SystemIdentifier:    u64("system_identifier"),
+		Version:             u32("pg_control_version"),
+		CatalogVersion:      u32("catalog_version_no"),
+		State:               State(u32("state")),
+		Time:                time.Unix(int64(u64("time")), 0).UTC(),
+		Checkpoint:          u64("checkPoint"),
+		Redo:                u64("checkPointCopy.redo"),
+		Timeline:            u32("checkPointCopy.ThisTimeLineID"),
+		PrevTimeline:        u32("checkPointCopy.PrevTimeLineID"),
+		MinRecoveryPoint:    u64("minRecoveryPoint"),
+		MinRecoveryTimeline: u32("minRecoveryPointTLI"),
+		BlockSize:           u32("blcksz"),
+		WALBlockSize:        u32("xlog_blcksz"),
+		WALSegmentSize:      u32("xlog_seg_size"),
+		DataChecksumVersion: u32("data_checksum_version"),
+	}, nil
+}
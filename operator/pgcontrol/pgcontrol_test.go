@@ -0,0 +1,79 @@
+package pgcontrol
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"testing"
+)
+
+// controlFile builds a pg_control file using offsets computed by hand from
+// the C definitions of ControlFileData.
+func controlFile(version uint32, redo, timeline, float, segsize, crc int) []byte {
+	b := make([]byte, 8192)
+	order := binary.LittleEndian
+	order.PutUint64(b[0:], 6455284129925640000)
+	order.PutUint32(b[8:], version)
+	order.PutUint32(b[16:], uint32(Shutdowned))
+	order.PutUint64(b[24:], 1496318400)
+	order.PutUint64(b[32:], 0x3000060)
+	order.PutUint64(b[redo:], 0x3000028)
+	order.PutUint32(b[timeline:], 2)
+	order.PutUint64(b[float:], math.Float64bits(1234567.0))
+	order.PutUint32(b[segsize:], 64*1024*1024)
+	order.PutUint32(b[crc:], crc32.Checksum(b[:crc], crc32.MakeTable(crc32.Castagnoli)))
+	return b
+}
+
+func TestParse(t *testing.T) {
+	var tests = []struct {
+		version                             uint32
+		redo, timeline, float, segsize, crc int
+	}{
+		{960, 48, 56, 208, 228, 256},
+		{1002, 48, 56, 208, 228, 288},
+		{1100, 40, 48, 200, 220, 280},
+		{1201, 40, 48, 208, 228, 288},
+		{1300, 40, 48, 208, 228, 288},
+		{1700, 40, 48, 208, 228, 288},
+		{1800, 40, 48, 208, 228, 292},
+	}
+	for _, tt := range tests {
+		c, err := Parse(controlFile(tt.version, tt.redo, tt.timeline, tt.float, tt.segsize, tt.crc))
+		if err != nil {
+			t.Fatalf("version %d: %v", tt.version, err)
+		}
+		if c.Version != tt.version {
+			t.Errorf("version don't match, wants %d got %d", tt.version, c.Version)
+		}
+		if c.SystemIdentifier != 6455284129925640000 {
+			t.Errorf("version %d: system identifier don't match, got %d", tt.version, c.SystemIdentifier)
+		}
+		if c.State != Shutdowned {
+			t.Errorf("version %d: state don't match, got %s", tt.version, c.State)
+		}
+		if c.Checkpoint != 0x3000060 || c.Redo != 0x3000028 {
+			t.Errorf("version %d: locations don't match, got %X and %X", tt.version, c.Checkpoint, c.Redo)
+		}
+		if c.Timeline != 2 {
+			t.Errorf("version %d: timeline don't match, got %d", tt.version, c.Timeline)
+		}
+		if c.WALSegmentSize != 64*1024*1024 {
+			t.Errorf("version %d: segment size don't match, got %d", tt.version, c.WALSegmentSize)
+		}
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	b := controlFile(1300, 40, 48, 208, 228, 288)
+	b[48] = 3
+	if _, err := Parse(b); err != ErrChecksum {
+		t.Fatalf("expected checksum error, got %v", err)
+	}
+}
+
+func TestParseUnsupported(t *testing.T) {
+	if _, err := Parse(controlFile(903, 40, 48, 208, 228, 288)); err == nil {
+		t.Fatal("expected error for unsupported version")
+	}
+}
@@ -9,14 +9,32 @@ import (
 	"github.com/cyberdelia/ratio"
 )
 
-// lzoWritePipeline returns a WritePipeline that will compress data.
+// lzoWritePipeline returns a WritePipeline that will compress data. The
+// modification time of the header is fixed, such that the same data is
+// always compressed the same.
 func lzoWritePipeline(w io.WriteCloser) (io.WriteCloser, error) {
-	return lzo.NewWriter(w), nil
+	z := lzo.NewWriter(w)
+	z.ModTime = time.Unix(0, 0)
+	return z, nil
 }
 
-// lzoReadPipeline returns a ReadPipeline that will decompress data.
+// lzoReadPipeline returns a ReadPipeline that will decompress data,
+// reporting corrupted data as storage.ErrCorrupt.
 func lzoReadPipeline(r io.ReadCloser) (io.ReadCloser, error) {
-	return lzo.NewReader(r)
+	z, err := lzo.NewReader(r)
+	if err != nil {
+		return nil, corrupted(err)
+	}
+	return corruptionReader{z}, nil
+}
+
+type corruptionReader struct {
+	io.ReadCloser
+}
+
+func (r corruptionReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	return n, corrupted(err)
 }
 
 // rateLimitWritePipeline returns a WritePipeline that will rate-limit write I/O.
@@ -25,6 +43,15 @@ func rateLimitWritePipeline(size int) pipeline.WritePipeline {
 		if size > 0 {
 			return ratio.RateLimitedWriter(w, size, time.Second), nil
 		}
-		return w, nil
+		// The writer is closed by the caller, not by the pipeline.
+		return nopWriteCloser{w}, nil
 	}
 }
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
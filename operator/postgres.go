@@ -1,33 +1,35 @@
 package operator
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"net/url"
-	"os/exec"
-	"path/filepath"
-	"strings"
 	"time"
 
+	"github.com/cyberdelia/law/operator/pgcontrol"
+	"github.com/cyberdelia/law/operator/xlog"
 	// load postgres drivers
 	_ "github.com/lib/pq"
 )
 
-const (
-	pgControlData = "pg_controldata"
-	pgConfig      = "pg_config"
-)
-
 // Database represents the underlying postgres database.
 type Database interface {
-	StartBackup() (*Backup, error)
-	StopBackup() (*Backup, error)
+	StartBackup(ctx context.Context) (*Backup, error)
+	StopBackup(ctx context.Context) (*Backup, error)
+	SegmentSize(ctx context.Context) (int64, error)
 }
 
 type onlineDatabase struct {
 	dataSourceName string
+
+	// db is kept open between the start and the stop of a non-exclusive
+	// backup.
+	db       *sql.DB
+	version  int
+	size     int64
+	recovery bool
 }
 
 type offlineDatabase struct {
@@ -38,8 +40,24 @@ type offlineDatabase struct {
 
 // Backup represents a backup.
 type Backup struct {
-	Name   string
-	Offset string
+	Name        string
+	Offset      string
+	SegmentSize int64
+
+	// Standby is set when the backup is taken from a standby server.
+	Standby bool
+	// Label and TablespaceMap are the content of the backup_label and
+	// tablespace_map files returned when stopping a non-exclusive backup,
+	// which are stored along the backup as they aren't written to the
+	// cluster.
+	Label         string
+	TablespaceMap string
+	// MinRecoveryPoint is the location up to which a backup taken from a
+	// standby server must be recovered to be consistent.
+	MinRecoveryPoint string
+	// SystemIdentifier is the unique identifier of the cluster, when
+	// known.
+	SystemIdentifier uint64
 }
 
 // NewDatabase returns a new Database based on the given given
@@ -59,75 +77,218 @@ func NewDatabase(dsn string) (Database, error) {
 	}
 }
 
-// StartBackup starts a new backup.
-func (on *onlineDatabase) StartBackup() (*Backup, error) {
+// StartBackup starts a new backup, using the non-exclusive backup API from
+// PostgreSQL 9.6, and the exclusive one before, which can't be used on a
+// standby server.
+func (on *onlineDatabase) StartBackup(ctx context.Context) (*Backup, error) {
 	db, err := sql.Open("postgres", on.dataSourceName)
 	if err != nil {
 		return nil, err
 	}
+	// A non-exclusive backup must be stopped from the same connection.
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	if err := db.QueryRowContext(ctx, `SELECT pg_is_in_recovery(), current_setting('server_version_num')::int`).Scan(&on.recovery, &on.version); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if on.size, err = segmentSize(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	label := fmt.Sprintf("freeze_start_%s", time.Now().UTC().Format(time.RFC3339))
+	if on.version >= 90600 {
+		backup, err := on.startNonExclusiveBackup(ctx, db, label)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		on.db = db
+		return backup, nil
+	}
 	defer db.Close()
+	if on.recovery {
+		return nil, errors.New("backup from a standby server requires PostgreSQL 9.6 or later")
+	}
 	var name, offset string
-	label := fmt.Sprintf("freeze_start_%s", time.Now().UTC().Format(time.RFC3339))
-	if err := db.QueryRow(`SELECT file_name, lpad(file_offset::text, 8, '0') AS file_offset FROM pg_xlogfile_name_offset(pg_start_backup($1))`, label).Scan(&name, &offset); err != nil {
+	if err := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT file_name, lpad(file_offset::text, 8, '0') AS file_offset FROM %s(pg_start_backup($1))`, on.walFileNameOffset()), label).Scan(&name, &offset); err != nil {
 		return nil, err
 	}
 	return &Backup{
-		Name:   name,
-		Offset: offset,
+		Name:        name,
+		Offset:      offset,
+		SegmentSize: on.size,
 	}, nil
 }
 
 // StopBackup stops the currently running backup.
-func (on *onlineDatabase) StopBackup() (*Backup, error) {
+func (on *onlineDatabase) StopBackup(ctx context.Context) (*Backup, error) {
+	if on.db != nil {
+		defer func() {
+			on.db.Close()
+			on.db = nil
+		}()
+		return on.stopNonExclusiveBackup(ctx, on.db)
+	}
 	db, err := sql.Open("postgres", on.dataSourceName)
 	if err != nil {
 		return nil, err
 	}
 	defer db.Close()
 	var name, offset string
-	if err := db.QueryRow(`SELECT file_name, lpad(file_offset::text, 8, '0') AS file_offset FROM pg_xlogfile_name_offset(pg_stop_backup())`).Scan(&name, &offset); err != nil {
+	if err := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT file_name, lpad(file_offset::text, 8, '0') AS file_offset FROM %s(pg_stop_backup())`, on.walFileNameOffset())).Scan(&name, &offset); err != nil {
 		return nil, err
 	}
 	return &Backup{
-		Name:   name,
-		Offset: offset,
+		Name:        name,
+		Offset:      offset,
+		SegmentSize: on.size,
 	}, nil
 }
 
-func (off *offlineDatabase) StartBackup() (*Backup, error) {
-	u, err := url.Parse(off.dataSourceName)
+// SegmentSize returns the size of WAL segments of the database.
+func (on *onlineDatabase) SegmentSize(ctx context.Context) (int64, error) {
+	db, err := sql.Open("postgres", on.dataSourceName)
 	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	return segmentSize(ctx, db)
+}
+
+// segmentSize returns the size of WAL segments, reported in blocks of 8kB
+// before PostgreSQL 11 and in bytes afterward.
+func segmentSize(ctx context.Context, db *sql.DB) (int64, error) {
+	var size int64
+	if err := db.QueryRowContext(ctx, `SELECT setting::bigint * CASE unit WHEN '8kB' THEN 8192 ELSE 1 END FROM pg_settings WHERE name = 'wal_segment_size'`).Scan(&size); err != nil {
+		return 0, err
+	}
+	return size, xlog.ValidSegmentSize(size)
+}
+
+// walFileNameOffset returns the name of the function converting a location
+// to a segment name and offset.
+func (on *onlineDatabase) walFileNameOffset() string {
+	if on.version >= 100000 {
+		return "pg_walfile_name_offset"
+	}
+	return "pg_xlogfile_name_offset"
+}
+
+func (on *onlineDatabase) startNonExclusiveBackup(ctx context.Context, db *sql.DB, label string) (*Backup, error) {
+	query := `SELECT pg_start_backup($1, false, false)::text`
+	if on.version >= 150000 {
+		query = `SELECT pg_backup_start($1, false)::text`
+	}
+	var lsn string
+	if err := db.QueryRowContext(ctx, query, label).Scan(&lsn); err != nil {
 		return nil, err
 	}
-	output, err := exec.Command(pgConfig, "--bindir").Output()
-	if err != nil {
+	return on.locationBackup(ctx, db, lsn)
+}
+
+// stopNonExclusiveBackup stops the backup, returning the content of its
+// backup_label and tablespace_map files to be stored along the backup.
+func (on *onlineDatabase) stopNonExclusiveBackup(ctx context.Context, db *sql.DB) (*Backup, error) {
+	query := `SELECT lsn::text, labelfile, coalesce(spcmapfile, '') FROM pg_stop_backup(false)`
+	if on.version >= 150000 {
+		query = `SELECT lsn::text, labelfile, coalesce(spcmapfile, '') FROM pg_backup_stop()`
+	}
+	var lsn, label, tablespaceMap string
+	if err := db.QueryRowContext(ctx, query).Scan(&lsn, &label, &tablespaceMap); err != nil {
 		return nil, err
 	}
-	binary := filepath.Join(strings.TrimSpace(string(output)), pgControlData)
-	control, err := exec.Command(binary, u.Path).Output()
+	backup, err := on.locationBackup(ctx, db, lsn)
 	if err != nil {
 		return nil, err
 	}
-	var checkpoint, timeline []byte
-	for _, l := range bytes.Split(control, []byte("\n")) {
-		f := bytes.Split(l, []byte(":"))
-		if len(f) == 2 {
-			switch {
-			case bytes.Contains(f[0], []byte("Latest checkpoint's REDO location")):
-				checkpoint = bytes.TrimSpace(f[1])
-			case bytes.Contains(f[0], []byte("Latest checkpoint's TimeLineID")):
-				timeline = bytes.TrimSpace(f[1])
-			}
+	backup.Label = label
+	backup.TablespaceMap = tablespaceMap
+	if on.recovery {
+		if err := db.QueryRowContext(ctx, `SELECT min_recovery_end_lsn::text FROM pg_control_recovery()`).Scan(&backup.MinRecoveryPoint); err != nil {
+			return nil, err
 		}
 	}
-	location := bytes.Split(checkpoint, []byte("/"))
+	return backup, nil
+}
+
+// locationBackup returns the backup for the given location.
+func (on *onlineDatabase) locationBackup(ctx context.Context, db *sql.DB, lsn string) (*Backup, error) {
+	if on.recovery {
+		return on.standbyBackup(ctx, db, lsn)
+	}
+	var name, offset string
+	if err := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT file_name, lpad(file_offset::text, 8, '0') AS file_offset FROM %s($1::pg_lsn)`, on.walFileNameOffset()), lsn).Scan(&name, &offset); err != nil {
+		return nil, err
+	}
+	return &Backup{
+		Name:        name,
+		Offset:      offset,
+		SegmentSize: on.size,
+	}, nil
+}
+
+// standbyBackup returns the backup for the given location, as
+// pg_walfile_name_offset can't be used during recovery.
+func (on *onlineDatabase) standbyBackup(ctx context.Context, db *sql.DB, location string) (*Backup, error) {
+	var timeline uint32
+	if err := db.QueryRowContext(ctx, `SELECT timeline_id FROM pg_control_checkpoint()`).Scan(&timeline); err != nil {
+		return nil, err
+	}
+	lsn, err := xlog.ParseLSN(location)
+	if err != nil {
+		return nil, err
+	}
+	return &Backup{
+		Name:        lsn.Segment(timeline, on.size).Name(on.size),
+		Offset:      fmt.Sprintf("%08d", lsn.Offset(on.size)),
+		Standby:     true,
+		SegmentSize: on.size,
+	}, nil
+}
+
+// StartBackup starts a backup of a cluster that has been shut down, based
+// on its last checkpoint.
+func (off *offlineDatabase) StartBackup(ctx context.Context) (*Backup, error) {
+	control, err := off.control()
+	if err != nil {
+		return nil, err
+	}
+	if control.State != pgcontrol.Shutdowned && control.State != pgcontrol.ShutdownedInRecovery {
+		return nil, fmt.Errorf("cluster must be shut down for an offline backup, it is %s", control.State)
+	}
+	size := int64(control.WALSegmentSize)
+	if err := xlog.ValidSegmentSize(size); err != nil {
+		return nil, err
+	}
+	redo := xlog.LSN(control.Redo)
 	off.backup = &Backup{
-		Name:   fmt.Sprintf("%08s%08s%08s", timeline, location[0], location[1][0:2]),
-		Offset: fmt.Sprintf("%08s", location[1][0:2]),
+		Name:             redo.Segment(control.Timeline, size).Name(size),
+		Offset:           fmt.Sprintf("%08d", redo.Offset(size)),
+		SegmentSize:      size,
+		SystemIdentifier: control.SystemIdentifier,
 	}
 	return off.backup, nil
 }
 
-func (off *offlineDatabase) StopBackup() (*Backup, error) {
+// SegmentSize returns the size of WAL segments of the cluster.
+func (off *offlineDatabase) SegmentSize(ctx context.Context) (int64, error) {
+	control, err := off.control()
+	if err != nil {
+		return 0, err
+	}
+	size := int64(control.WALSegmentSize)
+	return size, xlog.ValidSegmentSize(size)
+}
+
+func (off *offlineDatabase) control() (*pgcontrol.ControlFile, error) {
+	u, err := url.Parse(off.dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	return pgcontrol.Read(u.Path)
+}
+
+func (off *offlineDatabase) StopBackup(ctx context.Context) (*Backup, error) {
 	return off.backup, nil
 }
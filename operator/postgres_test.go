@@ -1,6 +1,7 @@
 package operator
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -15,17 +16,20 @@ func TestOnlineBackup(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	start, err := db.StartBackup()
+	start, err := db.StartBackup(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
-	stop, err := db.StopBackup()
+	stop, err := db.StopBackup(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
 	if start.Name != stop.Name {
 		t.Error("did not return the same backup name")
 	}
+	if stop.Label == "" {
+		t.Error("did not return the backup label")
+	}
 }
 
 func TestOfflineBackup(t *testing.T) {
@@ -37,11 +41,11 @@ func TestOfflineBackup(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	start, err := db.StartBackup()
+	start, err := db.StartBackup(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
-	stop, err := db.StopBackup()
+	stop, err := db.StopBackup(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
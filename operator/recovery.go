@@ -0,0 +1,196 @@
+package operator
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cyberdelia/law/operator/xlog"
+	"github.com/cyberdelia/law/storage"
+)
+
+// Recovery represents the recovery configuration of a restored cluster.
+type Recovery struct {
+	TargetTime     string
+	TargetLSN      string
+	TargetXID      string
+	TargetTimeline string
+	Standby        bool
+	// Config is the configuration file read by the restore_command, which
+	// otherwise reads the storage from the environment of the server when
+	// the storage URL holds credentials.
+	Config string
+}
+
+func (r *Recovery) validate() error {
+	var targets int
+	for _, target := range []string{r.TargetTime, r.TargetLSN, r.TargetXID} {
+		if target != "" {
+			targets++
+		}
+	}
+	if targets > 1 {
+		return errors.New("only one of recovery target time, lsn or xid can be specified")
+	}
+	return nil
+}
+
+// consistent checks that the recovery target isn't before the point at
+// which the given backup becomes consistent.
+func (r *Recovery) consistent(m *Metadata) error {
+	if m == nil || m.MinRecoveryPoint == "" || r.TargetLSN == "" {
+		return nil
+	}
+	target, err := xlog.ParseLSN(r.TargetLSN)
+	if err != nil {
+		return err
+	}
+	point, err := xlog.ParseLSN(m.MinRecoveryPoint)
+	if err != nil {
+		return err
+	}
+	if target < point {
+		return fmt.Errorf("recovery target %s precedes minimum recovery point %s of backup", r.TargetLSN, m.MinRecoveryPoint)
+	}
+	return nil
+}
+
+// settings returns the recovery settings for the given PostgreSQL major
+// version.
+func (r *Recovery) settings(version int, command string) ([][2]string, error) {
+	if r.TargetLSN != "" && version < 10 {
+		return nil, errors.New("recovery target lsn requires PostgreSQL 10 or later")
+	}
+	settings := [][2]string{{"restore_command", command}}
+	if r.TargetTime != "" {
+		settings = append(settings, [2]string{"recovery_target_time", r.TargetTime})
+	}
+	if r.TargetLSN != "" {
+		settings = append(settings, [2]string{"recovery_target_lsn", r.TargetLSN})
+	}
+	if r.TargetXID != "" {
+		settings = append(settings, [2]string{"recovery_target_xid", r.TargetXID})
+	}
+	if r.TargetTimeline != "" {
+		settings = append(settings, [2]string{"recovery_target_timeline", r.TargetTimeline})
+	}
+	if r.Standby && version < 12 {
+		settings = append(settings, [2]string{"standby_mode", "on"})
+	}
+	return settings, nil
+}
+
+// Write writes the recovery configuration of the given cluster directory,
+// using recovery.conf before PostgreSQL 12, and recovery.signal or
+// standby.signal along with postgresql.auto.conf afterward.
+func (r *Recovery) Write(cluster, command string) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	version, err := clusterVersion(cluster)
+	if err != nil {
+		return err
+	}
+	settings, err := r.settings(version, command)
+	if err != nil {
+		return err
+	}
+	var conf []string
+	for _, setting := range settings {
+		conf = append(conf, fmt.Sprintf("%s = %s", setting[0], quoteSetting(setting[1])))
+	}
+	if version < 12 {
+		return ioutil.WriteFile(filepath.Join(cluster, "recovery.conf"), []byte(strings.Join(conf, "\n")+"\n"), 0600)
+	}
+	signal := "recovery.signal"
+	if r.Standby {
+		signal = "standby.signal"
+	}
+	if err := ioutil.WriteFile(filepath.Join(cluster, signal), nil, 0600); err != nil {
+		return err
+	}
+	return writeAutoConf(filepath.Join(cluster, "postgresql.auto.conf"), conf)
+}
+
+// writeAutoConf replaces the recovery settings of the given
+// postgresql.auto.conf by the given ones, keeping its other settings, such
+// that settings of the backed up cluster don't override them.
+func writeAutoConf(filename string, conf []string) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		if line == "" && len(lines) == 0 || line == recoveryComment || recoverySetting(line) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	lines = append(append(lines, recoveryComment), conf...)
+	tmp := filename + ".law"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+const recoveryComment = "# Recovery configuration generated by law"
+
+// recoverySetting reports whether the given configuration line sets the
+// restore_command or a recovery target.
+func recoverySetting(line string) bool {
+	fields := strings.FieldsFunc(line, func(r rune) bool {
+		return r == '=' || r == ' ' || r == '\t'
+	})
+	if len(fields) == 0 {
+		return false
+	}
+	key := strings.ToLower(fields[0])
+	return key == "restore_command" || key == "standby_mode" || strings.HasPrefix(key, "recovery_target")
+}
+
+// clusterVersion returns the major version of a cluster directory.
+func clusterVersion(cluster string) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(cluster, "PG_VERSION"))
+	if err != nil {
+		return 0, err
+	}
+	major := strings.SplitN(strings.TrimSpace(string(b)), ".", 2)[0]
+	version, err := strconv.Atoi(major)
+	if err != nil {
+		return 0, fmt.Errorf("invalid PostgreSQL version: %s", b)
+	}
+	return version, nil
+}
+
+// restoreCommand returns a restore_command fetching segments with law from
+// the given storage, along with the given configuration file. The storage
+// URL is left to the configuration file, or to the environment of the
+// server, when it holds credentials, so they aren't written to the cluster.
+func restoreCommand(uri, config string) string {
+	law, err := os.Executable()
+	if err != nil {
+		law = "law"
+	}
+	command := quoteShell(law)
+	if config != "" {
+		command += " -config " + quoteShell(config)
+	}
+	if uri != "" && storage.RedactURL(uri) == uri {
+		command += " -storage " + quoteShell(uri)
+	}
+	return command + ` wal-fetch -segment "%f" -destination "%p"`
+}
+
+func quoteSetting(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func quoteShell(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
@@ -0,0 +1,161 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/cyberdelia/law/operator/xlog"
+)
+
+// RetentionReport represents the backups kept and deleted by a retention
+// run, and the number of WAL segments deleted.
+type RetentionReport struct {
+	Kept     []string `json:"kept"`
+	Deleted  []string `json:"deleted"`
+	Segments int      `json:"segments"`
+}
+
+// Retain deletes all but the given number of newest backups, along with
+// the WAL segments preceding the oldest backup kept, while holding the lock
+// of the storage, then notifies of its outcome. Timeline history files are
+// kept.
+func (o *Operator) Retain(ctx context.Context, keep int) (report *RetentionReport, err error) {
+	defer func(start time.Time) { observe("retention", start, err) }(time.Now())
+	defer func() { o.notifyRetention(ctx, report, err) }()
+	if keep < 1 {
+		return nil, errors.New("at least one backup must be kept")
+	}
+	err = o.withLock(ctx, "delete", func(ctx context.Context) error {
+		report, err = o.retain(ctx, keep)
+		return err
+	})
+	return report, err
+}
+
+func (o *Operator) retain(ctx context.Context, keep int) (report *RetentionReport, err error) {
+	backups, err := o.s.Backups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	size, err := o.segmentSize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	starts, err := sortBackups(backups, size)
+	if err != nil {
+		return nil, err
+	}
+	report = new(RetentionReport)
+	if len(backups) <= keep {
+		report.Kept = backups
+		return report, nil
+	}
+	// Full backups which delta backups kept are based on are kept as well.
+	kept, err := o.withBases(ctx, backups[len(backups)-keep:])
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	for _, name := range backups {
+		if contains(kept, name) {
+			report.Kept = append(report.Kept, name)
+		} else {
+			deleted = append(deleted, name)
+		}
+	}
+	for _, name := range deleted {
+		if err := o.s.DeleteBackup(ctx, name); err != nil {
+			return report, err
+		}
+		report.Deleted = append(report.Deleted, name)
+		o.log.Info("deleted backup", "backup", name)
+	}
+	segments, err := o.s.Segments(ctx)
+	if err != nil {
+		return report, err
+	}
+	oldest := starts[report.Kept[0]]
+	for _, name := range segments {
+		if requiredSegment(name, oldest, size) {
+			continue
+		}
+		if err := o.s.DeleteSegment(ctx, name); err != nil {
+			return report, err
+		}
+		report.Segments++
+	}
+	o.log.Info("applied retention", "kept", len(report.Kept), "deleted", len(report.Deleted), "segments", report.Segments)
+	return report, nil
+}
+
+// sortBackups sorts the given backups by their starting location, then by
+// timeline as a backup taken after a promotion at the same location is
+// newer, returning their starting segments.
+func sortBackups(backups []string, size int64) (map[string]xlog.Segment, error) {
+	starts := make(map[string]xlog.Segment, len(backups))
+	for _, name := range backups {
+		start, err := parseBackupName(name, size)
+		if err != nil {
+			return nil, err
+		}
+		starts[name] = start
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		a, b := starts[backups[i]], starts[backups[j]]
+		if a.Number != b.Number {
+			return a.Number < b.Number
+		}
+		return a.Timeline < b.Timeline
+	})
+	return starts, nil
+}
+
+// Run represents the outcome of a backup run, and of the retention which
+// followed it.
+type Run struct {
+	Cluster   string           `json:"cluster"`
+	Hostname  string           `json:"hostname"`
+	Scheduled *time.Time       `json:"scheduled,omitempty"`
+	Started   time.Time        `json:"started"`
+	Finished  time.Time        `json:"finished"`
+	Error     string           `json:"error,omitempty"`
+	Retention *RetentionReport `json:"retention,omitempty"`
+}
+
+// RecordRun records the outcome of the given run in the storage.
+func (o *Operator) RecordRun(ctx context.Context, run *Run) error {
+	w, err := o.s.CreateRun(ctx, run.Started.UTC().Format("20060102T150405.000000000Z"))
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(run); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// Runs returns the last n recorded runs, oldest first.
+func (o *Operator) Runs(ctx context.Context, n int) ([]*Run, error) {
+	rs, err := o.s.Runs(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, r := range rs {
+			r.Close()
+		}
+	}()
+	var runs []*Run
+	for _, r := range rs {
+		run := new(Run)
+		if err := json.NewDecoder(r).Decode(run); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
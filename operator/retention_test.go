@@ -0,0 +1,99 @@
+package operator
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetain(t *testing.T) {
+	o, err := NewOperator("mem://retain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, name := range []string{"000000010000000000000002", "000000020000000000000004", "000000020000000000000006"} {
+		_, _, err := o.upload(ctx, &Backup{Name: name, Offset: "00000028"}, 0, 0, func(w io.WriteCloser) error {
+			return writeFiles(w, map[string]string{"PG_VERSION": "12\n"})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"000000010000000000000002", "000000010000000000000003", "00000002.history", "000000020000000000000004", "000000020000000000000005"} {
+		w, err := o.s.Archive(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+	}
+	if _, err := o.Retain(ctx, 0); err == nil {
+		t.Error("retaining no backups should fail")
+	}
+	report, err := o.Retain(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &RetentionReport{
+		Kept:     []string{"base_000000020000000000000004_00000028", "base_000000020000000000000006_00000028"},
+		Deleted:  []string{"base_000000010000000000000002_00000028"},
+		Segments: 2,
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("report don't match, wants %+v got %+v", expected, report)
+	}
+	segments, err := o.s.Segments(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"00000002.history", "000000020000000000000004", "000000020000000000000005"}; !reflect.DeepEqual(segments, expected) {
+		t.Errorf("segments don't match, wants %v got %v", expected, segments)
+	}
+}
+
+func TestRetainTimelines(t *testing.T) {
+	o, err := NewOperator("mem://retain-timelines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, name := range []string{"0000000200000000000000FF", "000000010000000100000000", "000000020000000100000000"} {
+		_, _, err := o.upload(ctx, &Backup{Name: name, Offset: "00000028"}, 0, 0, func(w io.WriteCloser) error {
+			return writeFiles(w, map[string]string{"PG_VERSION": "12\n"})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := o.Retain(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"base_000000010000000100000000_00000028", "base_000000020000000100000000_00000028"}; !reflect.DeepEqual(report.Kept, expected) {
+		t.Errorf("kept backups don't match, wants %v got %v", expected, report.Kept)
+	}
+}
+
+func TestRuns(t *testing.T) {
+	o, err := NewOperator("mem://runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		run := &Run{Cluster: "/var/lib/postgres", Started: start.Add(time.Duration(i) * time.Hour)}
+		if err := o.RecordRun(ctx, run); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runs, err := o.Runs(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 || !runs[0].Started.Equal(start.Add(time.Hour)) || !runs[1].Started.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("runs don't match, got %+v", runs)
+	}
+}
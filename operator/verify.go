@@ -0,0 +1,224 @@
+package operator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cyberdelia/law/operator/xlog"
+	"github.com/cyberdelia/pipeline"
+)
+
+// Report represents the state of the archived WAL chain.
+type Report struct {
+	Timeline uint32         `json:"timeline"`
+	Newest   string         `json:"newest"`
+	Backups  []BackupReport `json:"backups"`
+}
+
+// BackupReport represents the WAL segments missing to restore a backup
+// up to the newest archived segment.
+type BackupReport struct {
+	Name    string   `json:"name"`
+	Start   string   `json:"start"`
+	Missing []string `json:"missing"`
+}
+
+// Complete reports whether no segments are missing.
+func (r *Report) Complete() bool {
+	for _, b := range r.Backups {
+		if len(b.Missing) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Verify looks for gaps in the archived WAL chain, from the start of each
+// backup to the newest archived segment. The size of segments is detected
+// from the metadata of backups when not given.
+func (o *Operator) Verify(ctx context.Context, size int64) (report *Report, err error) {
+	defer func(start time.Time) { observe("verify", start, err) }(time.Now())
+	if size == 0 {
+		if size, err = o.segmentSize(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := xlog.ValidSegmentSize(size); err != nil {
+		return nil, err
+	}
+	names, err := o.s.Segments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		newest   xlog.Segment
+		timeline uint32
+	)
+	segments := make(map[xlog.Segment]bool, len(names))
+	for _, name := range names {
+		if strings.HasSuffix(name, ".history") {
+			tli, err := strconv.ParseUint(strings.TrimSuffix(name, ".history"), 16, 32)
+			if err != nil {
+				continue
+			}
+			if uint32(tli) > timeline {
+				timeline = uint32(tli)
+			}
+			continue
+		}
+		s, err := xlog.ParseSegment(name, size)
+		if err != nil {
+			// Backup labels and partial segments are not part of the chain.
+			continue
+		}
+		segments[s] = true
+		if s.Number > newest.Number || (s.Number == newest.Number && s.Timeline > newest.Timeline) {
+			newest = s
+		}
+		if s.Timeline > timeline {
+			timeline = s.Timeline
+		}
+	}
+	h, err := o.history(ctx, timeline)
+	if err != nil {
+		return nil, err
+	}
+	backups, err := o.s.Backups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report = &Report{
+		Timeline: timeline,
+		Backups:  make([]BackupReport, 0, len(backups)),
+	}
+	if len(segments) > 0 {
+		report.Newest = newest.Name(size)
+	}
+	for _, name := range backups {
+		start, err := parseBackupName(name, size)
+		if err != nil {
+			return nil, err
+		}
+		b := BackupReport{
+			Name:    name,
+			Start:   start.Name(size),
+			Missing: []string{},
+		}
+		for n := start.Number; len(segments) > 0 && n <= newest.Number; n++ {
+			s := xlog.Segment{
+				Timeline: h.timeline(n, size, timeline),
+				Number:   n,
+			}
+			if !segments[s] {
+				b.Missing = append(b.Missing, s.Name(size))
+			}
+		}
+		report.Backups = append(report.Backups, b)
+	}
+	return report, nil
+}
+
+// segmentSize detects the size of WAL segments from the metadata of the
+// latest backup.
+func (o *Operator) segmentSize(ctx context.Context) (int64, error) {
+	backups, err := o.s.Backups(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for i := len(backups) - 1; i >= 0; i-- {
+		m, err := o.readMetadata(ctx, backups[i])
+		if err != nil {
+			return 0, err
+		}
+		if m != nil && m.SegmentSize != 0 {
+			return m.SegmentSize, nil
+		}
+	}
+	return xlog.DefaultSegmentSize, nil
+}
+
+// history represents the content of a timeline history file.
+type history []historyEntry
+
+type historyEntry struct {
+	Timeline uint32
+	Switch   xlog.LSN
+}
+
+// timeline returns the timeline a segment is expected to be archived on.
+func (h history) timeline(n uint64, size int64, current uint32) uint32 {
+	for _, e := range h {
+		if n < e.Switch.Segment(e.Timeline, size).Number {
+			return e.Timeline
+		}
+	}
+	return current
+}
+
+func (o *Operator) history(ctx context.Context, timeline uint32) (history, error) {
+	if timeline <= 1 {
+		return nil, nil
+	}
+	b, err := o.read(ctx, fmt.Sprintf("%08X.history", timeline))
+	if err != nil {
+		return nil, fmt.Errorf("missing history for timeline %d: %v", timeline, err)
+	}
+	return parseHistory(b)
+}
+
+func parseHistory(b []byte) (h history, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid history line: %s", line)
+		}
+		tli, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid history line: %s", line)
+		}
+		lsn, err := xlog.ParseLSN(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		h = append(h, historyEntry{
+			Timeline: uint32(tli),
+			Switch:   lsn,
+		})
+	}
+	return h, scanner.Err()
+}
+
+// parseBackupName returns the starting segment of a backup named
+// base_<segment>_<offset>.
+func parseBackupName(name string, size int64) (xlog.Segment, error) {
+	parts := strings.Split(name, "_")
+	if len(parts) != 3 || parts[0] != "base" {
+		return xlog.Segment{}, fmt.Errorf("invalid backup name: %s", name)
+	}
+	return xlog.ParseSegment(parts[1], size)
+}
+
+func (o *Operator) read(ctx context.Context, name string) ([]byte, error) {
+	r, err := o.s.Unarchive(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	pipe, err := pipeline.PipeRead(r, lzoReadPipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer pipe.Close()
+	return ioutil.ReadAll(pipe)
+}
@@ -0,0 +1,76 @@
+package operator
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cyberdelia/law/operator/xlog"
+)
+
+func TestHistoryTimeline(t *testing.T) {
+	h, err := parseHistory([]byte("1\t0/3000000\tno recovery target specified\n\n2\t0/5800028\tbefore 2000-01-01 05:00:00+05\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := history{{1, 0x3000000}, {2, 0x5800028}}
+	if !reflect.DeepEqual(h, want) {
+		t.Fatalf("history don't match, wants %v got %v", want, h)
+	}
+	for n, tli := range []uint32{1, 1, 1, 2, 2, 3, 3} {
+		if got := h.timeline(uint64(n), xlog.DefaultSegmentSize, 3); got != tli {
+			t.Errorf("timeline of segment %d don't match, wants %d got %d", n, tli, got)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	o, err := NewOperator("file://" + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"000000010000000000000002",
+		"000000010000000000000003",
+		"000000010000000000000005",
+		"000000010000000000000005.00000028.backup",
+	} {
+		segment := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(segment, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.Archive(context.Background(), segment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := o.s.Backup(context.Background(), "000000010000000000000002", "00000028", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	report, err := o.Verify(context.Background(), xlog.DefaultSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Newest != "000000010000000000000005" {
+		t.Errorf("newest segment don't match, got %s", report.Newest)
+	}
+	if len(report.Backups) != 1 {
+		t.Fatalf("expected one backup, got %d", len(report.Backups))
+	}
+	want := []string{"000000010000000000000004"}
+	if !reflect.DeepEqual(report.Backups[0].Missing, want) {
+		t.Errorf("missing segments don't match, wants %v got %v", want, report.Backups[0].Missing)
+	}
+	if report.Complete() {
+		t.Error("report should not be complete")
+	}
+}
@@ -0,0 +1,108 @@
+// Package xlog maps WAL locations to segment names, for any power of two
+// segment size supported by PostgreSQL.
+package xlog
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultSegmentSize represents the default size of a WAL segment.
+const DefaultSegmentSize = 16 * 1024 * 1024
+
+// ValidSegmentSize checks that the given segment size is supported by
+// PostgreSQL.
+func ValidSegmentSize(size int64) error {
+	if size < 1024*1024 || size > 1024*1024*1024 || size&(size-1) != 0 {
+		return errors.New("segment size must be a power of two between 1MB and 1GB")
+	}
+	return nil
+}
+
+// LSN represents a location in the WAL.
+type LSN uint64
+
+// ParseLSN parses a WAL location, such as 0/3000028.
+func ParseLSN(s string) (LSN, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid location: %s", s)
+	}
+	hi, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid location: %s", s)
+	}
+	lo, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid location: %s", s)
+	}
+	return LSN(hi<<32 | lo), nil
+}
+
+// String returns the textual representation of a location.
+func (l LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint64(l)>>32, uint32(l))
+}
+
+// Segment returns the segment containing the location on the given timeline.
+func (l LSN) Segment(timeline uint32, size int64) Segment {
+	return Segment{
+		Timeline: timeline,
+		Number:   uint64(l) / uint64(size),
+	}
+}
+
+// Offset returns the offset of the location within its segment.
+func (l LSN) Offset(size int64) int64 {
+	return int64(uint64(l) % uint64(size))
+}
+
+// Segment represents a WAL segment.
+type Segment struct {
+	Timeline uint32
+	Number   uint64
+}
+
+// ParseSegment parses a WAL segment file name, such as
+// 000000010000000000000001, for the given segment size.
+func ParseSegment(name string, size int64) (Segment, error) {
+	if len(name) != 24 {
+		return Segment{}, fmt.Errorf("invalid segment name: %s", name)
+	}
+	if err := ValidSegmentSize(size); err != nil {
+		return Segment{}, err
+	}
+	var fields [3]uint32
+	for i := range fields {
+		n, err := strconv.ParseUint(name[i*8:(i+1)*8], 16, 32)
+		if err != nil {
+			return Segment{}, fmt.Errorf("invalid segment name: %s", name)
+		}
+		fields[i] = uint32(n)
+	}
+	perLog := segmentsPerLog(size)
+	if uint64(fields[2]) >= perLog {
+		return Segment{}, fmt.Errorf("invalid segment name: %s", name)
+	}
+	return Segment{
+		Timeline: fields[0],
+		Number:   uint64(fields[1])*perLog + uint64(fields[2]),
+	}, nil
+}
+
+// Name returns the file name of a segment for the given segment size.
+func (s Segment) Name(size int64) string {
+	perLog := segmentsPerLog(size)
+	return fmt.Sprintf("%08X%08X%08X", s.Timeline, s.Number/perLog, s.Number%perLog)
+}
+
+// Start returns the location of the beginning of a segment.
+func (s Segment) Start(size int64) LSN {
+	return LSN(s.Number * uint64(size))
+}
+
+func segmentsPerLog(size int64) uint64 {
+	return 0x100000000 / uint64(size)
+}
@@ -0,0 +1,78 @@
+package xlog
+
+import "testing"
+
+func TestParseSegment(t *testing.T) {
+	var tests = []struct {
+		name string
+		size int64
+		want Segment
+	}{
+		{"000000010000000000000001", DefaultSegmentSize, Segment{1, 1}},
+		{"0000000200000001000000FF", DefaultSegmentSize, Segment{2, 0x1FF}},
+		{"000000010000000100000003", 1024 * 1024 * 1024, Segment{1, 7}},
+	}
+	for _, tt := range tests {
+		s, err := ParseSegment(tt.name, tt.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != tt.want {
+			t.Errorf("segment don't match, wants %v got %v", tt.want, s)
+		}
+		if name := s.Name(tt.size); name != tt.name {
+			t.Errorf("name don't match, wants %s got %s", tt.name, name)
+		}
+	}
+}
+
+func TestParseInvalidSegment(t *testing.T) {
+	var tests = []struct {
+		name string
+		size int64
+	}{
+		{"00000001000000000000000", DefaultSegmentSize},
+		{"00000001000000000000000G", DefaultSegmentSize},
+		{"000000010000000000000100", DefaultSegmentSize},
+		{"000000010000000000000001", 3 * 1024 * 1024},
+	}
+	for _, tt := range tests {
+		if _, err := ParseSegment(tt.name, tt.size); err == nil {
+			t.Errorf("expected error for %s", tt.name)
+		}
+	}
+}
+
+func TestLSN(t *testing.T) {
+	lsn, err := ParseLSN("1/5800028")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lsn != 0x105800028 {
+		t.Fatalf("location don't match, wants %X got %X", 0x105800028, uint64(lsn))
+	}
+	if s := lsn.String(); s != "1/5800028" {
+		t.Errorf("string don't match, wants 1/5800028 got %s", s)
+	}
+	var tests = []struct {
+		size   int64
+		name   string
+		offset int64
+	}{
+		{DefaultSegmentSize, "000000020000000100000005", 0x800028},
+		{64 * 1024 * 1024, "000000020000000100000001", 0x1800028},
+		{1024 * 1024, "000000020000000100000058", 0x28},
+	}
+	for _, tt := range tests {
+		s := lsn.Segment(2, tt.size)
+		if name := s.Name(tt.size); name != tt.name {
+			t.Errorf("segment don't match, wants %s got %s", tt.name, name)
+		}
+		if offset := lsn.Offset(tt.size); offset != tt.offset {
+			t.Errorf("offset don't match, wants %X got %X", tt.offset, offset)
+		}
+		if start := s.Start(tt.size); start+LSN(tt.offset) != lsn {
+			t.Errorf("start don't match, got %s", start)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	awsMetadataEndpoint = "http://169.254.169.254"
+	awsMetadataTokenTTL = "21600"
+	awsRefreshWindow    = 5 * time.Minute
+)
+
+// awsCredentials represents a set of AWS credentials, temporary ones expire.
+type awsCredentials struct {
+	accessKey     string
+	secretKey     string
+	securityToken string
+	expiry        time.Time
+}
+
+func (c *awsCredentials) expired() bool {
+	return !c.expiry.IsZero() && time.Now().Add(awsRefreshWindow).After(c.expiry)
+}
+
+// awsProvider retrieves credentials, or nil when not configured.
+type awsProvider func(ctx context.Context) (*awsCredentials, error)
+
+// awsCredentialChain retrieves credentials from the first configured
+// provider, and caches them until they are about to expire.
+type awsCredentialChain struct {
+	providers []awsProvider
+
+	mu          sync.Mutex
+	credentials *awsCredentials
+}
+
+// newAWSCredentialChain returns the default chain, looking for credentials
+// in the environment, the shared credentials file, a web identity token
+// and the instance metadata, in that order. Web identity comes before the
+// instance metadata, as pods of an EKS node can reach the metadata of the
+// node.
+func newAWSCredentialChain() *awsCredentialChain {
+	return &awsCredentialChain{
+		providers: []awsProvider{
+			awsEnvCredentials,
+			awsProfileCredentials,
+			(&awsWebIdentity{endpoint: awsSTSEndpoint()}).credentials,
+			(&awsMetadata{endpoint: awsMetadataEndpointURL()}).credentials,
+		},
+	}
+}
+
+// Credentials returns valid credentials, refreshing them when needed.
+func (c *awsCredentialChain) Credentials(ctx context.Context) (*awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.credentials != nil && !c.credentials.expired() {
+		return c.credentials, nil
+	}
+	for _, p := range c.providers {
+		credentials, err := p(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if credentials != nil {
+			c.credentials = credentials
+			return credentials, nil
+		}
+	}
+	return nil, &Error{Kind: ErrAuth, Err: errors.New("s3: no credentials found")}
+}
+
+func awsEnvCredentials(context.Context) (*awsCredentials, error) {
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, nil
+	}
+	token := os.Getenv("AWS_SESSION_TOKEN")
+	if token == "" {
+		token = os.Getenv("AWS_SECURITY_TOKEN")
+	}
+	return &awsCredentials{
+		accessKey:     accessKey,
+		secretKey:     secretKey,
+		securityToken: token,
+	}, nil
+}
+
+// awsProfileCredentials reads the profile named by AWS_PROFILE, or the
+// default one, from the shared credentials file.
+func awsProfileCredentials(context.Context) (*awsCredentials, error) {
+	filename := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if filename == "" {
+		filename = filepath.Join(os.Getenv("HOME"), ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var (
+		section string
+		values  = make(map[string]string)
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 {
+			values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if values["aws_access_key_id"] == "" || values["aws_secret_access_key"] == "" {
+		return nil, nil
+	}
+	return &awsCredentials{
+		accessKey:     values["aws_access_key_id"],
+		secretKey:     values["aws_secret_access_key"],
+		securityToken: values["aws_session_token"],
+	}, nil
+}
+
+func awsSTSEndpoint() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return "https://sts." + region + ".amazonaws.com"
+	}
+	return "https://sts.amazonaws.com"
+}
+
+// awsWebIdentity exchanges the token referenced by
+// AWS_WEB_IDENTITY_TOKEN_FILE for credentials of the AWS_ROLE_ARN role, as
+// configured for EKS service accounts.
+type awsWebIdentity struct {
+	endpoint string
+}
+
+func (w *awsWebIdentity) credentials(ctx context.Context) (*awsCredentials, error) {
+	filename, role := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+	if filename == "" || role == "" {
+		return nil, nil
+	}
+	// The token is rotated, and read again on each refresh.
+	token, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = fmt.Sprintf("law-%d", time.Now().Unix())
+	}
+	resp, err := postForm(ctx, w.endpoint, url.Values{
+		"Action":           []string{"AssumeRoleWithWebIdentity"},
+		"Version":          []string{"2011-06-15"},
+		"RoleArn":          []string{role},
+		"RoleSessionName":  []string{session},
+		"WebIdentityToken": []string{strings.TrimSpace(string(token))},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newS3Error(resp)
+	}
+	var r struct {
+		AccessKeyID     string    `xml:"AssumeRoleWithWebIdentityResult>Credentials>AccessKeyId"`
+		SecretAccessKey string    `xml:"AssumeRoleWithWebIdentityResult>Credentials>SecretAccessKey"`
+		SessionToken    string    `xml:"AssumeRoleWithWebIdentityResult>Credentials>SessionToken"`
+		Expiration      time.Time `xml:"AssumeRoleWithWebIdentityResult>Credentials>Expiration"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	return &awsCredentials{
+		accessKey:     r.AccessKeyID,
+		secretKey:     r.SecretAccessKey,
+		securityToken: r.SessionToken,
+		expiry:        r.Expiration,
+	}, nil
+}
+
+func awsMetadataEndpointURL() string {
+	if os.Getenv("AWS_EC2_METADATA_DISABLED") == "true" {
+		return ""
+	}
+	if endpoint := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"); endpoint != "" {
+		return strings.TrimRight(endpoint, "/")
+	}
+	return awsMetadataEndpoint
+}
+
+// awsMetadata retrieves the credentials of the instance role using IMDSv2.
+type awsMetadata struct {
+	endpoint string
+}
+
+func (m *awsMetadata) credentials(ctx context.Context) (*awsCredentials, error) {
+	if m.endpoint == "" {
+		return nil, nil
+	}
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", m.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", awsMetadataTokenTTL)
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// Not running on an instance.
+		return nil, nil
+	}
+	token, err := awsMetadataBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", m.endpoint+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		return awsMetadataBody(resp)
+	}
+	role, err := get("/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0])
+	if name == "" {
+		return nil, nil
+	}
+	b, err := get("/latest/meta-data/iam/security-credentials/" + name)
+	if err != nil {
+		return nil, err
+	}
+	var r struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	return &awsCredentials{
+		accessKey:     r.AccessKeyID,
+		secretKey:     r.SecretAccessKey,
+		securityToken: r.Token,
+		expiry:        r.Expiration,
+	}, nil
+}
+
+// postForm posts the given form, bounded by credentialsTimeout and the
+// given context.
+func postForm(ctx context.Context, uri string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := &http.Client{
+		Timeout: credentialsTimeout,
+	}
+	return client.Do(req)
+}
+
+func awsMetadataBody(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("s3: unexpected metadata error: (%d) %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
@@ -0,0 +1,411 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	azureVersion   = "2020-10-02"
+	azureBlockSize = 16 * 1024 * 1024
+)
+
+// AzureStorage represents an Azure Blob Storage based file storage.
+type AzureStorage struct {
+	endpoint  string
+	container string
+	prefix    string
+	client    *http.Client
+}
+
+// NewAzureStorage creates a new AzureStorage based on the given
+// azure://account/container/prefix URL.
+//
+// Requests are authenticated using the shared key in AZURE_STORAGE_KEY, or
+// the SAS token in AZURE_STORAGE_SAS_TOKEN. AZURE_STORAGE_ENDPOINT
+// overrides the blob service endpoint of the account, such as
+// http://127.0.0.1:10000/devstoreaccount1 for Azurite.
+func NewAzureStorage(u *url.URL) (*AzureStorage, error) {
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if u.Host == "" || parts[0] == "" {
+		return nil, errors.New("azure: storage URL must be azure://account/container/prefix")
+	}
+	s := &AzureStorage{
+		endpoint:  fmt.Sprintf("https://%s.blob.core.windows.net", u.Host),
+		container: parts[0],
+	}
+	if len(parts) == 2 {
+		s.prefix = parts[1]
+	}
+	if endpoint := os.Getenv("AZURE_STORAGE_ENDPOINT"); endpoint != "" {
+		s.endpoint = strings.TrimRight(endpoint, "/")
+	}
+	t := &azureTransport{
+		account: u.Host,
+		sas:     strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?"),
+	}
+	if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		b, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("azure: invalid shared key: %v", err)
+		}
+		t.key = b
+	}
+	if t.key == nil && t.sas == "" {
+		return nil, errors.New("azure: AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN required")
+	}
+	s.client = &http.Client{
+		Transport: t,
+	}
+	return s, nil
+}
+
+func (s AzureStorage) blob(name string) string {
+	var segments []string
+	for _, segment := range strings.Split(path.Join(s.container, s.prefix, name), "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	return s.endpoint + "/" + strings.Join(segments, "/")
+}
+
+// Create creates a new file based on the given filename, staging blocks as
+// data is written and committing them when closed. Blocks staged before the
+// context is done are never committed, and discarded by the service.
+func (s AzureStorage) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	return &azureWriter{
+		ctx:    ctx,
+		client: s.client,
+		url:    s.blob(name),
+		buf:    new(bytes.Buffer),
+	}, nil
+}
+
+// Open opens the given filename.
+func (s AzureStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.blob(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAzureError(resp)
+	}
+	return resp.Body, nil
+}
+
+// List lists all files presents in the file storage below the given prefix,
+// or the file of the given name when it doesn't end with a slash.
+func (s AzureStorage) List(ctx context.Context, name string) (files []io.ReadCloser, err error) {
+	names, err := s.Names(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		file, err := s.Open(ctx, name)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Names lists the names of all files presents in the file storage below the
+// given prefix, or the file of the given name when it doesn't end with a
+// slash.
+func (s AzureStorage) Names(ctx context.Context, name string) (names []string, err error) {
+	prefix := strings.TrimPrefix(path.Join(s.prefix, name), "/")
+	if prefix != "" && (name == "" || strings.HasSuffix(name, "/")) {
+		prefix += "/"
+	}
+	q := url.Values{
+		"restype": []string{"container"},
+		"comp":    []string{"list"},
+		"prefix":  []string{prefix},
+	}
+	for {
+		req, err := http.NewRequestWithContext(ctx, "GET", s.endpoint+"/"+url.PathEscape(s.container)+"?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, newAzureError(resp)
+		}
+		var l struct {
+			Names      []string `xml:"Blobs>Blob>Name"`
+			NextMarker string   `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&l)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range l.Names {
+			if n = name + strings.TrimPrefix(n, prefix); matchName(name, n) {
+				names = append(names, n)
+			}
+		}
+		if l.NextMarker == "" {
+			return names, nil
+		}
+		q.Set("marker", l.NextMarker)
+	}
+}
+
+// Size returns the size of the given filename.
+func (s AzureStorage) Size(ctx context.Context, name string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", s.blob(name), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, &azureError{StatusCode: resp.StatusCode}
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("azure: unknown size of %s", name)
+	}
+	return resp.ContentLength, nil
+}
+
+// Delete deletes the given filename.
+func (s AzureStorage) Delete(ctx context.Context, name string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", s.blob(name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNotFound {
+		return newAzureError(resp)
+	}
+	return nil
+}
+
+// azureWriter stages blocks of a block blob, and commits the block list
+// when closed.
+type azureWriter struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+	buf    *bytes.Buffer
+	blocks []string
+	err    error
+}
+
+func (w *azureWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, _ := w.buf.Write(p)
+	for w.buf.Len() >= azureBlockSize {
+		if w.err = w.stage(w.buf.Next(azureBlockSize)); w.err != nil {
+			return n, w.err
+		}
+	}
+	return n, nil
+}
+
+func (w *azureWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.buf.Len() > 0 {
+		if w.err = w.stage(w.buf.Bytes()); w.err != nil {
+			return w.err
+		}
+	}
+	w.err = w.commit()
+	return w.err
+}
+
+// stage uploads a block, block ids must all have the same length.
+func (w *azureWriter) stage(block []byte) error {
+	id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(w.blocks))))
+	q := url.Values{
+		"comp":    []string{"block"},
+		"blockid": []string{id},
+	}
+	resp, err := w.do("PUT", w.url+"?"+q.Encode(), block)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return newAzureError(resp)
+	}
+	w.blocks = append(w.blocks, id)
+	return nil
+}
+
+func (w *azureWriter) commit() error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{Latest: w.blocks})
+	if err != nil {
+		return err
+	}
+	resp, err := w.do("PUT", w.url+"?comp=blocklist", append([]byte(xml.Header), body...))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return newAzureError(resp)
+	}
+	return nil
+}
+
+func (w *azureWriter) do(method, uri string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(w.ctx, method, uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return w.client.Do(req)
+}
+
+// azureTransport authenticates requests using either a shared key or a SAS
+// token.
+type azureTransport struct {
+	account string
+	key     []byte
+	sas     string
+}
+
+// RoundTrip implements the RoundTripper interface.
+func (t *azureTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c := new(http.Request)
+	*c = *r
+	c.URL = new(url.URL)
+	*c.URL = *r.URL
+	c.Header = make(http.Header, len(r.Header)+3)
+	for k, v := range r.Header {
+		c.Header[k] = append([]string(nil), v...)
+	}
+	c.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	c.Header.Set("x-ms-version", azureVersion)
+	if c.Method == "PUT" && c.URL.Query().Get("comp") == "" {
+		c.Header.Set("x-ms-blob-type", "BlockBlob")
+	}
+	if t.key != nil {
+		c.Header.Set("Authorization", "SharedKey "+t.account+":"+t.sign(c))
+	} else {
+		if c.URL.RawQuery != "" {
+			c.URL.RawQuery += "&"
+		}
+		c.URL.RawQuery += t.sas
+	}
+	return roundTrip(c)
+}
+
+// sign computes the shared key signature of a request.
+func (t *azureTransport) sign(r *http.Request) string {
+	length := ""
+	if r.ContentLength > 0 {
+		length = fmt.Sprint(r.ContentLength)
+	}
+	var headers []string
+	for k := range r.Header {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			headers = append(headers, k)
+		}
+	}
+	sort.Strings(headers)
+	var canonical []string
+	for _, k := range headers {
+		canonical = append(canonical, k+":"+strings.TrimSpace(r.Header.Get(k)))
+	}
+	resource := "/" + t.account + r.URL.EscapedPath()
+	query := r.URL.Query()
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(k) + ":" + strings.Join(values, ",")
+	}
+	stringToSign := strings.Join([]string{
+		r.Method,
+		r.Header.Get("Content-Encoding"),
+		r.Header.Get("Content-Language"),
+		length,
+		r.Header.Get("Content-MD5"),
+		r.Header.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		r.Header.Get("If-Modified-Since"),
+		r.Header.Get("If-Match"),
+		r.Header.Get("If-None-Match"),
+		r.Header.Get("If-Unmodified-Since"),
+		r.Header.Get("Range"),
+		strings.Join(canonical, "\n"),
+		resource,
+	}, "\n")
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+type azureError struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func newAzureError(resp *http.Response) error {
+	defer resp.Body.Close()
+	e := &azureError{
+		StatusCode: resp.StatusCode,
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	xml.Unmarshal(b, e)
+	return e
+}
+
+// Is reports whether the status code of the error is classified by the
+// target, such as ErrNotExist when the blob doesn't exist.
+func (e *azureError) Is(target error) bool {
+	return statusIs(target, e.StatusCode)
+}
+
+func (e *azureError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("azure: unexpected error: (%d) %s: %s", e.StatusCode, e.Code, strings.TrimSpace(e.Message))
+	}
+	return fmt.Sprintf("azure: unexpected error: (%d)", e.StatusCode)
+}
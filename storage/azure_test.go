@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// azuriteKey is the well-known shared key of the Azurite emulator account.
+const azuriteKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+// fakeAzure is a minimal in-memory implementation of the Blob service REST
+// API, for the devstoreaccount1 account.
+type fakeAzure struct {
+	mu     sync.Mutex
+	blobs  map[string][]byte
+	blocks map[string][]byte
+}
+
+func newFakeAzure() *httptest.Server {
+	f := &fakeAzure{
+		blobs:  make(map[string][]byte),
+		blocks: make(map[string][]byte),
+	}
+	return httptest.NewServer(f)
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey devstoreaccount1:") || r.Header.Get("x-ms-date") == "" {
+		http.Error(w, "<Error><Code>AuthenticationFailed</Code></Error>", http.StatusForbidden)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/devstoreaccount1/container/")
+	q := r.URL.Query()
+	switch {
+	case r.Method == "PUT" && q.Get("comp") == "block":
+		b, _ := ioutil.ReadAll(r.Body)
+		f.blocks[name+"#"+q.Get("blockid")] = b
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && q.Get("comp") == "blocklist":
+		var l struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&l); err != nil {
+			http.Error(w, "<Error><Code>InvalidXmlDocument</Code></Error>", http.StatusBadRequest)
+			return
+		}
+		var buf bytes.Buffer
+		for _, id := range l.Latest {
+			b, ok := f.blocks[name+"#"+id]
+			if !ok {
+				http.Error(w, "<Error><Code>InvalidBlockList</Code></Error>", http.StatusBadRequest)
+				return
+			}
+			buf.Write(b)
+		}
+		f.blobs[name] = buf.Bytes()
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "GET" && r.URL.Path == "/devstoreaccount1/container" && q.Get("comp") == "list":
+		var names []string
+		for name := range f.blobs {
+			if strings.HasPrefix(name, q.Get("prefix")) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		// Return a single blob per page to exercise pagination.
+		var l struct {
+			XMLName    xml.Name `xml:"EnumerationResults"`
+			Names      []string `xml:"Blobs>Blob>Name"`
+			NextMarker string   `xml:"NextMarker"`
+		}
+		page, _ := strconv.Atoi(q.Get("marker"))
+		if page < len(names) {
+			l.Names = append(l.Names, names[page])
+		}
+		if page+1 < len(names) {
+			l.NextMarker = strconv.Itoa(page + 1)
+		}
+		xml.NewEncoder(w).Encode(l)
+	case r.Method == "GET" || r.Method == "HEAD":
+		b, ok := f.blobs[name]
+		if !ok {
+			http.Error(w, "<Error><Code>BlobNotFound</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Write(b)
+	case r.Method == "DELETE":
+		if _, ok := f.blobs[name]; !ok {
+			http.Error(w, "<Error><Code>BlobNotFound</Code></Error>", http.StatusNotFound)
+			return
+		}
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "<Error><Code>UnsupportedHttpVerb</Code></Error>", http.StatusBadRequest)
+	}
+}
+
+// TestAzureStorage runs against the Azurite emulator when AZURITE_ENDPOINT
+// is set, such as http://127.0.0.1:10000/devstoreaccount1, or an in-memory
+// fake otherwise.
+func TestAzureStorage(t *testing.T) {
+	endpoint := os.Getenv("AZURITE_ENDPOINT")
+	if endpoint == "" {
+		srv := newFakeAzure()
+		defer srv.Close()
+		endpoint = srv.URL + "/devstoreaccount1"
+	}
+	os.Setenv("AZURE_STORAGE_ENDPOINT", endpoint)
+	defer os.Unsetenv("AZURE_STORAGE_ENDPOINT")
+	os.Setenv("AZURE_STORAGE_KEY", azuriteKey)
+	defer os.Unsetenv("AZURE_STORAGE_KEY")
+	s, err := NewStorage("azure://devstoreaccount1/container/prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv("AZURITE_ENDPOINT") != "" {
+		b := s.b.(*AzureStorage)
+		req, _ := http.NewRequest("PUT", endpoint+"/container?restype=container", nil)
+		resp, err := b.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	content := bytes.Repeat([]byte("law"), azureBlockSize/2)
+	for _, name := range []string{"000000010000000000000001", "000000010000000000000002"} {
+		w, err := s.Archive(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err := s.Segments(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || segments[1] != "000000010000000000000002" {
+		t.Fatalf("unexpected segments %v", segments)
+	}
+	r, err := s.Unarchive(context.Background(), "000000010000000000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Fatal("content don't match")
+	}
+	if _, err := s.Unarchive(context.Background(), "000000010000000000000003"); err == nil {
+		t.Fatal("expected error for missing segment")
+	}
+	for _, name := range []string{"000000010000000000000001", "000000010000000000000002"} {
+		if err := s.b.Delete(context.Background(), "wal_005/"+name+".lzo"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err = s.Segments(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 0 {
+		t.Fatalf("unexpected segments after delete %v", segments)
+	}
+}
+
+func TestAzureStorageCredentials(t *testing.T) {
+	os.Unsetenv("AZURE_STORAGE_KEY")
+	os.Unsetenv("AZURE_STORAGE_SAS_TOKEN")
+	if _, err := NewStorage("azure://account/container"); err == nil {
+		t.Fatal("expected error without credentials")
+	}
+	os.Setenv("AZURE_STORAGE_SAS_TOKEN", "?sv=2020-10-02&sig=abc")
+	defer os.Unsetenv("AZURE_STORAGE_SAS_TOKEN")
+	if _, err := NewStorage("azure://account"); err == nil {
+		t.Fatal("expected error without container")
+	}
+	if _, err := NewStorage("azure://account/container"); err != nil {
+		t.Fatal(err)
+	}
+}
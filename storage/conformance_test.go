@@ -0,0 +1,86 @@
+package storage_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cyberdelia/law/storage"
+	"github.com/cyberdelia/law/storage/storagetest"
+)
+
+func testConformance(t *testing.T, uri string) {
+	b, err := storage.NewBackend(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storagetest.TestBackend(t, b)
+}
+
+// writeSibling stores a file with a backend whose prefix begins like the
+// prefix of the backend under test.
+func writeSibling(t *testing.T, uri string) {
+	b, err := storage.NewBackend(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := b.Create(context.Background(), "sibling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testConformance(t, "file://"+dir)
+}
+
+func TestMemConformance(t *testing.T) {
+	testConformance(t, "mem://conformance")
+}
+
+func TestMultiConformance(t *testing.T) {
+	testConformance(t, "multi:mem://conformance-1,mem://conformance-2")
+}
+
+func TestS3Conformance(t *testing.T) {
+	defer storage.SetS3Credentials()()
+	srv := storage.NewFakeS3()
+	defer srv.Close()
+	writeSibling(t, "s3://bucket/prefix2?endpoint="+srv.URL)
+	testConformance(t, "s3://bucket/prefix?endpoint="+srv.URL)
+}
+
+func TestGCSConformance(t *testing.T) {
+	srv := storage.NewFakeGCS()
+	defer srv.Close()
+	os.Setenv("STORAGE_EMULATOR_HOST", srv.URL)
+	defer os.Unsetenv("STORAGE_EMULATOR_HOST")
+	writeSibling(t, "gs://bucket/prefix2")
+	testConformance(t, "gs://bucket/prefix")
+}
+
+func TestAzureConformance(t *testing.T) {
+	srv := storage.NewFakeAzure()
+	defer srv.Close()
+	os.Setenv("AZURE_STORAGE_ENDPOINT", srv.URL+"/devstoreaccount1")
+	defer os.Unsetenv("AZURE_STORAGE_ENDPOINT")
+	os.Setenv("AZURE_STORAGE_KEY", storage.AzuriteKey)
+	defer os.Unsetenv("AZURE_STORAGE_KEY")
+	writeSibling(t, "azure://devstoreaccount1/container/prefix2")
+	testConformance(t, "azure://devstoreaccount1/container/prefix")
+}
+
+func TestSFTPConformance(t *testing.T) {
+	uri, cleanup := storage.NewSFTPTestStorage(t)
+	defer cleanup()
+	testConformance(t, uri)
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// CopySegment copies the given wal segment to the current layout of the
+// destination storage. It reports whether the segment was copied, or
+// skipped as already present.
+func (s Storage) CopySegment(ctx context.Context, dst *Storage, name string) (bool, error) {
+	versions, err := s.versions(ctx)
+	if err != nil {
+		return false, err
+	}
+	to := fmt.Sprintf("wal_%s/%s.lzo", CurrentVersion, name)
+	for _, v := range versions {
+		var copied bool
+		copied, err = copyFile(ctx, s.b, fmt.Sprintf("wal_%s/%s.lzo", v, name), dst.b, to)
+		if !errors.Is(err, ErrNotExist) {
+			return copied, err
+		}
+	}
+	return false, err
+}
+
+// CopyBackup copies all files of the given backup to the current layout of
+// the destination storage, its metadata last. It returns the number of files copied, and
+// of files skipped as already present.
+func (s Storage) CopyBackup(ctx context.Context, dst *Storage, name string) (copied, skipped int, err error) {
+	prefix, names, err := s.backup(ctx, name)
+	if err != nil {
+		return 0, 0, err
+	}
+	// The metadata is copied last, so an interrupted copy isn't mistaken
+	// for a complete backup.
+	sort.SliceStable(names, func(i, j int) bool {
+		return isMetadata(names[j]) && !isMetadata(names[i])
+	})
+	for _, n := range names {
+		to := fmt.Sprintf("basebackup_%s/%s/%s", CurrentVersion, name, strings.TrimPrefix(n, prefix))
+		ok, err := copyFile(ctx, s.b, n, dst.b, to)
+		if err != nil {
+			return copied, skipped, err
+		}
+		if ok {
+			copied++
+		} else {
+			skipped++
+		}
+	}
+	return copied, skipped, nil
+}
+
+// copyFile copies a file between backends, unless an identical file is
+// already present, and verifies the size of the copy. Files are only read
+// to compare their checksums when their sizes match, as reading them from
+// the destination to verify them would double the transfers of a copy.
+func copyFile(ctx context.Context, src Backend, from string, dst Backend, to string) (bool, error) {
+	existing, err := dst.Size(ctx, to)
+	if err != nil && !errors.Is(err, ErrNotExist) {
+		return false, err
+	}
+	if err == nil {
+		size, err := src.Size(ctx, from)
+		if err != nil {
+			return false, err
+		}
+		if size == existing {
+			identical, err := sameChecksum(ctx, src, from, dst, to)
+			if err != nil || identical {
+				return false, err
+			}
+		}
+	}
+	r, err := src.Open(ctx, from)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	// The copy is discarded on failure by cancelling its context.
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w, err := dst.Create(wctx, to)
+	if err != nil {
+		return false, err
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		cancel()
+		w.Close()
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		return false, err
+	}
+	copied, err := dst.Size(ctx, to)
+	if err != nil {
+		return false, err
+	}
+	if copied != n {
+		return false, &Error{Kind: ErrCorrupt, Err: fmt.Errorf("size mismatch after copying %s, wants %d got %d", from, n, copied)}
+	}
+	return true, nil
+}
+
+// sameChecksum reports whether both files have the same content.
+func sameChecksum(ctx context.Context, src Backend, from string, dst Backend, to string) (bool, error) {
+	existing, err := checksum(ctx, dst, to)
+	if err != nil {
+		return false, err
+	}
+	sum, err := checksum(ctx, src, from)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(sum, existing), nil
+}
+
+func checksum(ctx context.Context, b Backend, name string) ([]byte, error) {
+	r, err := b.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCopyBackup(t *testing.T) {
+	src, err := NewStorage("mem://copy-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := NewStorage("mem://copy-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"basebackup_005/base_000000010000000000000002_00000028/metadata.json",
+		"basebackup_005/base_000000010000000000000002_00000028/part_0.tar.lzo",
+		"basebackup_005/base_000000010000000000000002_00000028/part_1.tar.lzo",
+	} {
+		w, _ := src.b.Create(context.Background(), name)
+		w.Write([]byte(name))
+		w.Close()
+	}
+	copied, skipped, err := src.CopyBackup(context.Background(), dst, "base_000000010000000000000002_00000028")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 3 || skipped != 0 {
+		t.Fatalf("counts don't match, wants 3 copied got %d, %d skipped", copied, skipped)
+	}
+
+	// A partial copy is resumed, and a corrupted file copied again.
+	dst.b.Delete(context.Background(), "basebackup_005/base_000000010000000000000002_00000028/part_1.tar.lzo")
+	w, _ := dst.b.Create(context.Background(), "basebackup_005/base_000000010000000000000002_00000028/metadata.json")
+	w.Write([]byte("corrupted"))
+	w.Close()
+	copied, skipped, err = src.CopyBackup(context.Background(), dst, "base_000000010000000000000002_00000028")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 2 || skipped != 1 {
+		t.Fatalf("counts don't match, wants 2 copied got %d, %d skipped", copied, skipped)
+	}
+	r, err := dst.RestoreMetadata(context.Background(), "base_000000010000000000000002_00000028")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != "basebackup_005/base_000000010000000000000002_00000028/metadata.json" {
+		t.Fatalf("metadata don't match, got %q", b)
+	}
+
+	// A corrupted file of the same size is told apart by its checksum.
+	part := "basebackup_005/base_000000010000000000000002_00000028/part_0.tar.lzo"
+	w, _ = dst.b.Create(context.Background(), part)
+	w.Write([]byte(strings.Repeat("x", len(part))))
+	w.Close()
+	copied, skipped, err = src.CopyBackup(context.Background(), dst, "base_000000010000000000000002_00000028")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 1 || skipped != 2 {
+		t.Fatalf("counts don't match, wants 1 copied got %d, %d skipped", copied, skipped)
+	}
+
+	if _, _, err := src.CopyBackup(context.Background(), dst, "base_000000010000000000000009_00000028"); err == nil {
+		t.Fatal("expected unknown backup")
+	}
+}
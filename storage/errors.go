@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"errors"
+	"net/http"
+	"os"
+)
+
+// Errors classifying the failures of storages, possibly wrapped and
+// matched with errors.Is.
+var (
+	// ErrNotExist is returned by backends opening a file which doesn't
+	// exist.
+	ErrNotExist = os.ErrNotExist
+	// ErrExist is returned when a file already exists with a different
+	// content.
+	ErrExist = errors.New("storage: file already exists with different content")
+	// ErrAuth is returned when credentials are missing, invalid or not
+	// allowed to access the storage.
+	ErrAuth = errors.New("storage: authentication failed")
+	// ErrTransient is returned when the storage can't be reached or fails
+	// temporarily, such that the operation can be retried.
+	ErrTransient = errors.New("storage: transient failure")
+	// ErrCorrupt is returned when a file stored is corrupted.
+	ErrCorrupt = errors.New("storage: corrupted file")
+)
+
+// Error represents a failure classified by one of the errors above.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error is of the given kind.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// statusIs reports whether an HTTP status code is classified by the target
+// error.
+func statusIs(target error, code int) bool {
+	switch target {
+	case ErrNotExist:
+		return code == http.StatusNotFound
+	case ErrAuth:
+		return code == http.StatusUnauthorized || code == http.StatusForbidden
+	case ErrTransient:
+		return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// roundTrip sends an authenticated request with the default transport,
+// classifying failures to reach the storage as transient.
+func roundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil && r.Context().Err() == nil {
+		return nil, &Error{Kind: ErrTransient, Err: err}
+	}
+	return resp, err
+}
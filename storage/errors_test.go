@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestStatusErrors(t *testing.T) {
+	tests := []struct {
+		status   int
+		expected error
+	}{
+		{http.StatusNotFound, ErrNotExist},
+		{http.StatusUnauthorized, ErrAuth},
+		{http.StatusForbidden, ErrAuth},
+		{http.StatusTooManyRequests, ErrTransient},
+		{http.StatusServiceUnavailable, ErrTransient},
+		{http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		for _, err := range []error{
+			&s3Error{StatusCode: tt.status},
+			&gcsError{StatusCode: tt.status},
+			&azureError{StatusCode: tt.status},
+		} {
+			for _, kind := range []error{ErrNotExist, ErrAuth, ErrTransient, ErrExist, ErrCorrupt} {
+				if errors.Is(err, kind) != (kind == tt.expected) {
+					t.Errorf("%T with status %d matching %v don't match, wants %v", err, tt.status, kind, kind == tt.expected)
+				}
+			}
+		}
+	}
+}
+
+func TestTransientErrors(t *testing.T) {
+	defer setS3Credentials()()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	u, _ := url.Parse("s3://bucket/prefix?endpoint=" + srv.URL)
+	s, err := NewS3Storage(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Open(context.Background(), "wal_005/a"); !errors.Is(err, ErrTransient) {
+		t.Errorf("unreachable storage should fail with ErrTransient, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Open(ctx, "wal_005/a"); errors.Is(err, ErrTransient) || !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled request should fail with context.Canceled, got %v", err)
+	}
+	err = multiError([]error{errUnavailable, &s3Error{StatusCode: http.StatusForbidden}}, 3)
+	if !errors.Is(err, ErrAuth) || !errors.Is(err, errUnavailable) {
+		t.Errorf("multi error should match the errors of destinations, got %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+package storage
+
+import (
+	"net/http/httptest"
+)
+
+// Fakes and helpers exported for the conformance tests.
+var (
+	NewFakeGCS         = newFakeGCS
+	NewFakeAzure       = newFakeAzure
+	NewSFTPTestStorage = newSFTPTestStorage
+	SetS3Credentials   = setS3Credentials
+)
+
+const AzuriteKey = azuriteKey
+
+func NewFakeS3() *httptest.Server {
+	_, srv := newFakeS3()
+	return srv
+}
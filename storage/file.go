@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"io"
 	"net/url"
 	"os"
@@ -22,7 +23,7 @@ func NewFileStorage(u *url.URL) *FileStorage {
 }
 
 // Open opens the given filename.
-func (s FileStorage) Open(name string) (io.ReadCloser, error) {
+func (s FileStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
 	filename, err := preparePath(s.basedir, name)
 	if err != nil {
 		return nil, err
@@ -30,17 +31,28 @@ func (s FileStorage) Open(name string) (io.ReadCloser, error) {
 	return os.Open(filename)
 }
 
-// Create creates a new file based on the given filename.
-func (s FileStorage) Create(name string) (io.WriteCloser, error) {
+// Create creates a new file based on the given filename, written to a
+// temporary file renamed once closed, which is removed instead if the
+// context is done or a write failed before it is closed.
+func (s FileStorage) Create(ctx context.Context, name string) (io.WriteCloser, error) {
 	filename, err := preparePath(s.basedir, name)
 	if err != nil {
 		return nil, err
 	}
-	return os.Create(filename)
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{
+		f:        f,
+		ctx:      ctx,
+		filename: filename,
+	}, nil
 }
 
-// List lists all files presents in the file storage after the given prefix.
-func (s FileStorage) List(name string) (files []io.ReadCloser, err error) {
+// List lists all files presents in the file storage below the given prefix,
+// or the file of the given name when it doesn't end with a slash.
+func (s FileStorage) List(ctx context.Context, name string) (files []io.ReadCloser, err error) {
 	basedir, err := preparePath(s.basedir, name)
 	if err != nil {
 		return nil, err
@@ -49,9 +61,12 @@ func (s FileStorage) List(name string) (files []io.ReadCloser, err error) {
 		if err != nil {
 			return err
 		}
-		if info.IsDir() {
+		if info.IsDir() || info.Name()[0] == '.' {
 			return nil
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		file, err := os.Open(path)
 		if err != nil {
 			return err
@@ -65,6 +80,93 @@ func (s FileStorage) List(name string) (files []io.ReadCloser, err error) {
 	return files, nil
 }
 
+// Names lists the names of all files presents in the file storage below the
+// given prefix, or the file of the given name when it doesn't end with a
+// slash.
+func (s FileStorage) Names(ctx context.Context, name string) (names []string, err error) {
+	basedir, err := preparePath(s.basedir, name)
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.Walk(basedir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name()[0] == '.' {
+			return nil
+		}
+		rel, err := filepath.Rel(s.basedir, path)
+		if err != nil {
+			return err
+		}
+		if rel = filepath.ToSlash(rel); matchName(name, rel) {
+			names = append(names, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return names, nil
+}
+
+// Size returns the size of the given filename.
+func (s FileStorage) Size(ctx context.Context, name string) (int64, error) {
+	info, err := os.Stat(path.Join(s.basedir, name))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Delete deletes the given filename.
+func (s FileStorage) Delete(ctx context.Context, name string) error {
+	if err := os.Remove(path.Join(s.basedir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// fileWriter renames the temporary file to its final name once closed.
+type fileWriter struct {
+	f        *os.File
+	ctx      context.Context
+	filename string
+	err      error
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.err = w.ctx.Err(); w.err != nil {
+		return 0, w.err
+	}
+	var n int
+	n, w.err = w.f.Write(p)
+	return n, w.err
+}
+
+func (w *fileWriter) Close() error {
+	err := w.f.Close()
+	if err == nil {
+		err = w.err
+	}
+	if err == nil {
+		err = w.ctx.Err()
+	}
+	if err == nil {
+		err = os.Rename(w.f.Name(), w.filename)
+	}
+	if err != nil {
+		os.Remove(w.f.Name())
+	}
+	return err
+}
+
 func preparePath(basedir, name string) (string, error) {
 	filename := path.Join(basedir, name)
 	if err := os.MkdirAll(path.Dir(filename), 0700); err != nil {
@@ -0,0 +1,336 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// gcsChunkSize is the size of each chunk of a resumable upload, it must be
+// a multiple of 256KB.
+const gcsChunkSize = 16 * 1024 * 1024
+
+// GCSStorage represents a Google Cloud Storage based file storage.
+type GCSStorage struct {
+	bucket   string
+	prefix   string
+	endpoint string
+	client   *http.Client
+}
+
+// NewGCSStorage creates a new GCSStorage based on the given
+// gs://bucket/prefix URL.
+//
+// Requests are authenticated using the service account whose key is
+// referenced by GOOGLE_APPLICATION_CREDENTIALS, or the metadata server
+// otherwise. When STORAGE_EMULATOR_HOST is set, unauthenticated requests
+// are made to the given emulator.
+func NewGCSStorage(u *url.URL) (*GCSStorage, error) {
+	s := &GCSStorage{
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		endpoint: "https://storage.googleapis.com",
+	}
+	if emulator := os.Getenv("STORAGE_EMULATOR_HOST"); emulator != "" {
+		if !strings.Contains(emulator, "://") {
+			emulator = "http://" + emulator
+		}
+		s.endpoint = strings.TrimRight(emulator, "/")
+		s.client = http.DefaultClient
+		return s, nil
+	}
+	source, err := newGoogleTokenSource(os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+	if err != nil {
+		return nil, err
+	}
+	s.client = &http.Client{
+		Transport: &googleTransport{source: source},
+	}
+	return s, nil
+}
+
+func (s GCSStorage) object(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+// Create creates a new file based on the given filename, using a
+// resumable upload which is cancelled if the context is done before the
+// upload completes.
+func (s GCSStorage) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	q := url.Values{
+		"uploadType": []string{"resumable"},
+		"name":       []string{s.object(name)},
+	}
+	uri := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", s.endpoint, url.PathEscape(s.bucket), q.Encode())
+	req, err := http.NewRequestWithContext(ctx, "POST", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newGCSError(resp)
+	}
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return nil, fmt.Errorf("gcs: no upload session for %s", name)
+	}
+	return &gcsWriter{
+		ctx:     ctx,
+		client:  s.client,
+		session: session,
+		buf:     new(bytes.Buffer),
+	}, nil
+}
+
+// Open opens the given filename.
+func (s GCSStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	uri := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", s.endpoint, url.PathEscape(s.bucket), url.PathEscape(s.object(name)))
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newGCSError(resp)
+	}
+	return resp.Body, nil
+}
+
+// List lists all files presents in the file storage below the given prefix,
+// or the file of the given name when it doesn't end with a slash.
+func (s GCSStorage) List(ctx context.Context, name string) (files []io.ReadCloser, err error) {
+	names, err := s.Names(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		file, err := s.Open(ctx, name)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Names lists the names of all files presents in the file storage below the
+// given prefix, or the file of the given name when it doesn't end with a
+// slash.
+func (s GCSStorage) Names(ctx context.Context, name string) (names []string, err error) {
+	prefix := s.object(name)
+	if prefix != "" && (name == "" || strings.HasSuffix(name, "/")) {
+		prefix += "/"
+	}
+	q := url.Values{
+		"prefix": []string{prefix},
+		"fields": []string{"items(name),nextPageToken"},
+	}
+	for {
+		uri := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", s.endpoint, url.PathEscape(s.bucket), q.Encode())
+		req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, newGCSError(resp)
+		}
+		var l struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&l)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range l.Items {
+			if n := name + strings.TrimPrefix(item.Name, prefix); matchName(name, n) {
+				names = append(names, n)
+			}
+		}
+		if l.NextPageToken == "" {
+			return names, nil
+		}
+		q.Set("pageToken", l.NextPageToken)
+	}
+}
+
+// Size returns the size of the given filename, from the metadata of the
+// object.
+func (s GCSStorage) Size(ctx context.Context, name string) (int64, error) {
+	uri := fmt.Sprintf("%s/storage/v1/b/%s/o/%s", s.endpoint, url.PathEscape(s.bucket), url.PathEscape(s.object(name)))
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, newGCSError(resp)
+	}
+	var o struct {
+		Size int64 `json:"size,string"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&o); err != nil {
+		return 0, err
+	}
+	return o.Size, nil
+}
+
+// Delete deletes the given filename.
+func (s GCSStorage) Delete(ctx context.Context, name string) error {
+	uri := fmt.Sprintf("%s/storage/v1/b/%s/o/%s", s.endpoint, url.PathEscape(s.bucket), url.PathEscape(s.object(name)))
+	req, err := http.NewRequestWithContext(ctx, "DELETE", uri, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return newGCSError(resp)
+	}
+	return nil
+}
+
+// gcsWriter uploads data in chunks to a resumable upload session.
+type gcsWriter struct {
+	ctx     context.Context
+	client  *http.Client
+	session string
+	buf     *bytes.Buffer
+	offset  int64
+	err     error
+}
+
+func (w *gcsWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, _ := w.buf.Write(p)
+	for w.buf.Len() >= gcsChunkSize {
+		if w.err = w.upload(w.buf.Next(gcsChunkSize), false); w.err != nil {
+			return n, w.err
+		}
+	}
+	return n, nil
+}
+
+func (w *gcsWriter) Close() error {
+	if w.err == nil {
+		w.err = w.upload(w.buf.Bytes(), true)
+	}
+	if w.err != nil {
+		w.cancel()
+	}
+	return w.err
+}
+
+// cancel deletes the upload session, even once the context is done.
+func (w *gcsWriter) cancel() {
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "DELETE", w.session, nil)
+	if err != nil {
+		return
+	}
+	if resp, err := w.client.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// upload sends a chunk of the upload, the size of the object is only given
+// with the last one.
+func (w *gcsWriter) upload(chunk []byte, last bool) error {
+	size := "*"
+	if last {
+		size = fmt.Sprint(w.offset + int64(len(chunk)))
+	}
+	req, err := http.NewRequestWithContext(w.ctx, "PUT", w.session, bytes.NewReader(chunk))
+	if err != nil {
+		return err
+	}
+	if len(chunk) > 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", w.offset, w.offset+int64(len(chunk))-1, size))
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%s", size))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case last && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated):
+	case !last && resp.StatusCode == http.StatusPermanentRedirect:
+		if r := resp.Header.Get("Range"); r != fmt.Sprintf("bytes=0-%d", w.offset+int64(len(chunk))-1) {
+			return fmt.Errorf("gcs: incomplete upload of chunk, persisted %s", r)
+		}
+	default:
+		return newGCSError(resp)
+	}
+	w.offset += int64(len(chunk))
+	return nil
+}
+
+type gcsError struct {
+	StatusCode int
+	Message    string
+}
+
+func newGCSError(resp *http.Response) error {
+	defer resp.Body.Close()
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	json.Unmarshal(b, &e)
+	return &gcsError{
+		StatusCode: resp.StatusCode,
+		Message:    e.Error.Message,
+	}
+}
+
+// Is reports whether the status code of the error is classified by the
+// target, such as ErrNotExist when the object doesn't exist.
+func (e *gcsError) Is(target error) bool {
+	return statusIs(target, e.StatusCode)
+}
+
+func (e *gcsError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("gcs: unexpected error: (%d) %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("gcs: unexpected error: (%d)", e.StatusCode)
+}
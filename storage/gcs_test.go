@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGCS is a minimal in-memory implementation of the Google Cloud Storage
+// JSON API.
+type fakeGCS struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	sessions map[string]*bytes.Buffer
+	names    map[string]string
+}
+
+func newFakeGCS() *httptest.Server {
+	f := &fakeGCS{
+		objects:  make(map[string][]byte),
+		sessions: make(map[string]*bytes.Buffer),
+		names:    make(map[string]string),
+	}
+	return httptest.NewServer(f)
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/upload/storage/v1/b/bucket/o":
+		id := strconv.Itoa(len(f.sessions))
+		f.sessions[id] = new(bytes.Buffer)
+		f.names[id] = r.URL.Query().Get("name")
+		w.Header().Set("Location", "http://"+r.Host+"/upload/session/"+id)
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/upload/session/"):
+		id := strings.TrimPrefix(r.URL.Path, "/upload/session/")
+		buf := f.sessions[id]
+		var start, end int
+		var size string
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%s", &start, &end, &size); err != nil {
+			fmt.Sscanf(r.Header.Get("Content-Range"), "bytes */%s", &size)
+		} else if start != buf.Len() {
+			http.Error(w, "invalid range", http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		buf.Write(b)
+		if size == "*" {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", buf.Len()-1))
+			w.WriteHeader(http.StatusPermanentRedirect)
+			return
+		}
+		f.objects[f.names[id]] = buf.Bytes()
+	case r.Method == "GET" && r.URL.Path == "/storage/v1/b/bucket/o":
+		prefix := r.URL.Query().Get("prefix")
+		var names []string
+		for name := range f.objects {
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		// Return a single item per page to exercise pagination.
+		var l struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken,omitempty"`
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+		if page < len(names) {
+			l.Items = append(l.Items, struct {
+				Name string `json:"name"`
+			}{names[page]})
+		}
+		if page+1 < len(names) {
+			l.NextPageToken = strconv.Itoa(page + 1)
+		}
+		json.NewEncoder(w).Encode(l)
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/storage/v1/b/bucket/o/"):
+		name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/")
+		b, ok := f.objects[name]
+		if !ok {
+			http.Error(w, `{"error":{"message":"No such object"}}`, http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("alt") != "media" {
+			fmt.Fprintf(w, `{"name":%q,"size":"%d"}`, name, len(b))
+			return
+		}
+		w.Write(b)
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/storage/v1/b/bucket/o/"):
+		name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/")
+		if _, ok := f.objects[name]; !ok {
+			http.Error(w, `{"error":{"message":"No such object"}}`, http.StatusNotFound)
+			return
+		}
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported request", http.StatusBadRequest)
+	}
+}
+
+func TestGCSStorage(t *testing.T) {
+	srv := newFakeGCS()
+	defer srv.Close()
+	os.Setenv("STORAGE_EMULATOR_HOST", srv.URL)
+	defer os.Unsetenv("STORAGE_EMULATOR_HOST")
+	s, err := NewStorage("gs://bucket/prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("law"), gcsChunkSize/2)
+	for _, name := range []string{"000000010000000000000001", "000000010000000000000002"} {
+		w, err := s.Archive(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err := s.Segments(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || segments[1] != "000000010000000000000002" {
+		t.Fatalf("unexpected segments %v", segments)
+	}
+	r, err := s.Unarchive(context.Background(), "000000010000000000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Fatal("content don't match")
+	}
+	if _, err := s.Unarchive(context.Background(), "000000010000000000000003"); err == nil {
+		t.Fatal("expected error for missing segment")
+	}
+	if err := s.b.Delete(context.Background(), "wal_005/000000010000000000000001.lzo"); err != nil {
+		t.Fatal(err)
+	}
+	segments, err = s.Segments(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Fatalf("unexpected segments after delete %v", segments)
+	}
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	googleScope         = "https://www.googleapis.com/auth/devstorage.read_write"
+	googleMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// googleToken represents an OAuth2 access token.
+type googleToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+
+	expiry time.Time
+}
+
+// googleTokenSource retrieves and caches access tokens, either for a
+// service account or from the metadata server.
+type googleTokenSource struct {
+	email    string
+	key      *rsa.PrivateKey
+	tokenURI string
+
+	mu    sync.Mutex
+	token *googleToken
+}
+
+func newGoogleTokenSource(credentials string) (*googleTokenSource, error) {
+	if credentials == "" {
+		return &googleTokenSource{}, nil
+	}
+	b, err := ioutil.ReadFile(credentials)
+	if err != nil {
+		return nil, err
+	}
+	var account struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(b, &account); err != nil {
+		return nil, err
+	}
+	if account.Type != "service_account" {
+		return nil, fmt.Errorf("gcs: unsupported credentials type: %s", account.Type)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("gcs: invalid service account private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("gcs: service account private key is not a RSA key")
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &googleTokenSource{
+		email:    account.ClientEmail,
+		key:      rsaKey,
+		tokenURI: account.TokenURI,
+	}, nil
+}
+
+// Token returns a valid access token, refreshing it when it is about to
+// expire.
+func (s *googleTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != nil && time.Now().Add(time.Minute).Before(s.token.expiry) {
+		return s.token.AccessToken, nil
+	}
+	var token *googleToken
+	var err error
+	if s.key != nil {
+		token, err = s.serviceAccountToken(ctx)
+	} else {
+		token, err = s.metadataToken(ctx)
+	}
+	if err != nil {
+		return "", err
+	}
+	token.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	s.token = token
+	return token.AccessToken, nil
+}
+
+// serviceAccountToken exchanges a signed JWT assertion for an access token.
+func (s *googleTokenSource) serviceAccountToken(ctx context.Context) (*googleToken, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   s.email,
+		"scope": googleScope,
+		"aud":   s.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	payload := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(payload))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	resp, err := postForm(ctx, s.tokenURI, url.Values{
+		"grant_type": []string{"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  []string{payload + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decodeGoogleToken(resp)
+}
+
+// metadataToken retrieves an access token for the default service account
+// of the instance.
+func (s *googleTokenSource) metadataToken(ctx context.Context) (*googleToken, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", googleMetadataToken, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	client := &http.Client{
+		Timeout: credentialsTimeout,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return decodeGoogleToken(resp)
+}
+
+func decodeGoogleToken(resp *http.Response) (*googleToken, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, &Error{Kind: ErrAuth, Err: fmt.Errorf("gcs: unable to retrieve access token: (%d) %s", resp.StatusCode, strings.TrimSpace(string(b)))}
+	}
+	token := new(googleToken)
+	if err := json.NewDecoder(resp.Body).Decode(token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// googleTransport authenticates requests using an access token.
+type googleTransport struct {
+	source *googleTokenSource
+}
+
+// RoundTrip implements the RoundTripper interface.
+func (t *googleTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	token, err := t.source.Token(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	c := new(http.Request)
+	*c = *r
+	c.Header = make(http.Header, len(r.Header)+1)
+	for k, v := range r.Header {
+		c.Header[k] = append([]string(nil), v...)
+	}
+	c.Header.Set("Authorization", "Bearer "+token)
+	return roundTrip(c)
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// layoutName is the name of the layout descriptor, at the root of a
+// storage.
+const layoutName = "layout.json"
+
+// Layout describes the layout of a storage, with the version files are
+// written with, and prior versions which still hold files.
+type Layout struct {
+	Version  string   `json:"version"`
+	Previous []string `json:"previous,omitempty"`
+}
+
+type layoutCache struct {
+	mu     sync.Mutex
+	layout *Layout
+	found  bool
+}
+
+// Layout returns the layout descriptor of the storage, or the current
+// layout if the storage has none.
+func (s Storage) Layout(ctx context.Context) (*Layout, error) {
+	c := s.layout
+	if c == nil {
+		c = new(layoutCache)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.layout == nil {
+		l, found, err := s.readLayout(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.layout, c.found = l, found
+	}
+	return c.layout, nil
+}
+
+func (s Storage) readLayout(ctx context.Context) (*Layout, bool, error) {
+	r, err := s.b.Open(ctx, layoutName)
+	if errors.Is(err, ErrNotExist) {
+		return &Layout{Version: CurrentVersion}, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer r.Close()
+	l := new(Layout)
+	if err := json.NewDecoder(r).Decode(l); err != nil {
+		return nil, false, fmt.Errorf("invalid storage layout: %v", err)
+	}
+	if l.Version > CurrentVersion {
+		return nil, false, fmt.Errorf("unsupported storage layout %s, newer than %s", l.Version, CurrentVersion)
+	}
+	return l, true, nil
+}
+
+// versions returns the layout versions to read files from, the current
+// one first.
+func (s Storage) versions(ctx context.Context) ([]string, error) {
+	l, err := s.Layout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	versions := []string{CurrentVersion}
+	for _, v := range append([]string{l.Version}, l.Previous...) {
+		if !contains(versions, v) {
+			versions = append(versions, v)
+		}
+	}
+	return versions, nil
+}
+
+// InitLayout writes the layout descriptor of a storage which has none.
+func (s Storage) InitLayout(ctx context.Context) error {
+	if _, err := s.Layout(ctx); err != nil {
+		return err
+	}
+	if s.layout != nil && s.layout.found {
+		return nil
+	}
+	return s.writeLayout(ctx, &Layout{Version: CurrentVersion})
+}
+
+func (s Storage) writeLayout(ctx context.Context, l *Layout) error {
+	w, err := s.create(ctx, layoutName)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(l); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if s.layout != nil {
+		s.layout.mu.Lock()
+		s.layout.layout, s.layout.found = l, true
+		s.layout.mu.Unlock()
+	}
+	return nil
+}
+
+// Versions returns the layout versions holding files, as found by listing
+// the whole storage.
+func (s Storage) Versions(ctx context.Context) ([]string, error) {
+	names, err := s.b.Names(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, name := range names {
+		dir := strings.SplitN(name, "/", 2)[0]
+		for _, prefix := range []string{"wal_", "basebackup_"} {
+			if v := strings.TrimPrefix(dir, prefix); v != dir && !contains(versions, v) {
+				versions = append(versions, v)
+			}
+		}
+	}
+	sort.Strings(versions)
+	return versions, nil
+}
+
+// MigrationReport represents the layout versions found by a migration, and
+// the number of files rewritten into the current layout.
+type MigrationReport struct {
+	Versions  []string `json:"versions"`
+	Rewritten int      `json:"rewritten"`
+}
+
+// MigrateLayout indexes files of prior layouts in the layout descriptor,
+// so they are read along files of the current layout. Files are instead
+// copied into the current layout when rewrite is set, and the originals
+// deleted once copied when remove is also set.
+func (s Storage) MigrateLayout(ctx context.Context, rewrite, remove bool) (*MigrationReport, error) {
+	if _, err := s.Layout(ctx); err != nil {
+		return nil, err
+	}
+	versions, err := s.Versions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &MigrationReport{
+		Versions: versions,
+	}
+	var previous []string
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		if v > CurrentVersion {
+			return report, fmt.Errorf("unsupported storage layout %s, newer than %s", v, CurrentVersion)
+		}
+		if v == CurrentVersion {
+			continue
+		}
+		if !rewrite {
+			previous = append(previous, v)
+			continue
+		}
+		n, err := s.rewriteLayout(ctx, v, remove)
+		report.Rewritten += n
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, s.writeLayout(ctx, &Layout{
+		Version:  CurrentVersion,
+		Previous: previous,
+	})
+}
+
+// rewriteLayout copies the files of the given layout version into the
+// current layout, metadata of backups last.
+func (s Storage) rewriteLayout(ctx context.Context, version string, remove bool) (int, error) {
+	var names []string
+	for _, prefix := range []string{"wal_", "basebackup_"} {
+		files, err := s.b.Names(ctx, prefix+version+"/")
+		if err != nil {
+			return 0, err
+		}
+		names = append(names, files...)
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return isMetadata(names[j]) && !isMetadata(names[i])
+	})
+	var n int
+	for _, name := range names {
+		dir := strings.SplitN(name, "/", 2)
+		to := strings.TrimSuffix(dir[0], version) + CurrentVersion + "/" + dir[1]
+		if _, err := copyFile(ctx, s.b, name, s.b, to); err != nil {
+			return n, err
+		}
+		n++
+		if remove {
+			if err := s.b.Delete(ctx, name); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func isMetadata(name string) bool {
+	return strings.HasSuffix(name, "/metadata.json")
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
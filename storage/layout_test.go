@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func newLayoutStorage(t *testing.T, uri string, files ...string) *Storage {
+	s, err := NewStorage(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range files {
+		w, _ := s.b.Create(context.Background(), name)
+		w.Write([]byte(name))
+		w.Close()
+	}
+	return s
+}
+
+var layoutFiles = []string{
+	"wal_004/000000010000000000000001.lzo",
+	"wal_004/000000010000000000000002.lzo",
+	"basebackup_004/base_000000010000000000000001_00000028/part_0.tar.lzo",
+	"basebackup_004/base_000000010000000000000001_00000028/metadata.json",
+	"wal_005/000000010000000000000003.lzo",
+}
+
+func TestLayoutReindex(t *testing.T) {
+	s := newLayoutStorage(t, "mem://layout-reindex", layoutFiles...)
+	segments, err := s.Segments(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Fatalf("prior layouts should be ignored without descriptor, got %v", segments)
+	}
+	report, err := s.MigrateLayout(context.Background(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Versions, []string{"004", "005"}) || report.Rewritten != 0 {
+		t.Errorf("report don't match, got %+v", report)
+	}
+
+	s = newLayoutStorage(t, "mem://layout-reindex")
+	l, err := s.Layout(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (&Layout{Version: "005", Previous: []string{"004"}}); !reflect.DeepEqual(l, expected) {
+		t.Errorf("layout don't match, wants %+v got %+v", expected, l)
+	}
+	segments, err = s.Segments(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"000000010000000000000001", "000000010000000000000002", "000000010000000000000003"}
+	if !reflect.DeepEqual(segments, expected) {
+		t.Errorf("segments don't match, wants %v got %v", expected, segments)
+	}
+	r, err := s.Unarchive(context.Background(), "000000010000000000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != "wal_004/000000010000000000000001.lzo" {
+		t.Errorf("segment don't match, got %q", b)
+	}
+	backups, err := s.Backups(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("expected one backup, got %v", backups)
+	}
+	parts, err := s.Restore(context.Background(), backups[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 1 {
+		t.Errorf("expected one part, got %d", len(parts))
+	}
+	if r, err := s.RestoreMetadata(context.Background(), backups[0]); err != nil || r == nil {
+		t.Errorf("expected metadata, got %v", err)
+	}
+}
+
+func TestLayoutRewrite(t *testing.T) {
+	s := newLayoutStorage(t, "mem://layout-rewrite", layoutFiles...)
+	report, err := s.MigrateLayout(context.Background(), true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rewritten != 4 {
+		t.Errorf("expected 4 files rewritten, got %d", report.Rewritten)
+	}
+	names, err := s.b.Names(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"basebackup_005/base_000000010000000000000001_00000028/metadata.json",
+		"basebackup_005/base_000000010000000000000001_00000028/part_0.tar.lzo",
+		"layout.json",
+		"wal_005/000000010000000000000001.lzo",
+		"wal_005/000000010000000000000002.lzo",
+		"wal_005/000000010000000000000003.lzo",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("names don't match, wants %v got %v", expected, names)
+	}
+	l, err := newLayoutStorage(t, "mem://layout-rewrite").Layout(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Previous) != 0 {
+		t.Errorf("expected no previous layouts, got %v", l.Previous)
+	}
+}
+
+func TestLayoutNewer(t *testing.T) {
+	s := newLayoutStorage(t, "mem://layout-newer")
+	if err := s.writeLayout(context.Background(), &Layout{Version: "006"}); err != nil {
+		t.Fatal(err)
+	}
+	s = newLayoutStorage(t, "mem://layout-newer")
+	if _, err := s.Segments(context.Background()); err == nil {
+		t.Fatal("expected unsupported layout")
+	}
+	if err := s.InitLayout(context.Background()); err == nil {
+		t.Fatal("expected unsupported layout")
+	}
+}
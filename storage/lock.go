@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// lockName is the name of the lock object, at the root of a storage.
+const lockName = "lock.json"
+
+var (
+	// ErrLocked is returned, wrapped, when acquiring a lock held by another
+	// owner.
+	ErrLocked = errors.New("storage: locked")
+	// ErrLockLost is returned when refreshing a lock which expired and was
+	// acquired or broken since.
+	ErrLockLost = errors.New("storage: lock lost")
+)
+
+// Lock represents the lease of a storage, held by an owner until it
+// expires unless its heartbeat refreshes it.
+type Lock struct {
+	Owner     string    `json:"owner"`
+	Hostname  string    `json:"hostname"`
+	PID       int       `json:"pid"`
+	Operation string    `json:"operation"`
+	Acquired  time.Time `json:"acquired"`
+	Heartbeat time.Time `json:"heartbeat"`
+	Expires   time.Time `json:"expires"`
+}
+
+// Expired reports whether the lock expired at the given time.
+func (l *Lock) Expired(t time.Time) bool {
+	return !t.Before(l.Expires)
+}
+
+// AcquireLock acquires the lock of the storage for the given operation,
+// until it expires after the given duration. As backends can't create
+// files conditionally, the lock is read back once written to detect most
+// races between owners.
+func (s Storage) AcquireLock(ctx context.Context, operation string, ttl time.Duration) (*Lock, error) {
+	current, err := s.readLock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if current != nil && !current.Expired(now) {
+		return nil, lockedError(current)
+	}
+	hostname, _ := os.Hostname()
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	l := &Lock{
+		Owner:     hex.EncodeToString(id),
+		Hostname:  hostname,
+		PID:       os.Getpid(),
+		Operation: operation,
+		Acquired:  now,
+		Heartbeat: now,
+		Expires:   now.Add(ttl),
+	}
+	if err := s.writeLock(ctx, l); err != nil {
+		return nil, err
+	}
+	current, err = s.readLock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil || current.Owner != l.Owner {
+		if current == nil {
+			return nil, fmt.Errorf("%w: lock vanished once acquired", ErrLocked)
+		}
+		return nil, lockedError(current)
+	}
+	s.log.Debug("acquired lock", "operation", operation, "expires", l.Expires)
+	return l, nil
+}
+
+// RefreshLock extends the given lock until it expires after the given
+// duration, unless it was lost. As when acquired, the lock is read back
+// once written, failing with ErrLocked if another owner acquired it in the
+// meantime.
+func (s Storage) RefreshLock(ctx context.Context, l *Lock, ttl time.Duration) error {
+	current, err := s.readLock(ctx)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Owner != l.Owner {
+		return ErrLockLost
+	}
+	now := time.Now()
+	refreshed := *l
+	refreshed.Heartbeat, refreshed.Expires = now, now.Add(ttl)
+	if err := s.writeLock(ctx, &refreshed); err != nil {
+		return err
+	}
+	current, err = s.readLock(ctx)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Owner != l.Owner {
+		if current == nil {
+			return fmt.Errorf("%w: lock vanished once refreshed", ErrLocked)
+		}
+		return lockedError(current)
+	}
+	*l = refreshed
+	return nil
+}
+
+// ReleaseLock releases the given lock, unless another owner acquired it
+// since it expired.
+func (s Storage) ReleaseLock(ctx context.Context, l *Lock) error {
+	current, err := s.readLock(ctx)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Owner != l.Owner {
+		return nil
+	}
+	if err := s.b.Delete(ctx, lockName); err != nil {
+		return err
+	}
+	s.log.Debug("released lock", "operation", l.Operation)
+	return nil
+}
+
+// LockStatus returns the lock of the storage, or nil if it has none.
+func (s Storage) LockStatus(ctx context.Context) (*Lock, error) {
+	return s.readLock(ctx)
+}
+
+// BreakLock deletes the lock of the storage once expired, or regardless
+// of its owner when forced, returning the lock broken or nil if it had
+// none. Breaking a lock which hasn't expired without force fails with
+// ErrLocked.
+func (s Storage) BreakLock(ctx context.Context, force bool) (*Lock, error) {
+	l, err := s.readLock(ctx)
+	if err != nil || l == nil {
+		return nil, err
+	}
+	if !force && !l.Expired(time.Now()) {
+		return nil, lockedError(l)
+	}
+	if err := s.b.Delete(ctx, lockName); err != nil {
+		return nil, err
+	}
+	s.log.Warn("broke lock", "owner", l.Owner, "hostname", l.Hostname, "pid", l.PID, "operation", l.Operation)
+	return l, nil
+}
+
+// readLock returns the lock of the storage, or nil if it has none.
+func (s Storage) readLock(ctx context.Context) (*Lock, error) {
+	r, err := s.b.Open(ctx, lockName)
+	if errors.Is(err, ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	l := new(Lock)
+	if err := json.NewDecoder(r).Decode(l); err != nil {
+		return nil, fmt.Errorf("invalid storage lock: %v", err)
+	}
+	return l, nil
+}
+
+func (s Storage) writeLock(ctx context.Context, l *Lock) error {
+	w, err := s.create(ctx, lockName)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(l); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+func lockedError(l *Lock) error {
+	return fmt.Errorf("%w by %s on %s (pid %d) for %s until %s", ErrLocked,
+		l.Owner, l.Hostname, l.PID, l.Operation, l.Expires.Format(time.RFC3339))
+}
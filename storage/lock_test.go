@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	s := newLayoutStorage(t, "mem://lock")
+	ctx := context.Background()
+	l, err := s.AcquireLock(ctx, "backup", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Operation != "backup" || l.PID == 0 || l.Owner == "" {
+		t.Errorf("lock don't match, got %+v", l)
+	}
+	if _, err := s.AcquireLock(ctx, "backup", time.Hour); !errors.Is(err, ErrLocked) {
+		t.Fatalf("storage should be locked, got %v", err)
+	}
+	if err := s.ReleaseLock(ctx, l); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := s.AcquireLock(ctx, "backup", -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err = s.AcquireLock(ctx, "retention", time.Hour)
+	if err != nil {
+		t.Fatalf("expired lock should be acquired, got %v", err)
+	}
+	if err := s.ReleaseLock(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AcquireLock(ctx, "backup", time.Hour); !errors.Is(err, ErrLocked) {
+		t.Errorf("releasing an expired lock should keep the new one, got %v", err)
+	}
+	if err := s.RefreshLock(ctx, expired, time.Hour); !errors.Is(err, ErrLockLost) {
+		t.Errorf("expired lock should be lost, got %v", err)
+	}
+	if _, err := s.BreakLock(ctx, false); !errors.Is(err, ErrLocked) {
+		t.Errorf("breaking a held lock should fail without force, got %v", err)
+	}
+	broken, err := s.BreakLock(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broken == nil || broken.Owner != l.Owner {
+		t.Errorf("broken lock don't match, wants %+v got %+v", l, broken)
+	}
+	if current, err := s.LockStatus(ctx); err != nil || current != nil {
+		t.Errorf("lock should be broken, got %+v %v", current, err)
+	}
+}
+
+// racingBackend writes the lock of a rival owner right after each file
+// created, as another process acquiring the lock concurrently would.
+type racingBackend struct {
+	Backend
+	rival *Lock
+}
+
+func (b racingBackend) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	w, err := b.Backend.Create(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return racingWriter{w, b}, nil
+}
+
+type racingWriter struct {
+	io.WriteCloser
+	b racingBackend
+}
+
+func (w racingWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	rival, err := w.b.Backend.Create(context.Background(), lockName)
+	if err != nil {
+		return err
+	}
+	json.NewEncoder(rival).Encode(w.b.rival)
+	return rival.Close()
+}
+
+func TestRefreshLockRace(t *testing.T) {
+	s := newLayoutStorage(t, "mem://lock-race")
+	ctx := context.Background()
+	l, err := s.AcquireLock(ctx, "backup", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rival := &Lock{Owner: "rival", Operation: "retention", Expires: time.Now().Add(time.Hour)}
+	s.b = racingBackend{s.b, rival}
+	if err := s.RefreshLock(ctx, l, time.Hour); !errors.Is(err, ErrLocked) {
+		t.Errorf("refreshing a lock acquired concurrently should fail with ErrLocked, got %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	s := newLayoutStorage(t, "mem://delete", layoutFiles...)
+	ctx := context.Background()
+	if _, err := s.MigrateLayout(ctx, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteBackup(ctx, "base_000000010000000000000001_00000028"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteSegment(ctx, "000000010000000000000001"); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := s.Backups(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 0 {
+		t.Errorf("backups should be deleted, got %v", backups)
+	}
+	segments, err := s.Segments(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || segments[0] != "000000010000000000000002" {
+		t.Errorf("segments don't match, got %v", segments)
+	}
+}
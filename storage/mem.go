@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	memMu       sync.Mutex
+	memStorages = make(map[string]*MemStorage)
+)
+
+// MemStorage represents an in-memory file storage, shared by every
+// mem:// URL of the same name within a process.
+type MemStorage struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+}
+
+// NewMemStorage returns the MemStorage based on the given mem://name URL.
+func NewMemStorage(u *url.URL) *MemStorage {
+	memMu.Lock()
+	defer memMu.Unlock()
+	name := u.Host + u.Path
+	s, ok := memStorages[name]
+	if !ok {
+		s = &MemStorage{
+			files: make(map[string][]byte),
+		}
+		memStorages[name] = s
+	}
+	return s
+}
+
+// Create creates a new file based on the given filename, which is visible
+// once closed unless the context is done.
+func (s *MemStorage) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	return &memWriter{
+		ctx:  ctx,
+		s:    s,
+		name: name,
+	}, nil
+}
+
+// Open opens the given filename.
+func (s *MemStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// List lists all files presents in the file storage below the given prefix,
+// or the file of the given name when it doesn't end with a slash.
+func (s *MemStorage) List(ctx context.Context, name string) (files []io.ReadCloser, err error) {
+	names, err := s.Names(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		file, err := s.Open(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Names lists the names of all files presents in the file storage below the
+// given prefix, or the file of the given name when it doesn't end with a
+// slash.
+func (s *MemStorage) Names(ctx context.Context, name string) (names []string, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for n := range s.files {
+		if strings.HasPrefix(n, name) && matchName(name, n) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Size returns the size of the given filename.
+func (s *MemStorage) Size(ctx context.Context, name string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.files[name]
+	if !ok {
+		return 0, &os.PathError{Op: "stat", Path: name, Err: ErrNotExist}
+	}
+	return int64(len(b)), nil
+}
+
+// Delete deletes the given filename.
+func (s *MemStorage) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, name)
+	return nil
+}
+
+type memWriter struct {
+	bytes.Buffer
+	ctx  context.Context
+	s    *MemStorage
+	name string
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.Buffer.Write(p)
+}
+
+func (w *memWriter) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	w.s.files[w.name] = w.Bytes()
+	return nil
+}
@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// MultiStorage represents a storage writing to several destinations, and
+// reading from the first one available.
+type MultiStorage struct {
+	backends []Backend
+	required int
+}
+
+// NewMultiStorage creates a new MultiStorage based on the given
+// multi:url,url URL, where writes must succeed on every destination, or on
+// a majority of them with multi+quorum:url,url,url.
+func NewMultiStorage(uri string) (*MultiStorage, error) {
+	parts := strings.SplitN(uri, ":", 2)
+	var urls []string
+	for _, u := range strings.Split(parts[1], ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) < 2 {
+		return nil, errors.New("multi: at least two destinations required")
+	}
+	s := &MultiStorage{
+		required: len(urls),
+	}
+	if parts[0] == "multi+quorum" {
+		s.required = len(urls)/2 + 1
+	}
+	for _, u := range urls {
+		b, err := NewBackend(u)
+		if err != nil {
+			return nil, err
+		}
+		s.backends = append(s.backends, b)
+	}
+	return s, nil
+}
+
+// Create creates a new file based on the given filename on every
+// destination.
+func (s MultiStorage) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	w := &multiWriter{
+		name:     name,
+		required: s.required,
+		total:    len(s.backends),
+	}
+	for _, b := range s.backends {
+		// Each destination is discarded on its own by cancelling its
+		// context.
+		ctx, cancel := context.WithCancel(ctx)
+		f, err := b.Create(ctx, name)
+		if err != nil {
+			cancel()
+			w.errs = append(w.errs, err)
+			continue
+		}
+		w.writers = append(w.writers, &destinationWriter{f, b, cancel})
+	}
+	if len(w.writers) < s.required {
+		for _, f := range w.writers {
+			f.discard()
+		}
+		return nil, w.error()
+	}
+	return w, nil
+}
+
+// Open opens the given filename, from the first destination having it. It
+// only fails with ErrNotExist when no destination has it, and otherwise
+// with the failure of the first unavailable destination.
+func (s MultiStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	var errs []error
+	for _, b := range s.backends {
+		r, err := b.Open(ctx, name)
+		if err == nil {
+			return r, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, firstError(errs)
+}
+
+// firstError returns the first error which isn't ErrNotExist, or the first
+// one if all are.
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if !errors.Is(err, ErrNotExist) {
+			return err
+		}
+	}
+	return errs[0]
+}
+
+// List lists all files presents in the file storage below the given prefix,
+// or the file of the given name when it doesn't end with a slash.
+func (s MultiStorage) List(ctx context.Context, name string) (files []io.ReadCloser, err error) {
+	names, err := s.Names(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		file, err := s.Open(ctx, name)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Names lists the names of all files presents in any of the destinations
+// below the given prefix, unavailable destinations are ignored unless none
+// are or the other ones have no such files, as they could be the only ones
+// having them.
+func (s MultiStorage) Names(ctx context.Context, name string) ([]string, error) {
+	var (
+		first     error
+		available int
+	)
+	seen := make(map[string]bool)
+	var names []string
+	for _, b := range s.backends {
+		n, err := b.Names(ctx, name)
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		available++
+		for _, n := range n {
+			if !seen[n] {
+				seen[n] = true
+				names = append(names, n)
+			}
+		}
+	}
+	if available == 0 || (first != nil && len(names) == 0) {
+		return nil, first
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Size returns the size of the given filename, from the first destination
+// having it, failing as Open does.
+func (s MultiStorage) Size(ctx context.Context, name string) (int64, error) {
+	var errs []error
+	for _, b := range s.backends {
+		size, err := b.Size(ctx, name)
+		if err == nil {
+			return size, nil
+		}
+		errs = append(errs, err)
+	}
+	return 0, firstError(errs)
+}
+
+// Delete deletes the given filename from every destination.
+func (s MultiStorage) Delete(ctx context.Context, name string) error {
+	var errs []error
+	for _, b := range s.backends {
+		if err := b.Delete(ctx, name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(s.backends)-len(errs) < s.required {
+		return multiError(errs, len(s.backends))
+	}
+	return nil
+}
+
+// multiWriter tees writes to every destination, destinations failing are
+// discarded as long as enough of them remain.
+type multiWriter struct {
+	name     string
+	writers  []*destinationWriter
+	errs     []error
+	required int
+	total    int
+	err      error
+}
+
+// destinationWriter writes the file to a destination, discarded by
+// cancelling the context it was created with.
+type destinationWriter struct {
+	io.WriteCloser
+	b      Backend
+	cancel context.CancelFunc
+}
+
+func (f *destinationWriter) Close() error {
+	defer f.cancel()
+	return f.WriteCloser.Close()
+}
+
+func (f *destinationWriter) discard() {
+	f.cancel()
+	f.WriteCloser.Close()
+}
+
+func (w *multiWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	var writers []*destinationWriter
+	for _, f := range w.writers {
+		if _, err := f.Write(p); err != nil {
+			w.errs = append(w.errs, err)
+			f.discard()
+			continue
+		}
+		writers = append(writers, f)
+	}
+	w.writers = writers
+	if len(w.writers) < w.required {
+		w.err = w.error()
+		return 0, w.err
+	}
+	return len(p), nil
+}
+
+// Close stores the file on the remaining destinations, unless a write
+// failed on too many of them, in which case it is discarded everywhere.
+// When too few destinations stored it, it is deleted from the ones which
+// did, any previous file of the same name being lost on them.
+func (w *multiWriter) Close() error {
+	if w.err != nil {
+		for _, f := range w.writers {
+			f.discard()
+		}
+		w.writers = nil
+		return w.err
+	}
+	var stored []Backend
+	for _, f := range w.writers {
+		if err := f.Close(); err != nil {
+			w.errs = append(w.errs, err)
+			continue
+		}
+		stored = append(stored, f.b)
+	}
+	w.writers = nil
+	if len(stored) < w.required {
+		// The deletion can't be bound to the context of the file, which
+		// might be done.
+		ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+		defer cancel()
+		for _, b := range stored {
+			b.Delete(ctx, w.name)
+		}
+		return w.error()
+	}
+	return nil
+}
+
+func (w *multiWriter) error() error {
+	return multiError(w.errs, w.total)
+}
+
+// multiError returns the failures of destinations, matching the errors of
+// each of them.
+func multiError(errs []error, total int) error {
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return &destinationsError{
+		msg:  fmt.Sprintf("multi: %d of %d destinations failed: %s", len(errs), total, strings.Join(messages, "; ")),
+		errs: errs,
+	}
+}
+
+type destinationsError struct {
+	msg  string
+	errs []error
+}
+
+func (e *destinationsError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the failures of each destination.
+func (e *destinationsError) Unwrap() []error {
+	return e.errs
+}
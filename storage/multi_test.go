@@ -0,0 +1,293 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// unavailableBackend fails every operation.
+type unavailableBackend struct{}
+
+var errUnavailable = errors.New("unavailable")
+
+func (unavailableBackend) Create(context.Context, string) (io.WriteCloser, error) {
+	return nil, errUnavailable
+}
+func (unavailableBackend) Open(context.Context, string) (io.ReadCloser, error) {
+	return nil, errUnavailable
+}
+func (unavailableBackend) List(context.Context, string) ([]io.ReadCloser, error) {
+	return nil, errUnavailable
+}
+func (unavailableBackend) Names(context.Context, string) ([]string, error) {
+	return nil, errUnavailable
+}
+func (unavailableBackend) Size(context.Context, string) (int64, error) {
+	return 0, errUnavailable
+}
+func (unavailableBackend) Delete(context.Context, string) error { return errUnavailable }
+
+// failingBackend fails writes after writing half of the content.
+type failingBackend struct {
+	Backend
+}
+
+func (b failingBackend) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	w, err := b.Backend.Create(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return failingWriter{w}, nil
+}
+
+type failingWriter struct {
+	io.WriteCloser
+}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	n, _ := w.WriteCloser.Write(p[:len(p)/2])
+	return n, errUnavailable
+}
+
+// closeFailingBackend fails to store files once written.
+type closeFailingBackend struct {
+	Backend
+}
+
+func (b closeFailingBackend) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	w, err := b.Backend.Create(ctx, name)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return closeFailingWriter{w, cancel}, nil
+}
+
+type closeFailingWriter struct {
+	io.WriteCloser
+	cancel context.CancelFunc
+}
+
+func (w closeFailingWriter) Close() error {
+	w.cancel()
+	w.WriteCloser.Close()
+	return errUnavailable
+}
+
+func TestMultiStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	s, err := NewStorage("multi:file://" + a + ",file://" + b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := s.Archive(context.Background(), "000000010000000000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("law")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{a, b} {
+		content, err := ioutil.ReadFile(filepath.Join(d, "wal_005", "000000010000000000000001.lzo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "law" {
+			t.Fatal("content don't match")
+		}
+	}
+	// Reads fall back to the next destination.
+	if err := os.Remove(filepath.Join(a, "wal_005", "000000010000000000000001.lzo")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.Unarchive(context.Background(), "000000010000000000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "law" {
+		t.Fatal("content don't match")
+	}
+	segments, err := s.Segments(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Fatalf("unexpected segments %v", segments)
+	}
+}
+
+func TestMultiStoragePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := func(name string) Backend {
+		b, err := NewBackend("file://" + filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	var tests = []struct {
+		required int
+		fails    bool
+	}{
+		{3, true},
+		{2, false},
+	}
+	for _, test := range tests {
+		s := &MultiStorage{
+			backends: []Backend{file("a"), unavailableBackend{}, file("b")},
+			required: test.required,
+		}
+		w, err := s.Create(context.Background(), "segment")
+		if err == nil {
+			w.Write([]byte("law"))
+			err = w.Close()
+		}
+		if (err != nil) != test.fails {
+			t.Errorf("failure don't match for %d required, wants %v got %v", test.required, test.fails, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "1 of 3 destinations failed") {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	s := &MultiStorage{
+		backends: []Backend{unavailableBackend{}, file("a")},
+		required: 1,
+	}
+	names, err := s.Names(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "segment" {
+		t.Fatalf("unexpected names %v", names)
+	}
+	r, err := s.Open(context.Background(), "segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+}
+
+func TestMultiStorageErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := func(name string) Backend {
+		b, err := NewBackend("file://" + filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	// A file is only missing when every destination is available.
+	s := &MultiStorage{backends: []Backend{file("a"), unavailableBackend{}}, required: 1}
+	if _, err := s.Open(context.Background(), "missing"); errors.Is(err, ErrNotExist) || !errors.Is(err, errUnavailable) {
+		t.Errorf("open with an unavailable destination should fail with its error, got %v", err)
+	}
+	if _, err := s.Size(context.Background(), "missing"); errors.Is(err, ErrNotExist) || !errors.Is(err, errUnavailable) {
+		t.Errorf("size with an unavailable destination should fail with its error, got %v", err)
+	}
+	if _, err := s.Names(context.Background(), "missing"); !errors.Is(err, errUnavailable) {
+		t.Errorf("names of a missing file with an unavailable destination should fail with its error, got %v", err)
+	}
+	s = &MultiStorage{backends: []Backend{file("a"), file("b")}, required: 2}
+	if _, err := s.Open(context.Background(), "missing"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("open of a missing file should fail with ErrNotExist, got %v", err)
+	}
+	// A file stored by too few destinations is deleted from them.
+	s = &MultiStorage{backends: []Backend{file("a"), closeFailingBackend{file("b")}}, required: 2}
+	w, err := s.Create(context.Background(), "partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("law"))
+	if err := w.Close(); !errors.Is(err, errUnavailable) {
+		t.Errorf("close stored by too few destinations should fail, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "partial")); !os.IsNotExist(err) {
+		t.Errorf("file stored by too few destinations should be deleted, got %v", err)
+	}
+	// Destinations failing writes are discarded, rather than storing a
+	// truncated file.
+	var tests = []struct {
+		required int
+		stored   []string
+	}{
+		{1, []string{"a"}},
+		{2, nil},
+	}
+	for _, test := range tests {
+		name := fmt.Sprintf("segment-%d", test.required)
+		s := &MultiStorage{
+			backends: []Backend{file("a"), failingBackend{file("b")}},
+			required: test.required,
+		}
+		w, err := s.Create(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("law"))
+		w.Close()
+		var stored []string
+		for _, d := range []string{"a", "b"} {
+			if _, err := os.Stat(filepath.Join(dir, d, name)); err == nil {
+				stored = append(stored, d)
+			}
+		}
+		if !reflect.DeepEqual(stored, test.stored) {
+			t.Errorf("destinations storing the file don't match for %d required, wants %v got %v", test.required, test.stored, stored)
+		}
+	}
+}
+
+func TestMultiStorageURL(t *testing.T) {
+	var tests = []struct {
+		uri      string
+		required int
+	}{
+		{"multi:file:///tmp/a,file:///tmp/b", 2},
+		{"multi+quorum:file:///tmp/a,file:///tmp/b,file:///tmp/c", 2},
+		{"multi+quorum:file:///tmp/a,file:///tmp/b", 2},
+	}
+	for _, test := range tests {
+		s, err := NewMultiStorage(test.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.required != test.required {
+			t.Errorf("required don't match, wants %v got %v", test.required, s.required)
+		}
+	}
+	for _, uri := range []string{"multi:file:///tmp/a", "multi:file:///tmp/a,scheme://host"} {
+		if _, err := NewStorage(uri); err == nil {
+			t.Errorf("expected error for %s", uri)
+		}
+	}
+}
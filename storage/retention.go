@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// runsPrefix is the prefix of the recorded outcomes of runs.
+const runsPrefix = "runs/"
+
+// DeleteBackup deletes the files of the given backup from every layout,
+// its metadata first so a partially deleted backup isn't restored.
+func (s Storage) DeleteBackup(ctx context.Context, name string) error {
+	versions, err := s.versions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		prefix := fmt.Sprintf("basebackup_%s/%s/", v, name)
+		names, err := s.b.Names(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		sort.SliceStable(names, func(i, j int) bool {
+			return isMetadata(names[i]) && !isMetadata(names[j])
+		})
+		for _, n := range names {
+			if err := s.b.Delete(ctx, n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteSegment deletes the given wal segment from every layout.
+func (s Storage) DeleteSegment(ctx context.Context, name string) error {
+	versions, err := s.versions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err := s.b.Delete(ctx, fmt.Sprintf("wal_%s/%s.lzo", v, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateRun returns a writer to record the outcome of the given run.
+func (s Storage) CreateRun(ctx context.Context, name string) (*Writer, error) {
+	return s.create(ctx, runsPrefix+name+".json")
+}
+
+// Runs returns readers of the last n recorded runs, oldest first.
+func (s Storage) Runs(ctx context.Context, n int) ([]io.ReadCloser, error) {
+	names, err := s.b.Names(ctx, runsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	if len(names) > n {
+		names = names[len(names)-n:]
+	}
+	var runs []io.ReadCloser
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		r, err := s.b.Open(ctx, name)
+		if err != nil {
+			for _, run := range runs {
+				run.Close()
+			}
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, nil
+}
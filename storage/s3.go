@@ -1,79 +1,403 @@
 package storage
 
 import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
-
-	s3 "github.com/cyberdelia/aws/s3"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
 )
 
+var s3RegionMatcher = regexp.MustCompile(`\w{2}-(\w+|gov-\w+)-\d+`)
+
 // S3Storage represents a s3 based file storage.
 type S3Storage struct {
 	u      *url.URL
 	client *http.Client
+
+	sse                string
+	kmsKeyID           string
+	walStorageClass    string
+	backupStorageClass string
+	concurrency        int
+}
+
+// s3MaxConcurrency bounds the default number of parts transferred in
+// parallel, and so the memory used by buffers.
+const s3MaxConcurrency = 4
+
+func s3Concurrency() int {
+	if n := runtime.NumCPU(); n < s3MaxConcurrency {
+		return n
+	}
+	return s3MaxConcurrency
 }
 
 // NewS3Storage create a new S3Storage base on
-// a s3:// URL.
-func NewS3Storage(u *url.URL) *S3Storage {
-	u.RawQuery = ""
-	return &S3Storage{
-		u:      u,
-		client: s3.DefaultClient,
+// a s3://bucket/prefix URL.
+//
+// The endpoint, region and path_style query parameters allow to use S3
+// compatible services, such as
+// s3://bucket/prefix?endpoint=http://minio:9000&region=eu-west-1&path_style=true.
+// Path style addressing is the default when an endpoint is given. URLs
+// naming an AWS endpoint as host, such as s3://s3.amazonaws.com/bucket/prefix,
+// are still supported.
+//
+// Objects are encrypted with the sse option, either AES256 (the default),
+// aws:kms with the key given by sse_kms_key_id, customer with the base64 key
+// from S3_SSE_CUSTOMER_KEY, or none. The wal_storage_class and
+// backup_storage_class options set the storage class of WAL segments and
+// base backups, and concurrency the number of parts uploaded or downloaded
+// in parallel, each buffering 16MB in memory, which defaults to the number
+// of CPUs up to 4. Options can also be set in the environment, as S3_SSE,
+// S3_SSE_KMS_KEY_ID, S3_WAL_STORAGE_CLASS, S3_BACKUP_STORAGE_CLASS and
+// S3_CONCURRENCY.
+func NewS3Storage(u *url.URL) (*S3Storage, error) {
+	q := u.Query()
+	region := q.Get("region")
+	if region == "" && strings.HasSuffix(u.Host, ".amazonaws.com") {
+		region = s3RegionMatcher.FindString(u.Host)
+	}
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	t := &s3Transport{
+		signer: &s3Signer{
+			region: region,
+		},
+		credentials: newAWSCredentialChain(),
+	}
+	path := strings.Trim(u.Path, "/")
+	if strings.HasSuffix(u.Host, ".amazonaws.com") {
+		// Legacy URL, naming the endpoint and the bucket in the path.
+		t.endpoint = &url.URL{Scheme: "https", Host: u.Host}
+		t.pathStyle = true
+		parts := strings.SplitN(path, "/", 2)
+		u = &url.URL{Host: parts[0]}
+		if len(parts) == 2 {
+			u.Path = parts[1]
+		}
+	} else {
+		u = &url.URL{Host: u.Host, Path: path}
+		t.endpoint = &url.URL{Scheme: "https", Host: "s3." + region + ".amazonaws.com"}
+		if endpoint := q.Get("endpoint"); endpoint != "" {
+			e, err := url.Parse(endpoint)
+			if err != nil {
+				return nil, fmt.Errorf("s3: invalid endpoint: %v", err)
+			}
+			if e.Scheme != "http" && e.Scheme != "https" {
+				return nil, fmt.Errorf("s3: invalid endpoint: %s", endpoint)
+			}
+			t.endpoint = &url.URL{Scheme: e.Scheme, Host: e.Host}
+			t.pathStyle = true
+		}
+	}
+	if u.Host == "" {
+		return nil, errors.New("s3: storage URL must be s3://bucket/prefix")
+	}
+	if style := q.Get("path_style"); style != "" {
+		b, err := strconv.ParseBool(style)
+		if err != nil {
+			return nil, fmt.Errorf("s3: invalid path_style: %s", style)
+		}
+		t.pathStyle = b
+	}
+	// Objects are addressed using path style URLs, which are rewritten by
+	// the transport.
+	prefix := "/" + u.Host + "/"
+	if u.Path != "" {
+		prefix += u.Path + "/"
+	}
+	s := &S3Storage{
+		u: &url.URL{
+			Scheme: "s3",
+			Host:   s3Host,
+			Path:   prefix,
+		},
+		client: &http.Client{
+			Transport: t,
+		},
+		sse:                s3Option(q, "sse", "S3_SSE"),
+		kmsKeyID:           s3Option(q, "sse_kms_key_id", "S3_SSE_KMS_KEY_ID"),
+		walStorageClass:    s3Option(q, "wal_storage_class", "S3_WAL_STORAGE_CLASS"),
+		backupStorageClass: s3Option(q, "backup_storage_class", "S3_BACKUP_STORAGE_CLASS"),
+		concurrency:        s3Concurrency(),
+	}
+	if c := s3Option(q, "concurrency", "S3_CONCURRENCY"); c != "" {
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("s3: invalid concurrency: %s", c)
+		}
+		s.concurrency = n
+	}
+	switch s.sse {
+	case "":
+		s.sse = "AES256"
+	case "AES256", "none":
+	case "aws:kms":
+		if s.kmsKeyID == "" {
+			return nil, errors.New("s3: sse_kms_key_id required with aws:kms encryption")
+		}
+	case "customer":
+		key, err := base64.StdEncoding.DecodeString(os.Getenv("S3_SSE_CUSTOMER_KEY"))
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("s3: S3_SSE_CUSTOMER_KEY must be a base64 encoded 256-bit key")
+		}
+		sum := md5.Sum(key)
+		t.customerKey = base64.StdEncoding.EncodeToString(key)
+		t.customerKeyMD5 = base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		return nil, fmt.Errorf("s3: unsupported encryption: %s", s.sse)
 	}
+	return s, nil
 }
 
-// Create creates a new file based on the given filename.
-func (s S3Storage) Create(name string) (io.WriteCloser, error) {
-	uri, err := urlJoin(name, s.u)
+func s3Option(q url.Values, name, env string) string {
+	if v := q.Get(name); v != "" {
+		return v
+	}
+	return os.Getenv(env)
+}
+
+// Create creates a new file based on the given filename, using a
+// multipart upload which is aborted if the context is done before the
+// upload completes.
+func (s S3Storage) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	uri, err := s.object(name)
 	if err != nil {
 		return nil, err
 	}
-	return s3.Create(uri, http.Header{
-		"x-amz-server-side-encryption": []string{"AES256"},
-	}, s.client)
+	h := make(http.Header)
+	switch s.sse {
+	case "AES256":
+		h.Set("x-amz-server-side-encryption", "AES256")
+	case "aws:kms":
+		h.Set("x-amz-server-side-encryption", "aws:kms")
+		h.Set("x-amz-server-side-encryption-aws-kms-key-id", s.kmsKeyID)
+	}
+	switch {
+	case strings.HasPrefix(name, "wal_") && s.walStorageClass != "":
+		h.Set("x-amz-storage-class", s.walStorageClass)
+	case strings.HasPrefix(name, "basebackup_") && s.backupStorageClass != "":
+		h.Set("x-amz-storage-class", s.backupStorageClass)
+	}
+	return newS3Writer(ctx, s.client, uri, h, s.concurrency)
 }
 
-// Open opens the given filename.
-func (s S3Storage) Open(name string) (io.ReadCloser, error) {
-	uri, err := urlJoin(name, s.u)
+// Open opens the given filename, downloading parts of the file
+// concurrently.
+func (s S3Storage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	uri, err := s.object(name)
 	if err != nil {
 		return nil, err
 	}
-	r, _, err := s3.Open(uri, s.client)
-	return r, err
+	return newS3Reader(ctx, s.client, uri, s.concurrency)
 }
 
-// List lists all files presents in the file storage after the given prefix.
-func (s S3Storage) List(name string) (files []io.ReadCloser, err error) {
-	uri, err := urlJoin(name, s.u)
+// List lists all files presents in the file storage below the given prefix,
+// or the file of the given name when it doesn't end with a slash.
+func (s S3Storage) List(ctx context.Context, name string) (files []io.ReadCloser, err error) {
+	names, err := s.Names(ctx, name)
 	if err != nil {
 		return nil, err
 	}
-	err = s3.Walk(uri, func(path string, info os.FileInfo) error {
+	for _, name := range names {
+		file, err := s.Open(ctx, name)
 		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return s3.SkipDir
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
 		}
-		uri, err := urlJoin(path, s.u)
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Names lists the names of all files presents in the file storage below the
+// given prefix, or the file of the given name when it doesn't end with a
+// slash.
+func (s S3Storage) Names(ctx context.Context, name string) (names []string, err error) {
+	uri, err := urlJoin(name, s.u)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = "https"
+	path := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if len(path) != 2 {
+		return nil, fmt.Errorf("s3: missing bucket in %s", uri)
+	}
+	u.Path = "/" + path[0]
+	q := url.Values{
+		"list-type": []string{"2"},
+		"prefix":    []string{path[1]},
+	}
+	for {
+		u.RawQuery = q.Encode()
+		req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		file, _, err := s3.Open(uri, nil)
+		resp, err := s3Do(s.client, req, nil)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		files = append(files, file)
-		return nil
-	}, s.client)
+		var l struct {
+			Truncated bool     `xml:"IsTruncated"`
+			Token     string   `xml:"NextContinuationToken"`
+			Keys      []string `xml:"Contents>Key"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&l)
+		resp.Body.Close()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		for _, key := range l.Keys {
+			if strings.HasSuffix(key, "/") {
+				continue
+			}
+			if n := name + strings.TrimPrefix(key, path[1]); matchName(name, n) {
+				names = append(names, n)
+			}
+		}
+		if !l.Truncated {
+			return names, nil
+		}
+		q.Set("continuation-token", l.Token)
+	}
+}
+
+// Size returns the size of the given filename.
+func (s S3Storage) Size(ctx context.Context, name string) (int64, error) {
+	uri, err := s.object(name)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "HEAD", uri, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s3Do(s.client, req, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("s3: unknown size of %s", name)
+	}
+	return resp.ContentLength, nil
+}
+
+// Delete deletes the given filename.
+func (s S3Storage) Delete(ctx context.Context, name string) error {
+	uri, err := s.object(name)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "DELETE", uri, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s3Do(s.client, req, nil)
+	if err != nil {
+		if errors.Is(err, ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// object returns the URL of the given file, as a path style URL to the
+// placeholder host.
+func (s S3Storage) object(name string) (string, error) {
+	uri, err := urlJoin(name, s.u)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = "https"
+	return u.String(), nil
+}
+
+// s3Host is the placeholder host of requests, rewritten by the transport.
+const s3Host = "s3.law"
+
+// s3Transport sends requests to the configured endpoint, and signs them for
+// the configured region.
+type s3Transport struct {
+	endpoint  *url.URL
+	pathStyle bool
+	signer    *s3Signer
+
+	credentials    *awsCredentialChain
+	customerKey    string
+	customerKeyMD5 string
+}
+
+// RoundTrip implements the RoundTripper interface.
+func (t *s3Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	credentials, err := t.credentials.Credentials(r.Context())
 	if err != nil {
 		return nil, err
 	}
-	return files, nil
+	c := new(http.Request)
+	*c = *r
+	c.URL = t.rewrite(r.URL)
+	c.Host = ""
+	c.Header = make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		c.Header[k] = append([]string(nil), v...)
+	}
+	// Customer provided keys are required by every request to an object,
+	// but deletions.
+	object := len(strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 2)) == 2
+	if t.customerKey != "" && object && r.Method != "DELETE" {
+		c.Header.Set("x-amz-server-side-encryption-customer-algorithm", "AES256")
+		c.Header.Set("x-amz-server-side-encryption-customer-key", t.customerKey)
+		c.Header.Set("x-amz-server-side-encryption-customer-key-md5", t.customerKeyMD5)
+	}
+	t.signer.Sign(c, credentials)
+	return roundTrip(c)
+}
+
+// rewrite turns a path style URL to the bucket into an URL to the
+// endpoint, using virtual host style addressing if needed.
+func (t *s3Transport) rewrite(u *url.URL) *url.URL {
+	r := new(url.URL)
+	*r = *u
+	r.Scheme = t.endpoint.Scheme
+	r.Host = t.endpoint.Host
+	if !t.pathStyle {
+		parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+		r.Host = parts[0] + "." + t.endpoint.Host
+		r.Path = "/"
+		if len(parts) == 2 {
+			r.Path += parts[1]
+		}
+		r.RawPath = ""
+	}
+	return r
 }
 
 func urlJoin(name string, prefix *url.URL) (string, error) {
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+type s3Chunk struct {
+	b   []byte
+	err error
+}
+
+// s3Reader downloads an object in ranges of parts, fetched concurrently
+// ahead of reads.
+type s3Reader struct {
+	cancel context.CancelFunc
+	chunks chan chan s3Chunk
+	buf    *bytes.Reader
+	err    error
+	// stopped is set before chunks is closed when downloading stopped
+	// ahead of the end of the object.
+	stopped error
+}
+
+// newS3Reader retrieves the size and the ETag of the object, and starts
+// downloading up to concurrency parts of that version in the background.
+func newS3Reader(ctx context.Context, client *http.Client, uri string, concurrency int) (*s3Reader, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s3Do(client, req, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("s3: unknown size of %s", uri)
+	}
+	etag := resp.Header.Get("ETag")
+	ctx, cancel := context.WithCancel(ctx)
+	r := &s3Reader{
+		cancel: cancel,
+		chunks: make(chan chan s3Chunk, concurrency),
+		buf:    bytes.NewReader(nil),
+	}
+	go func() {
+		defer close(r.chunks)
+		for offset := int64(0); offset < resp.ContentLength; offset += s3PartSize {
+			c := make(chan s3Chunk, 1)
+			select {
+			case r.chunks <- c:
+			case <-ctx.Done():
+				r.stopped = ctx.Err()
+				return
+			}
+			end := offset + s3PartSize - 1
+			if end >= resp.ContentLength {
+				end = resp.ContentLength - 1
+			}
+			go func(offset, end int64) {
+				b, err := s3Range(ctx, client, uri, etag, offset, end)
+				c <- s3Chunk{b, err}
+			}(offset, end)
+		}
+	}()
+	return r, nil
+}
+
+// s3Range downloads a range of the object, failing with ErrTransient once
+// the object doesn't match the given ETag anymore, as parts of different
+// versions can't be mixed.
+func s3Range(ctx context.Context, client *http.Client, uri, etag string, offset, end int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, end))
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+	resp, err := s3Do(client, req, nil)
+	if err != nil {
+		var e *s3Error
+		if errors.As(err, &e) && e.StatusCode == http.StatusPreconditionFailed {
+			return nil, &Error{Kind: ErrTransient, Err: fmt.Errorf("s3: %s changed while downloading", uri)}
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("s3: unexpected range response: (%d)", resp.StatusCode)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) != end-offset+1 {
+		return nil, fmt.Errorf("s3: short range, got %d bytes of %d", len(b), end-offset+1)
+	}
+	return b, nil
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	for r.err == nil && r.buf.Len() == 0 {
+		c, ok := <-r.chunks
+		if !ok {
+			r.err = io.EOF
+			if r.stopped != nil {
+				r.err = r.stopped
+			}
+			break
+		}
+		chunk := <-c
+		if chunk.err != nil {
+			r.err = chunk.err
+			break
+		}
+		r.buf.Reset(chunk.b)
+	}
+	if r.buf.Len() > 0 {
+		return r.buf.Read(p)
+	}
+	return 0, r.err
+}
+
+// Close stops downloading parts ahead.
+func (r *s3Reader) Close() error {
+	r.cancel()
+	return nil
+}
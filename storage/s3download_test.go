@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"testing"
+)
+
+func TestS3Download(t *testing.T) {
+	defer setS3Credentials()()
+	f, srv := newFakeS3()
+	defer srv.Close()
+	u, _ := url.Parse("s3://bucket/prefix?endpoint=" + srv.URL + "&concurrency=2")
+	s, err := NewS3Storage(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"small", 1024},
+		{"part", s3PartSize},
+		{"parts", 3*s3PartSize + 1},
+	}
+	for _, tt := range tests {
+		content := bytes.Repeat([]byte("l"), tt.size)
+		f.mu.Lock()
+		f.objects["prefix/"+tt.name] = content
+		f.requests = nil
+		f.mu.Unlock()
+		r, err := s.Open(context.Background(), tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("content of %s don't match, wants %d bytes got %d", tt.name, len(content), len(b))
+		}
+		f.mu.Lock()
+		ranges := 0
+		for _, req := range f.requests {
+			if req.Method == "GET" && req.Header.Get("Range") != "" {
+				ranges++
+			}
+		}
+		f.mu.Unlock()
+		if expected := (tt.size + s3PartSize - 1) / s3PartSize; ranges != expected {
+			t.Errorf("ranges of %s don't match, wants %v got %v", tt.name, expected, ranges)
+		}
+	}
+	if _, err := s.Open(context.Background(), "missing"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("opening a missing object should fail with ErrNotExist, got %v", err)
+	}
+}
+
+func TestS3DownloadClose(t *testing.T) {
+	defer setS3Credentials()()
+	f, srv := newFakeS3()
+	defer srv.Close()
+	u, _ := url.Parse("s3://bucket/prefix?endpoint=" + srv.URL + "&concurrency=1")
+	s, err := NewS3Storage(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.objects["prefix/a"] = make([]byte, 4*s3PartSize)
+	r, err := s.Open(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1024)
+	if _, err := r.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	// Closing stops downloading parts ahead, reads then fail.
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("reading a closed object should fail")
+	}
+}
+
+func TestS3DownloadOverwritten(t *testing.T) {
+	defer setS3Credentials()()
+	f, srv := newFakeS3()
+	defer srv.Close()
+	u, _ := url.Parse("s3://bucket/prefix?endpoint=" + srv.URL + "&concurrency=1")
+	s, err := NewS3Storage(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.objects["prefix/a"] = make([]byte, 4*s3PartSize)
+	r, err := s.Open(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b := make([]byte, 1024)
+	if _, err := r.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	// Parts of the object overwritten meanwhile aren't mixed with the
+	// parts already read.
+	f.mu.Lock()
+	f.objects["prefix/a"] = bytes.Repeat([]byte("l"), 4*s3PartSize)
+	f.mu.Unlock()
+	if _, err := ioutil.ReadAll(r); !errors.Is(err, ErrTransient) {
+		t.Errorf("reading an overwritten object should fail with ErrTransient, got %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, req := range f.requests {
+		if req.Header.Get("Range") != "" && req.Header.Get("If-Match") == "" {
+			t.Errorf("range request without If-Match: %s", req.Header.Get("Range"))
+		}
+	}
+}
+
+func TestS3Delete(t *testing.T) {
+	defer setS3Credentials()()
+	f, srv := newFakeS3()
+	defer srv.Close()
+	u, _ := url.Parse("s3://bucket/prefix?endpoint=" + srv.URL)
+	s, err := NewS3Storage(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.objects["prefix/a"] = []byte("law")
+	for i := 0; i < 2; i++ {
+		// Deleting a missing object succeeds.
+		if err := s.Delete(context.Background(), "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := f.objects["prefix/a"]; ok {
+		t.Error("object should be deleted")
+	}
+}
@@ -0,0 +1,293 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cyberdelia/law/metrics"
+)
+
+const (
+	s3PartSize = 16 * 1024 * 1024
+	s3Retries  = 5
+)
+
+// s3Backoff is the longest delay before the first retry of a request,
+// doubled for each following retry.
+var s3Backoff = 100 * time.Millisecond
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// s3Writer uploads data in parts to a multipart upload, the integrity of
+// each part is checked by S3 using its Content-MD5.
+type s3Writer struct {
+	ctx      context.Context
+	client   *http.Client
+	url      string
+	uploadID string
+	buf      *bytes.Buffer
+
+	wg    sync.WaitGroup
+	sem   chan struct{}
+	mu    sync.Mutex
+	parts []s3Part
+	err   error
+}
+
+// newS3Writer initiates a multipart upload, with the given headers applied
+// to the resulting object, uploading up to concurrency parts in parallel.
+func newS3Writer(ctx context.Context, client *http.Client, uri string, h http.Header, concurrency int) (*s3Writer, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", uri+"?uploads", nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	resp, err := s3Do(client, req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var r struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	return &s3Writer{
+		ctx:      ctx,
+		client:   client,
+		url:      uri,
+		uploadID: r.UploadID,
+		buf:      new(bytes.Buffer),
+		sem:      make(chan struct{}, concurrency),
+	}, nil
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if err := w.error(); err != nil {
+		return 0, err
+	}
+	n, _ := w.buf.Write(p)
+	for w.buf.Len() >= s3PartSize {
+		w.flush(w.buf.Next(s3PartSize))
+	}
+	return n, nil
+}
+
+// flush uploads a copy of the given part in the background.
+func (w *s3Writer) flush(p []byte) {
+	b := make([]byte, len(p))
+	copy(b, p)
+	w.mu.Lock()
+	n := len(w.parts) + 1
+	w.parts = append(w.parts, s3Part{PartNumber: n})
+	w.mu.Unlock()
+	w.wg.Add(1)
+	w.sem <- struct{}{}
+	go func() {
+		defer func() {
+			<-w.sem
+			w.wg.Done()
+		}()
+		etag, err := w.upload(n, b)
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if err != nil {
+			if w.err == nil {
+				w.err = err
+			}
+			return
+		}
+		w.parts[n-1].ETag = etag
+	}()
+}
+
+func (w *s3Writer) upload(n int, b []byte) (string, error) {
+	q := url.Values{
+		"partNumber": []string{strconv.Itoa(n)},
+		"uploadId":   []string{w.uploadID},
+	}
+	req, err := http.NewRequestWithContext(w.ctx, "PUT", w.url+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	sum := md5.Sum(b)
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	resp, err := s3Do(w.client, req, b)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("s3: no ETag for part %d", n)
+	}
+	return etag, nil
+}
+
+func (w *s3Writer) error() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close uploads the remaining data and completes the upload, which is
+// aborted on failure or once the context is done.
+func (w *s3Writer) Close() error {
+	if (w.buf.Len() > 0 || len(w.parts) == 0) && w.ctx.Err() == nil {
+		w.flush(w.buf.Bytes())
+		w.buf.Reset()
+	}
+	w.wg.Wait()
+	if err := w.error(); err != nil {
+		w.abort()
+		return err
+	}
+	if err := w.complete(); err != nil {
+		w.abort()
+		return err
+	}
+	return nil
+}
+
+func (w *s3Writer) complete() error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(w.ctx, "POST", w.url+"?uploadId="+url.QueryEscape(w.uploadID), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s3Do(w.client, req, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// A completion can fail after a 200 OK response was sent.
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var e s3Error
+	if xml.Unmarshal(b, &e) == nil && e.XMLName.Local == "Error" {
+		e.StatusCode = resp.StatusCode
+		return &e
+	}
+	return nil
+}
+
+// abort aborts the upload, even once the context is done.
+func (w *s3Writer) abort() {
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "DELETE", w.url+"?uploadId="+url.QueryEscape(w.uploadID), nil)
+	if err != nil {
+		return
+	}
+	if resp, err := s3Do(w.client, req, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// s3Do sends a request with the given body, retrying on network and
+// internal errors after an exponential backoff with full jitter, as
+// recommended.
+func s3Do(client *http.Client, req *http.Request, body []byte) (resp *http.Response, err error) {
+	for i := 0; i < s3Retries; i++ {
+		if i > 0 {
+			if err := s3Wait(req.Context(), i); err != nil {
+				return nil, err
+			}
+			metrics.Retries.Inc("s3")
+		}
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			req.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(body)), nil
+			}
+			req.ContentLength = int64(len(body))
+		}
+		resp, err = client.Do(req)
+		if err != nil {
+			if req.Context().Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		err = newS3Error(resp)
+		if resp.StatusCode < 500 {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// s3Wait waits for a random delay of up to the backoff of the given retry,
+// unless the context is done first.
+func s3Wait(ctx context.Context, retry int) error {
+	t := time.NewTimer(time.Duration(rand.Int63n(int64(s3Backoff << uint(retry-1)))))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type s3Error struct {
+	XMLName    xml.Name
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func newS3Error(resp *http.Response) error {
+	defer resp.Body.Close()
+	e := &s3Error{
+		StatusCode: resp.StatusCode,
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	xml.Unmarshal(b, e)
+	return e
+}
+
+// Is reports whether the status code of the error is classified by the
+// target, such as ErrNotExist when the object doesn't exist.
+func (e *s3Error) Is(target error) bool {
+	return statusIs(target, e.StatusCode)
+}
+
+func (e *s3Error) Error() string {
+	if e.Code != "" && e.Message != "" {
+		return fmt.Sprintf("s3: unexpected error: (%s) %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("s3: unexpected error: (%d)", e.StatusCode)
+}
@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPStorage represents a SFTP based file storage.
+type SFTPStorage struct {
+	addr    string
+	basedir string
+	config  *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *sftp.Client
+}
+
+// NewSFTPStorage creates a new SFTPStorage based on the given
+// sftp://user@host/path URL.
+//
+// Authentication uses the private key referenced by SFTP_IDENTITY_FILE, or
+// the SSH agent listening on SSH_AUTH_SOCK otherwise. Host keys are
+// verified against SFTP_KNOWN_HOSTS, defaulting to ~/.ssh/known_hosts.
+func NewSFTPStorage(u *url.URL) (*SFTPStorage, error) {
+	if u.Host == "" {
+		return nil, errors.New("sftp: storage URL must be sftp://user@host/path")
+	}
+	user := os.Getenv("USER")
+	if u.User != nil {
+		user = u.User.Username()
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	auth, err := sftpAuth()
+	if err != nil {
+		return nil, err
+	}
+	hosts := os.Getenv("SFTP_KNOWN_HOSTS")
+	if hosts == "" {
+		hosts = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(hosts)
+	if err != nil {
+		return nil, fmt.Errorf("sftp: unable to load known hosts: %v", err)
+	}
+	return &SFTPStorage{
+		addr:    addr,
+		basedir: u.Path,
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{auth},
+			HostKeyCallback: callback,
+		},
+	}, nil
+}
+
+func sftpAuth() (ssh.AuthMethod, error) {
+	if identity := os.Getenv("SFTP_IDENTITY_FILE"); identity != "" {
+		b, err := ioutil.ReadFile(identity)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("sftp: invalid identity file: %v", err)
+		}
+		return ssh.PublicKeys(signer), nil
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, fmt.Errorf("sftp: unable to connect to agent: %v", err)
+		}
+		return ssh.PublicKeysCallback(agent.NewClient(conn).Signers), nil
+	}
+	return nil, errors.New("sftp: SFTP_IDENTITY_FILE or SSH_AUTH_SOCK required")
+}
+
+// connect returns the SFTP client, connecting on first use or once the
+// connection of the previous client was lost.
+func (s *SFTPStorage) connect(ctx context.Context) (*sftp.Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	sc, chans, reqs, err := ssh.NewClientConn(c, s.addr, s.config)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	conn := ssh.NewClient(sc, chans, reqs)
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.client = client
+	return client, nil
+}
+
+// reset forgets the client when the given error shows its connection was
+// lost, for the next call to connect again.
+func (s *SFTPStorage) reset(client *sftp.Client, err error) error {
+	var netErr net.Error
+	if errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.EOF) || errors.As(err, &netErr) {
+		s.mu.Lock()
+		if s.client == client {
+			s.client = nil
+		}
+		s.mu.Unlock()
+		client.Close()
+	}
+	return err
+}
+
+// Create creates a new file based on the given filename, the file is
+// uploaded under a temporary name and renamed when closed, unless the
+// context is done.
+func (s *SFTPStorage) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filename := path.Join(s.basedir, name)
+	if err := client.MkdirAll(path.Dir(filename)); err != nil {
+		return nil, s.reset(client, err)
+	}
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	tmp := path.Join(path.Dir(filename), "."+path.Base(filename)+"."+hex.EncodeToString(suffix))
+	f, err := client.Create(tmp)
+	if err != nil {
+		return nil, s.reset(client, err)
+	}
+	return &sftpWriter{
+		File:     f,
+		ctx:      ctx,
+		s:        s,
+		client:   client,
+		tmp:      tmp,
+		filename: filename,
+	}, nil
+}
+
+// Open opens the given filename.
+func (s *SFTPStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Open(path.Join(s.basedir, name))
+	if err != nil {
+		return nil, s.reset(client, err)
+	}
+	return f, nil
+}
+
+// List lists all files presents in the file storage below the given prefix,
+// or the file of the given name when it doesn't end with a slash.
+func (s *SFTPStorage) List(ctx context.Context, name string) (files []io.ReadCloser, err error) {
+	names, err := s.Names(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		file, err := s.Open(ctx, name)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Names lists the names of all files presents in the file storage below the
+// given prefix, or the file of the given name when it doesn't end with a
+// slash.
+func (s *SFTPStorage) Names(ctx context.Context, name string) (names []string, err error) {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	walker := client.Walk(path.Join(s.basedir, name))
+	for walker.Step() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := walker.Err(); err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, s.reset(client, err)
+		}
+		if walker.Stat().IsDir() || path.Base(walker.Path())[0] == '.' {
+			continue
+		}
+		rel, err := filepath.Rel(s.basedir, walker.Path())
+		if err != nil {
+			return nil, err
+		}
+		if rel = filepath.ToSlash(rel); matchName(name, rel) {
+			names = append(names, rel)
+		}
+	}
+	return names, nil
+}
+
+// Size returns the size of the given filename.
+func (s *SFTPStorage) Size(ctx context.Context, name string) (int64, error) {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+	info, err := client.Stat(path.Join(s.basedir, name))
+	if err != nil {
+		return 0, s.reset(client, err)
+	}
+	return info.Size(), nil
+}
+
+// Delete deletes the given filename.
+func (s *SFTPStorage) Delete(ctx context.Context, name string) error {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if err := client.Remove(path.Join(s.basedir, name)); err != nil && !os.IsNotExist(err) {
+		return s.reset(client, err)
+	}
+	return nil
+}
+
+// sftpWriter renames the temporary file to its final name once closed.
+type sftpWriter struct {
+	*sftp.File
+	ctx      context.Context
+	s        *SFTPStorage
+	client   *sftp.Client
+	tmp      string
+	filename string
+	err      error
+}
+
+func (w *sftpWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.err = w.ctx.Err(); w.err != nil {
+		return 0, w.err
+	}
+	var n int
+	n, w.err = w.File.Write(p)
+	return n, w.err
+}
+
+func (w *sftpWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.err = w.ctx.Err(); w.err != nil {
+		return 0, w.err
+	}
+	var n int64
+	n, w.err = w.File.ReadFrom(r)
+	return n, w.err
+}
+
+func (w *sftpWriter) Close() error {
+	err := w.File.Close()
+	if err == nil {
+		err = w.err
+	}
+	if err == nil {
+		err = w.ctx.Err()
+	}
+	if err != nil {
+		w.client.Remove(w.tmp)
+		return w.s.reset(w.client, err)
+	}
+	// Servers without the posix-rename extension can only rename to a
+	// name which doesn't exist yet.
+	if err := w.client.PosixRename(w.tmp, w.filename); err != nil {
+		if err := w.client.Rename(w.tmp, w.filename); err != nil {
+			w.client.Remove(w.tmp)
+			return w.s.reset(w.client, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newSFTPServer starts an in-process SSH server accepting the given client
+// key and serving the SFTP subsystem.
+func newSFTPServer(t *testing.T, hostKey ssh.Signer, clientKey ssh.PublicKey) net.Listener {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "law" && bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(hostKey)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+	return l
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for c := range chans {
+		if c.ChannelType() != "session" {
+			c.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, requests, err := c.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						return
+					}
+					server.Serve()
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+func newSFTPKey(t *testing.T) (ssh.Signer, []byte) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(block)
+}
+
+// newSFTPTestStorage starts an in-process SSH server, and returns the URL
+// of a storage on it along with a function stopping it.
+func newSFTPTestStorage(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, _ := newSFTPKey(t)
+	clientKey, identity := newSFTPKey(t)
+	l := newSFTPServer(t, hostKey, clientKey.PublicKey())
+	identityFile := filepath.Join(dir, "id_ed25519")
+	if err := ioutil.WriteFile(identityFile, identity, 0600); err != nil {
+		t.Fatal(err)
+	}
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(l.Addr().String())}, hostKey.PublicKey())
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SFTP_IDENTITY_FILE", identityFile)
+	os.Setenv("SFTP_KNOWN_HOSTS", knownHosts)
+	return "sftp://law@" + l.Addr().String() + filepath.Join(dir, "storage"), func() {
+		os.Unsetenv("SFTP_IDENTITY_FILE")
+		os.Unsetenv("SFTP_KNOWN_HOSTS")
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSFTPStorage(t *testing.T) {
+	uri, cleanup := newSFTPTestStorage(t)
+	defer cleanup()
+	s, err := NewStorage(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(uri)
+	content := bytes.Repeat([]byte("law"), 1024*1024)
+	for _, name := range []string{"000000010000000000000001", "000000010000000000000002"} {
+		w, err := s.Archive(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(u.Path, "wal_005", name+".lzo")); !os.IsNotExist(err) {
+			t.Fatal("segment visible before upload completed")
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err := s.Segments(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || segments[1] != "000000010000000000000002" {
+		t.Fatalf("unexpected segments %v", segments)
+	}
+	r, err := s.Unarchive(context.Background(), "000000010000000000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Fatal("content don't match")
+	}
+	if err := s.b.Delete(context.Background(), "wal_005/000000010000000000000001.lzo"); err != nil {
+		t.Fatal(err)
+	}
+	segments, err = s.Segments(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Fatalf("unexpected segments after delete %v", segments)
+	}
+}
+
+func TestSFTPStorageReconnect(t *testing.T) {
+	uri, cleanup := newSFTPTestStorage(t)
+	defer cleanup()
+	u, _ := url.Parse(uri)
+	s, err := NewSFTPStorage(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := s.Create(context.Background(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Closing the client drops its connection as a restarting server would.
+	s.client.Close()
+	if _, err := s.Size(context.Background(), "file"); err == nil {
+		t.Fatal("expected size to fail on the lost connection")
+	}
+	if _, err := s.Size(context.Background(), "file"); err != nil {
+		t.Fatalf("expected size to succeed once reconnected, got %v", err)
+	}
+}
+
+func TestSFTPStorageUnknownHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "law")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hostKey, _ := newSFTPKey(t)
+	otherKey, _ := newSFTPKey(t)
+	clientKey, identity := newSFTPKey(t)
+	l := newSFTPServer(t, hostKey, clientKey.PublicKey())
+	defer l.Close()
+	identityFile := filepath.Join(dir, "id_ed25519")
+	if err := ioutil.WriteFile(identityFile, identity, 0600); err != nil {
+		t.Fatal(err)
+	}
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(l.Addr().String())}, otherKey.PublicKey())
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SFTP_IDENTITY_FILE", identityFile)
+	defer os.Unsetenv("SFTP_IDENTITY_FILE")
+	os.Setenv("SFTP_KNOWN_HOSTS", knownHosts)
+	defer os.Unsetenv("SFTP_KNOWN_HOSTS")
+
+	s, err := NewStorage("sftp://law@" + l.Addr().String() + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Segments(context.Background()); err == nil {
+		t.Fatal("expected host key mismatch")
+	}
+}
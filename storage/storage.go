@@ -1,67 +1,357 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/url"
+	"sort"
+	"strings"
+	"time"
 )
 
 // CurrentVersion is a version prefix to be used by storage backends.
 const CurrentVersion = "005"
 
+// abortTimeout bounds the requests cleaning up after a failed or cancelled
+// upload, which can't be bound to the context of the upload.
+const abortTimeout = 30 * time.Second
+
+// credentialsTimeout bounds the requests exchanging tokens for credentials,
+// along with the context of the request needing them.
+const credentialsTimeout = 10 * time.Second
+
 // Backend represents a storage backend.
+//
+// Names and List only consider files below the given prefix when it ends
+// with a slash, or the file with the given name otherwise. Size returns the
+// size of a file from its metadata, without reading it. Deleting a file
+// which doesn't exist is not an error. Files created are only stored once
+// their writer is closed, unless the context is done or a write failed by
+// then, in which case any previous file of the same name is kept.
 type Backend interface {
-	Create(name string) (io.WriteCloser, error)
-	Open(name string) (io.ReadCloser, error)
-	List(name string) ([]io.ReadCloser, error)
+	Create(ctx context.Context, name string) (io.WriteCloser, error)
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	List(ctx context.Context, name string) ([]io.ReadCloser, error)
+	Names(ctx context.Context, name string) ([]string, error)
+	Size(ctx context.Context, name string) (int64, error)
+	Delete(ctx context.Context, name string) error
 }
 
 // Storage represents a storage facility.
 type Storage struct {
-	b Backend
+	b      Backend
+	layout *layoutCache
+	uri    string
+	log    *slog.Logger
 }
 
 // NewStorage create a new storage facility, using
 // the appropriate storage backend.
 func NewStorage(uri string) (*Storage, error) {
+	b, err := NewBackend(uri)
+	if err != nil {
+		return nil, err
+	}
+	s := &Storage{
+		b:      b,
+		layout: new(layoutCache),
+		uri:    uri,
+	}
+	s.SetLogger(slog.Default())
+	return s, nil
+}
+
+// SetLogger sets the logger of the storage, which records the storage URL
+// without its credentials.
+func (s *Storage) SetLogger(l *slog.Logger) {
+	s.log = l.With("storage", RedactURL(s.uri))
+}
+
+// RedactURL returns the given storage URL without credentials, replacing
+// passwords and secret looking query parameters by REDACTED.
+func RedactURL(uri string) string {
+	for _, prefix := range []string{"multi:", "multi+quorum:"} {
+		if strings.HasPrefix(uri, prefix) {
+			urls := strings.Split(strings.TrimPrefix(uri, prefix), ",")
+			for i, u := range urls {
+				urls[i] = RedactURL(strings.TrimSpace(u))
+			}
+			return prefix + strings.Join(urls, ",")
+		}
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "REDACTED"
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "REDACTED")
+		}
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for k := range q {
+			if secretParameter(k) {
+				q.Set(k, "REDACTED")
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+func secretParameter(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"key", "secret", "token", "password", "sig"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchName reports whether the file listed below the prefix given to
+// Names is part of its result, the prefix only matching the file of the
+// same name when it doesn't end with a slash.
+func matchName(prefix, name string) bool {
+	return prefix == "" || strings.HasSuffix(prefix, "/") || name == prefix
+}
+
+// NewBackend creates the storage backend for the given URL.
+func NewBackend(uri string) (Backend, error) {
+	if strings.HasPrefix(uri, "multi:") || strings.HasPrefix(uri, "multi+quorum:") {
+		return NewMultiStorage(uri)
+	}
 	u, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
 	}
-	var b Backend
 	switch u.Scheme {
 	case "file":
-		b = NewFileStorage(u)
+		return NewFileStorage(u), nil
 	case "s3":
-		b = NewS3Storage(u)
+		return NewS3Storage(u)
+	case "gs":
+		return NewGCSStorage(u)
+	case "azure":
+		return NewAzureStorage(u)
+	case "sftp":
+		return NewSFTPStorage(u)
+	case "mem":
+		return NewMemStorage(u), nil
 	default:
 		return nil, fmt.Errorf("unsupported storage : %s", u.Scheme)
 	}
-	return &Storage{
-		b: b,
-	}, nil
 }
 
 // Archive returns a writer to archive the given wal segment.
-func (s Storage) Archive(name string) (io.WriteCloser, error) {
+func (s Storage) Archive(ctx context.Context, name string) (*Writer, error) {
 	filename := fmt.Sprintf("wal_%s/%s.lzo", CurrentVersion, name)
-	return s.b.Create(filename)
+	return s.create(ctx, filename)
 }
 
-// Unarchive returns a reader to restore the given wal segment.
-func (s Storage) Unarchive(name string) (io.ReadCloser, error) {
-	filename := fmt.Sprintf("wal_%s/%s.lzo", CurrentVersion, name)
-	return s.b.Open(filename)
+// ArchiveSize returns the size of the given archived wal segment as
+// stored, looking for it in prior layouts of the storage when missing.
+func (s Storage) ArchiveSize(ctx context.Context, name string) (int64, error) {
+	versions, err := s.versions(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, v := range versions {
+		var size int64
+		size, err = s.b.Size(ctx, fmt.Sprintf("wal_%s/%s.lzo", v, name))
+		if !errors.Is(err, ErrNotExist) {
+			return size, err
+		}
+	}
+	return 0, err
+}
+
+// Unarchive returns a reader to restore the given wal segment, looking for
+// it in prior layouts of the storage when missing.
+func (s Storage) Unarchive(ctx context.Context, name string) (io.ReadCloser, error) {
+	versions, err := s.versions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		var r io.ReadCloser
+		r, err = s.b.Open(ctx, fmt.Sprintf("wal_%s/%s.lzo", v, name))
+		if !errors.Is(err, ErrNotExist) {
+			return r, err
+		}
+	}
+	return nil, err
 }
 
 // Backup returns a writer to archive the given backup.
-func (s Storage) Backup(name, offset string, n int) (io.WriteCloser, error) {
+func (s Storage) Backup(ctx context.Context, name, offset string, n int) (*Writer, error) {
 	filename := fmt.Sprintf("basebackup_%s/base_%s_%s/part_%d.tar.lzo", CurrentVersion, name, offset, n)
-	return s.b.Create(filename)
+	return s.create(ctx, filename)
+}
+
+// Restore returns readers of the partitions of the given backup, failing
+// with ErrNotExist when it isn't stored.
+func (s Storage) Restore(ctx context.Context, name string) ([]io.ReadCloser, error) {
+	prefix, names, err := s.backup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var parts []io.ReadCloser
+	for _, name := range names {
+		if !strings.HasPrefix(strings.TrimPrefix(name, prefix), "part_") {
+			continue
+		}
+		r, err := s.b.Open(ctx, name)
+		if err != nil {
+			for _, part := range parts {
+				part.Close()
+			}
+			return nil, err
+		}
+		parts = append(parts, r)
+	}
+	return parts, nil
+}
+
+// BackupMetadata returns a writer to store the metadata of the given backup.
+func (s Storage) BackupMetadata(ctx context.Context, name, offset string) (*Writer, error) {
+	filename := fmt.Sprintf("basebackup_%s/base_%s_%s/metadata.json", CurrentVersion, name, offset)
+	return s.create(ctx, filename)
+}
+
+// RestoreMetadata returns a reader to the metadata of the given backup, or
+// nil if the backup has none, failing with ErrNotExist when it isn't
+// stored.
+func (s Storage) RestoreMetadata(ctx context.Context, name string) (io.ReadCloser, error) {
+	prefix, names, err := s.backup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		if n == prefix+"metadata.json" {
+			return s.b.Open(ctx, n)
+		}
+	}
+	return nil, nil
+}
+
+// backup returns the prefix and the names of the files of the given backup,
+// from the first layout holding it, failing with ErrNotExist when none
+// does.
+func (s Storage) backup(ctx context.Context, name string) (string, []string, error) {
+	versions, err := s.versions(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, v := range versions {
+		prefix := fmt.Sprintf("basebackup_%s/%s/", v, name)
+		names, err := s.b.Names(ctx, prefix)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(names) > 0 {
+			return prefix, names, nil
+		}
+	}
+	return "", nil, fmt.Errorf("unknown backup %s: %w", name, ErrNotExist)
+}
+
+// Segments returns the names of all archived wal segments.
+func (s Storage) Segments(ctx context.Context) ([]string, error) {
+	return s.names(ctx, "wal_", func(name string) (string, bool) {
+		return strings.TrimSuffix(name, ".lzo"), strings.HasSuffix(name, ".lzo")
+	})
+}
+
+// Backups returns the names of all stored backups.
+func (s Storage) Backups(ctx context.Context) ([]string, error) {
+	return s.names(ctx, "basebackup_", func(name string) (string, bool) {
+		parts := strings.SplitN(name, "/", 2)
+		return parts[0], len(parts) == 2
+	})
+}
+
+// names returns the sorted and unique names of files of every layout below
+// the given prefix, as extracted by fn from their names within the layout.
+func (s Storage) names(ctx context.Context, prefix string, fn func(string) (string, bool)) ([]string, error) {
+	versions, err := s.versions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, v := range versions {
+		p := prefix + v + "/"
+		files, err := s.b.Names(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			name, ok := fn(strings.TrimPrefix(file, p))
+			if !ok || seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// create creates the given file, logging the bytes stored once closed, or
+// the file discarded when it fails.
+func (s Storage) create(ctx context.Context, name string) (*Writer, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	w, err := s.b.Create(ctx, name)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &Writer{
+		w:      w,
+		cancel: cancel,
+		log:    s.log.With("file", name),
+		start:  time.Now(),
+	}, nil
+}
+
+// Writer writes a file to the storage, which is stored once closed or
+// discarded once aborted.
+type Writer struct {
+	w      io.WriteCloser
+	cancel context.CancelFunc
+	log    *slog.Logger
+	start  time.Time
+	n      int64
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Close stores the file.
+func (w *Writer) Close() error {
+	defer w.cancel()
+	err := w.w.Close()
+	if err != nil {
+		w.log.Warn("discarded file", "bytes", w.n, "error", err)
+	} else {
+		w.log.Debug("stored file", "bytes", w.n, "duration", time.Since(w.start))
+	}
+	return err
 }
 
-// Restore returns a reader to restore the given backup.
-func (s Storage) Restore(name string) ([]io.ReadCloser, error) {
-	filename := fmt.Sprintf("basebackup_%s/%s/", CurrentVersion, name)
-	return s.b.List(filename)
+// Abort discards the file, keeping any file previously stored under the
+// same name.
+func (w *Writer) Abort() {
+	w.cancel()
+	w.w.Close()
+	w.log.Debug("aborted file", "bytes", w.n)
 }
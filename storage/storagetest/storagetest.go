@@ -0,0 +1,274 @@
+// Package storagetest implements a conformance suite for storage backends.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cyberdelia/law/storage"
+)
+
+// LargeSize is the size of the large stream, spanning several parts or
+// chunks of uploads.
+const LargeSize = 3*16*1024*1024 + 1
+
+// TestBackend checks that an empty backend follows the semantics expected
+// by law.
+func TestBackend(t *testing.T, b storage.Backend) {
+	t.Run("Missing", func(t *testing.T) { testMissing(t, b) })
+	t.Run("CreateOpen", func(t *testing.T) { testCreateOpen(t, b) })
+	t.Run("Empty", func(t *testing.T) { testEmpty(t, b) })
+	t.Run("Names", func(t *testing.T) { testNames(t, b) })
+	t.Run("Root", func(t *testing.T) { testRoot(t, b) })
+	t.Run("List", func(t *testing.T) { testList(t, b) })
+	t.Run("Size", func(t *testing.T) { testSize(t, b) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, b) })
+	t.Run("Large", func(t *testing.T) { testLarge(t, b) })
+	t.Run("Cancel", func(t *testing.T) { testCancel(t, b) })
+}
+
+func testMissing(t *testing.T, b storage.Backend) {
+	if _, err := b.Open(context.Background(), "missing/file"); !errors.Is(err, storage.ErrNotExist) {
+		t.Errorf("open of a missing file should fail with ErrNotExist, got %v", err)
+	}
+	if _, err := b.Size(context.Background(), "missing/file"); !errors.Is(err, storage.ErrNotExist) {
+		t.Errorf("size of a missing file should fail with ErrNotExist, got %v", err)
+	}
+	names, err := b.Names(context.Background(), "missing/")
+	if err != nil {
+		t.Errorf("names of a missing prefix should succeed, got %v", err)
+	}
+	if len(names) != 0 {
+		t.Errorf("names of a missing prefix should be empty, got %v", names)
+	}
+	if err := b.Delete(context.Background(), "missing/file"); err != nil {
+		t.Errorf("delete of a missing file should succeed, got %v", err)
+	}
+}
+
+func testCreateOpen(t *testing.T, b storage.Backend) {
+	for _, content := range []string{"law", "overwritten"} {
+		write(t, b, "create/file", []byte(content))
+		if got := read(t, b, "create/file"); string(got) != content {
+			t.Errorf("content don't match, wants %q got %q", content, got)
+		}
+	}
+}
+
+func testEmpty(t *testing.T, b storage.Backend) {
+	write(t, b, "empty/file", nil)
+	if got := read(t, b, "empty/file"); len(got) != 0 {
+		t.Errorf("content don't match, wants empty got %q", got)
+	}
+}
+
+func testNames(t *testing.T, b storage.Backend) {
+	for _, name := range []string{"names/a", "names/b/c", "names/b/cd", "names2/d"} {
+		write(t, b, name, []byte(name))
+	}
+	names, err := b.Names(context.Background(), "names/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if expected := []string{"names/a", "names/b/c", "names/b/cd"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("names don't match, wants %v got %v", expected, names)
+	}
+	names, err = b.Names(context.Background(), "names/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "names/b/c" {
+		t.Errorf("names don't match, wants %v got %v", []string{"names/b/c"}, names)
+	}
+	// A name without a trailing slash isn't a prefix of other files.
+	names, err = b.Names(context.Background(), "names/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("names don't match, wants none got %v", names)
+	}
+}
+
+// testRoot checks that the names of all files, listed with an empty prefix,
+// are the names they were created with. Backends with a prefix of their own
+// mustn't list files of a sibling prefix sharing its beginning.
+func testRoot(t *testing.T, b storage.Backend) {
+	write(t, b, "root/file", []byte("law"))
+	names, err := b.Names(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, name := range names {
+		if name == "root/file" {
+			found = true
+		}
+		if strings.HasPrefix(name, "/") {
+			t.Errorf("listed name %q should be relative", name)
+		}
+		if _, err := b.Size(context.Background(), name); err != nil {
+			t.Errorf("size of listed file %q should succeed, got %v", name, err)
+		}
+	}
+	if !found {
+		t.Errorf("names should contain %q, got %v", "root/file", names)
+	}
+}
+
+func testList(t *testing.T, b storage.Backend) {
+	for _, name := range []string{"list/a", "list/b/c"} {
+		write(t, b, name, []byte(name))
+	}
+	files, err := b.List(context.Background(), "list/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, f := range files {
+		content, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(content))
+	}
+	sort.Strings(contents)
+	if expected := []string{"list/a", "list/b/c"}; !reflect.DeepEqual(contents, expected) {
+		t.Errorf("contents don't match, wants %v got %v", expected, contents)
+	}
+}
+
+func testSize(t *testing.T, b storage.Backend) {
+	for _, content := range []string{"", "law"} {
+		write(t, b, "size/file", []byte(content))
+		size, err := b.Size(context.Background(), "size/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(content)) {
+			t.Errorf("size don't match, wants %v got %v", len(content), size)
+		}
+	}
+}
+
+func testDelete(t *testing.T, b storage.Backend) {
+	write(t, b, "delete/a", []byte("law"))
+	write(t, b, "delete/b", []byte("law"))
+	if err := b.Delete(context.Background(), "delete/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Open(context.Background(), "delete/a"); !errors.Is(err, storage.ErrNotExist) {
+		t.Errorf("open of a deleted file should fail with ErrNotExist, got %v", err)
+	}
+	names, err := b.Names(context.Background(), "delete/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "delete/b" {
+		t.Errorf("names don't match, wants %v got %v", []string{"delete/b"}, names)
+	}
+}
+
+func testLarge(t *testing.T, b storage.Backend) {
+	w, err := b.Create(context.Background(), "large/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := sha256.New()
+	src := io.TeeReader(io.LimitReader(rand.New(rand.NewSource(1)), LargeSize), written)
+	if _, err := io.Copy(w, src); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := b.Open(context.Background(), "large/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	read := sha256.New()
+	n, err := io.Copy(read, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != LargeSize {
+		t.Fatalf("size don't match, wants %v got %v", LargeSize, n)
+	}
+	if !bytes.Equal(read.Sum(nil), written.Sum(nil)) {
+		t.Fatal("content don't match")
+	}
+}
+
+func testCancel(t *testing.T, b storage.Backend) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := b.Create(ctx, "cancel/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("law"))
+	cancel()
+	if err := w.Close(); err == nil {
+		t.Error("close of a cancelled file should fail")
+	}
+	if _, err := b.Open(context.Background(), "cancel/file"); !errors.Is(err, storage.ErrNotExist) {
+		t.Errorf("cancelled file should not be stored, got %v", err)
+	}
+	// A cancelled file keeps the file previously stored under its name.
+	write(t, b, "cancel/file", []byte("law"))
+	ctx, cancel = context.WithCancel(context.Background())
+	w, err = b.Create(ctx, "cancel/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("overwritten"))
+	cancel()
+	w.Close()
+	if got := read(t, b, "cancel/file"); string(got) != "law" {
+		t.Errorf("content don't match, wants %q got %q", "law", got)
+	}
+	names, err := b.Names(context.Background(), "cancel/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "cancel/file" {
+		t.Errorf("names don't match, wants %v got %v", []string{"cancel/file"}, names)
+	}
+}
+
+func write(t *testing.T, b storage.Backend, name string, content []byte) {
+	w, err := b.Create(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read(t *testing.T, b storage.Backend, name string) []byte {
+	r, err := b.Open(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}